@@ -0,0 +1,62 @@
+// Command migration-scaffold generates the boilerplate for migrating records
+// from one cbor-gen struct to another: a frozen copy of the old struct with its
+// cbor-gen methods, a stub migration function that copies the fields the structs
+// share, and a versioned builder for the migration. It is meant to be run with
+// go generate, from the package with both structs:
+//
+//	//go:generate go run github.com/filecoin-project/go-ds-versioning/cmd/migration-scaffold -old FruitBasket -new FruitBasketV2 -old-version 1 -new-version 2
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/scaffold"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+func main() {
+	var cfg scaffold.Config
+	var oldVersion, newVersion, out string
+	flag.StringVar(&cfg.Dir, "dir", ".", "directory of the package with both structs")
+	flag.StringVar(&cfg.OldType, "old", "", "struct records are migrated from")
+	flag.StringVar(&cfg.NewType, "new", "", "struct records are migrated to")
+	flag.StringVar(&cfg.FrozenType, "frozen", "", "name for the frozen copy of the old struct (default: old struct with the old version appended)")
+	flag.StringVar(&oldVersion, "old-version", "", "version records are migrated from (empty for an initial migration)")
+	flag.StringVar(&newVersion, "new-version", "", "version records are migrated to")
+	flag.StringVar(&out, "out", "", "file to write, relative to -dir (default: migration_<new-version>.go)")
+	flag.Parse()
+	cfg.OldVersion = versioning.VersionKey(oldVersion)
+	cfg.NewVersion = versioning.VersionKey(newVersion)
+
+	if out == "" {
+		out = "migration_" + strings.ToLower(strings.Map(func(r rune) rune {
+			if r == '/' || r == '\\' || r == '.' {
+				return '_'
+			}
+			return r
+		}, newVersion)) + ".go"
+	}
+	outPath := filepath.Join(cfg.Dir, out)
+	// never overwrite a migration that may already be filled in, so that go
+	// generate can be rerun
+	if _, err := os.Stat(outPath); err == nil {
+		fmt.Fprintf(os.Stderr, "migration-scaffold: %s already exists, skipping\n", outPath)
+		return
+	}
+	src, err := scaffold.Generate(cfg)
+	if err != nil {
+		fail(err)
+	}
+	if err := os.WriteFile(outPath, src, 0644); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "migration-scaffold:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	gen "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+)
+
+func main() {
+	err := gen.WriteMapEncodersToFile("./internal/migrate/cbor_gen.go", "migrate",
+		migrate.MigrationLease{},
+		migrate.VersionRecord{},
+	)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,300 @@
+// Package bluegreen provides a datastore layer that reads and writes the records
+// of whichever version is current, and can build the next version alongside it
+// and switch over to it in one step
+package bluegreen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/atomic"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// Datastore reads and writes the records at the version it's bound to. Once a
+// staged version has been built, writes are migrated to it as well, so promoting
+// it loses nothing. Promoting waits for operations in flight, then rebinds the
+// datastore, so operations never see a mix of versions. Versions are staged and
+// promoted within a process, so a single process should use the store meanwhile
+type Datastore struct {
+	ds         datastore.Batching
+	migrations versioning.VersionedMigrationList
+	m          migrate.Migrator
+	bind       func(versioning.VersionKey) datastore.Batching
+
+	lk      sync.RWMutex
+	version versioning.VersionKey
+	current datastore.Batching
+	staged  *staged
+}
+
+// staged is a version being built or built alongside the current version
+type staged struct {
+	version versioning.VersionKey
+	ds      datastore.Batching
+	// migration migrates writes to the staged version, or is nil if writes can't
+	// be migrated one at a time
+	migration versioning.RecordMigration
+	building  bool
+	// outdated is set when the current version has been written in a way the
+	// staged version doesn't reflect
+	outdated atomic.Bool
+}
+
+// NewDatastore returns a datastore bound to the target version of ds, until
+// migrations find a later version was promoted, where bind returns the datastore
+// for the records of a version
+func NewDatastore(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey, m migrate.Migrator, bind func(versioning.VersionKey) datastore.Batching) *Datastore {
+	return &Datastore{ds: ds, migrations: migrations, m: m, bind: bind, version: target, current: bind(target)}
+}
+
+// RunMigrations returns a function to run migrations that migrates the datastore
+// to the target version, unless it's already at a later version that was
+// promoted, and binds the datastore to the version it ends up at
+func (d *Datastore) RunMigrations(m migrate.Migrator) runner.RunMigrationsFunc {
+	return func(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (versioning.VersionKey, error) {
+		version, err := m.ReadVersion(ctx, ds)
+		if err != nil && err != datastore.ErrNotFound {
+			return version, err
+		}
+		if err != nil || !migrate.KnownVersion(migrations, version) || migrate.Before(migrations, version, target) {
+			version = target
+		}
+		final, err := m.To(ctx, ds, migrations, version)
+		if err != nil {
+			return final, err
+		}
+		d.lk.Lock()
+		defer d.lk.Unlock()
+		if final != d.version {
+			d.version = final
+			d.current = d.bind(final)
+		}
+		return final, nil
+	}
+}
+
+// Stage builds a version one up from the version the datastore is bound to,
+// alongside it. Records written while it's built, or afterwards when its
+// migration can't migrate records one at a time, leave it out of date, and it
+// has to be staged again before it can be promoted
+func (d *Datastore) Stage(ctx context.Context, version versioning.VersionKey) error {
+	s := &staged{version: version, building: true}
+	d.lk.Lock()
+	if d.staged != nil && d.staged.building {
+		d.lk.Unlock()
+		return fmt.Errorf("version %q is already being staged", d.staged.version)
+	}
+	d.staged = s
+	d.lk.Unlock()
+
+	migration, err := d.m.Stage(ctx, d.ds, d.migrations, version)
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if err != nil {
+		d.staged = nil
+		return err
+	}
+	s.ds = d.bind(version)
+	s.migration, _ = versioning.MigrationAs[versioning.RecordMigration](migration)
+	s.building = false
+	return nil
+}
+
+// Promote makes a staged version current and rebinds the datastore to it, once
+// operations already in flight are done
+func (d *Datastore) Promote(ctx context.Context, version versioning.VersionKey) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if version == d.version {
+		return nil
+	}
+	s := d.staged
+	if s == nil || s.version != version {
+		return fmt.Errorf("version %q has not been staged", version)
+	}
+	if s.building {
+		return fmt.Errorf("version %q is still being staged", version)
+	}
+	if s.outdated.Load() {
+		return fmt.Errorf("records were written that version %q doesn't reflect, it must be staged again", version)
+	}
+	if err := d.m.Promote(ctx, d.ds, d.migrations, version); err != nil {
+		return err
+	}
+	d.version = version
+	d.current = s.ds
+	d.staged = nil
+	return nil
+}
+
+var _ versioning.Promoter = &Datastore{}
+
+// write is a single write to the datastore
+type write struct {
+	key    datastore.Key
+	value  []byte
+	delete bool
+}
+
+// commit makes a set of writes to the current version, and to a staged version
+// if there is one that's been built
+func (d *Datastore) commit(ctx context.Context, writes []write) error {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	var stagedWrites []write
+	s := d.staged
+	if s != nil && (s.building || s.migration == nil) {
+		s.outdated.Store(true)
+		s = nil
+	}
+	if s != nil {
+		for _, w := range writes {
+			if w.delete {
+				stagedWrites = append(stagedWrites, w)
+				continue
+			}
+			migrated, selected, err := s.migration.MigrateRecord(ctx, d.current, w.key, w.value)
+			if err != nil {
+				return fmt.Errorf("migrating write to staged version %q: %w", s.version, err)
+			}
+			stagedWrites = append(stagedWrites, write{key: w.key, value: migrated, delete: !selected})
+		}
+	}
+	if err := apply(ctx, d.current, writes); err != nil {
+		return err
+	}
+	if s == nil {
+		return nil
+	}
+	if err := apply(ctx, s.ds, stagedWrites); err != nil {
+		s.outdated.Store(true)
+		return fmt.Errorf("writing to staged version %q: %w", s.version, err)
+	}
+	return nil
+}
+
+func apply(ctx context.Context, ds datastore.Batching, writes []write) error {
+	batch, err := ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, w := range writes {
+		if w.delete {
+			err = batch.Delete(ctx, w.key)
+		} else {
+			err = batch.Put(ctx, w.key, w.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(ctx)
+}
+
+func (d *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.current.Get(ctx, key)
+}
+
+func (d *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.current.Has(ctx, key)
+}
+
+func (d *Datastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.current.GetSize(ctx, key)
+}
+
+// Query runs a query over the version the datastore is bound to when the query
+// starts. Promoting a version while results are being read doesn't rebind them
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.current.Query(ctx, q)
+}
+
+func (d *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return d.commit(ctx, []write{{key: key, value: value}})
+}
+
+func (d *Datastore) Delete(ctx context.Context, key datastore.Key) error {
+	return d.commit(ctx, []write{{key: key, delete: true}})
+}
+
+func (d *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.current.Sync(ctx, prefix)
+}
+
+func (d *Datastore) Close() error {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.current.Close()
+}
+
+// Batch returns a batch that's committed to whichever version the datastore is
+// bound to when it's committed
+func (d *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return &batch{d: d}, nil
+}
+
+var _ datastore.Batching = &Datastore{}
+
+// GetIndexEntry returns the value of a single entry in an index of the version
+// the datastore is bound to
+func (d *Datastore) GetIndexEntry(ctx context.Context, index string, key datastore.Key) ([]byte, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	indexed, ok := d.current.(versioning.IndexQuerier)
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", index)
+	}
+	return indexed.GetIndexEntry(ctx, index, key)
+}
+
+// QueryIndex runs a query over the entries of an index of the version the
+// datastore is bound to
+func (d *Datastore) QueryIndex(ctx context.Context, index string, q query.Query) (query.Results, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	indexed, ok := d.current.(versioning.IndexQuerier)
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", index)
+	}
+	return indexed.QueryIndex(ctx, index, q)
+}
+
+var _ versioning.IndexQuerier = &Datastore{}
+
+// batch buffers writes until it's committed
+type batch struct {
+	d      *Datastore
+	writes []write
+}
+
+func (b *batch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	b.writes = append(b.writes, write{key: key, value: value})
+	return nil
+}
+
+func (b *batch) Delete(ctx context.Context, key datastore.Key) error {
+	b.writes = append(b.writes, write{key: key, delete: true})
+	return nil
+}
+
+func (b *batch) Commit(ctx context.Context) error {
+	return b.d.commit(ctx, b.writes)
+}
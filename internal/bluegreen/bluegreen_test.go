@@ -0,0 +1,216 @@
+package bluegreen_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/bluegreen"
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+func TestDatastore(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "1"),
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		test                   func(t *testing.T, ds *bluegreen.Datastore)
+		expectedOutputDatabase map[string][]byte
+	}{
+		"promoting rebinds to the staged version": {
+			test: func(t *testing.T, ds *bluegreen.Datastore) {
+				require.NoError(t, ds.Stage(ctx, "2"))
+				value, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 7), value)
+				batch, err := ds.Batch(ctx)
+				require.NoError(t, err)
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/pears"), numData(t, 2)))
+				require.NoError(t, ds.Promote(ctx, "2"))
+				require.NoError(t, batch.Commit(ctx))
+				value, err = ds.Get(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 14), value)
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2", ""),
+				"/2/apples":         numData(t, 14),
+				"/2/pears":          numData(t, 2),
+			},
+		},
+		"writes after staging are migrated to the staged version": {
+			test: func(t *testing.T, ds *bluegreen.Datastore) {
+				require.NoError(t, ds.Stage(ctx, "2"))
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/oranges"), numData(t, 3)))
+				require.NoError(t, ds.Delete(ctx, datastore.NewKey("/apples")))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1", "2"),
+				"/1/oranges":        numData(t, 3),
+				"/2/oranges":        numData(t, 10),
+			},
+		},
+		"only staged versions can be promoted": {
+			test: func(t *testing.T, ds *bluegreen.Datastore) {
+				err := ds.Promote(ctx, "2")
+				require.EqualError(t, err, "version \"2\" has not been staged")
+				require.NoError(t, ds.Promote(ctx, "1"))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1", ""),
+				"/1/apples":         numData(t, 7),
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1", "")))
+			require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 7)))
+			bgDs := newDatastore(ds, migrations)
+			final, err := bgDs.RunMigrations(migrate.NewMigrator())(ctx, ds, migrations, "1")
+			require.NoError(t, err)
+			require.Equal(t, versioning.VersionKey("1"), final)
+
+			data.test(t, bgDs)
+
+			require.Equal(t, data.expectedOutputDatabase, dump(t, ds))
+		})
+	}
+}
+
+func TestDatastoreWritesWhileStaging(t *testing.T) {
+	ctx := context.Background()
+	staging := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		once.Do(func() {
+			close(staging)
+			<-release
+		})
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "1"),
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1", "")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 7)))
+	bgDs := newDatastore(ds, migrations)
+
+	staged := make(chan error, 1)
+	go func() {
+		staged <- bgDs.Stage(ctx, "2")
+	}()
+	<-staging
+	require.NoError(t, bgDs.Put(ctx, datastore.NewKey("/oranges"), numData(t, 3)))
+	close(release)
+	require.NoError(t, <-staged)
+
+	err = bgDs.Promote(ctx, "2")
+	require.EqualError(t, err, "records were written that version \"2\" doesn't reflect, it must be staged again")
+	require.NoError(t, bgDs.Stage(ctx, "2"))
+	require.NoError(t, bgDs.Promote(ctx, "2"))
+	require.Equal(t, map[string][]byte{
+		"/versions/current": versionData("2", ""),
+		"/2/apples":         numData(t, 14),
+		"/2/oranges":        numData(t, 10),
+	}, dump(t, ds))
+}
+
+func TestDatastoreRestart(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "1"),
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1", "")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 7)))
+	bgDs := newDatastore(ds, migrations)
+	_, err = bgDs.RunMigrations(migrate.NewMigrator())(ctx, ds, migrations, "1")
+	require.NoError(t, err)
+	require.NoError(t, bgDs.Stage(ctx, "2"))
+	require.NoError(t, bgDs.Promote(ctx, "2"))
+
+	// the migration to version 2 can't be reversed, so migrating back would fail
+	restarted := newDatastore(ds, migrations)
+	final, err := restarted.RunMigrations(migrate.NewMigrator())(ctx, ds, migrations, "1")
+	require.NoError(t, err)
+	require.Equal(t, versioning.VersionKey("2"), final)
+	value, err := restarted.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	require.Equal(t, numData(t, 14), value)
+	require.Equal(t, map[string][]byte{
+		"/versions/current": versionData("2", ""),
+		"/2/apples":         numData(t, 14),
+	}, dump(t, ds))
+}
+
+func newDatastore(ds datastore.Batching, migrations versioning.VersionedMigrationList) *bluegreen.Datastore {
+	return bluegreen.NewDatastore(ds, migrations, "1", migrate.NewMigrator(), func(version versioning.VersionKey) datastore.Batching {
+		return namespace.Wrap(ds, datastore.NewKey(string(version)))
+	})
+}
+
+func dump(t *testing.T, ds datastore.Read) map[string][]byte {
+	res, err := ds.Query(context.Background(), query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	outputDatabase := make(map[string][]byte)
+	for _, entry := range entries {
+		outputDatabase[entry.Key] = entry.Value
+	}
+	return outputDatabase
+}
+
+func versionData(versionKey versioning.VersionKey, staged versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(versionKey),
+		Staged:           string(staged),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func numData(t *testing.T, num int64) []byte {
+	buf := new(bytes.Buffer)
+	value := cbg.CborInt(num)
+	require.NoError(t, value.MarshalCBOR(buf))
+	return buf.Bytes()
+}
@@ -0,0 +1,142 @@
+// Package compat provides a read-only view of a datastore at a newer version
+// than the code using it knows, for when the code that wrote it recorded that
+// older code can still read it
+package compat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// Datastore reads the records at the version a datastore was left at, when
+// migrations leave it at a version the code doesn't know. Until then, and after
+// migrations that reach a known version, it has nothing to serve
+type Datastore struct {
+	ds datastore.Batching
+
+	lk      sync.RWMutex
+	version versioning.VersionKey
+	newer   datastore.Batching
+}
+
+// NewDatastore returns a view of the newer versions of ds
+func NewDatastore(ds datastore.Batching) *Datastore {
+	return &Datastore{ds: ds}
+}
+
+// RunMigrations wraps a function to run migrations, so the view serves the
+// version migrations leave the datastore at when it's one the code doesn't know
+func (d *Datastore) RunMigrations(run runner.RunMigrationsFunc) runner.RunMigrationsFunc {
+	return func(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (versioning.VersionKey, error) {
+		final, err := run(ctx, ds, migrations, target)
+		d.lk.Lock()
+		defer d.lk.Unlock()
+		if err == nil && !migrate.KnownVersion(migrations, final) && final != target {
+			d.version = final
+			d.newer = namespace.Wrap(d.ds, datastore.NewKey(string(final)))
+		} else {
+			d.version = versioning.VersionKey("")
+			d.newer = nil
+		}
+		return final, err
+	}
+}
+
+// Reading returns whether the datastore is at a newer version that reads
+// should be served from
+func (d *Datastore) Reading() bool {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.newer != nil
+}
+
+// Writable returns an error if the datastore is at a newer version, which this
+// code can read but not write
+func (d *Datastore) Writable() error {
+	if !d.Reading() {
+		return nil
+	}
+	return d.readOnlyError()
+}
+
+func (d *Datastore) readOnlyError() error {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return fmt.Errorf("%w: database is at version %q, which this code can only read", versioning.ErrStoreTooNew, d.version)
+}
+
+func (d *Datastore) reader() (datastore.Read, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if d.newer == nil {
+		return nil, versioning.ErrMigrationsNotRun
+	}
+	return d.newer, nil
+}
+
+func (d *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	reader, err := d.reader()
+	if err != nil {
+		return nil, err
+	}
+	return reader.Get(ctx, key)
+}
+
+func (d *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	reader, err := d.reader()
+	if err != nil {
+		return false, err
+	}
+	return reader.Has(ctx, key)
+}
+
+func (d *Datastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	reader, err := d.reader()
+	if err != nil {
+		return -1, err
+	}
+	return reader.GetSize(ctx, key)
+}
+
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	reader, err := d.reader()
+	if err != nil {
+		return nil, err
+	}
+	return reader.Query(ctx, q)
+}
+
+// Put fails, since the code can't write the newer version
+func (d *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return d.readOnlyError()
+}
+
+// Delete fails, since the code can't write the newer version
+func (d *Datastore) Delete(ctx context.Context, key datastore.Key) error {
+	return d.readOnlyError()
+}
+
+func (d *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return nil
+}
+
+// Close does nothing, since the view doesn't own the underlying datastore
+func (d *Datastore) Close() error {
+	return nil
+}
+
+// Batch fails, since the code can't write the newer version
+func (d *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return nil, d.readOnlyError()
+}
+
+var _ datastore.Batching = &Datastore{}
@@ -0,0 +1,416 @@
+// Package lazy provides a datastore layer that migrates records from the
+// previous version as they're read, while a store is being migrated lazily
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// Datastore reads and writes the records at the target version. While a lazy
+// step is in progress, records only found at the previous version are migrated
+// when they're read, and a sweeper migrates the rest in the background.
+// Migrating a record and writing it are serialized within a process, so a single
+// process should use the store while it's being migrated lazily
+type Datastore struct {
+	ds      datastore.Batching
+	current datastore.Batching
+
+	lk    sync.RWMutex
+	step  *migrate.LazyStep
+	old   datastore.Batching
+	sweep *sweep
+}
+
+type sweep struct {
+	step   migrate.LazyStep
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// NewDatastore returns a datastore over current, the records at the target
+// version of ds, which may be wrapped to maintain indexes
+func NewDatastore(ds datastore.Batching, current datastore.Batching) *Datastore {
+	return &Datastore{ds: ds, current: current}
+}
+
+// RunMigrations returns a function to run migrations that moves the datastore
+// up a version lazily when it can, starting to migrate records through this
+// datastore and sweeping them in the background
+func (d *Datastore) RunMigrations(m migrate.Migrator) runner.RunMigrationsFunc {
+	return func(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (versioning.VersionKey, error) {
+		final, step, err := m.LazyTo(ctx, ds, migrations, target)
+		if err == nil && step != nil {
+			d.start(*step, func(ctx context.Context) error {
+				return m.FinishLazy(ctx, ds, *step)
+			})
+		}
+		return final, err
+	}
+}
+
+// start begins migrating records for a lazy step, unless it's already being swept
+func (d *Datastore) start(step migrate.LazyStep, finish func(context.Context) error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.sweep != nil && d.sweep.step.From == step.From && d.sweep.step.To == step.To {
+		select {
+		case <-d.sweep.done:
+			if d.sweep.err == nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.step = &step
+	d.old = namespace.Wrap(d.ds, datastore.NewKey(string(step.From)))
+	d.sweep = &sweep{step: step, cancel: cancel, done: make(chan struct{})}
+	go d.runSweep(ctx, d.sweep, finish)
+}
+
+// runSweep migrates every record left at the previous version, then finishes the step
+func (d *Datastore) runSweep(ctx context.Context, s *sweep, finish func(context.Context) error) {
+	defer close(s.done)
+	s.err = d.sweepRecords(ctx)
+	if s.err == nil {
+		s.err = finish(ctx)
+	}
+	if s.err != nil {
+		return
+	}
+	d.lk.Lock()
+	d.step = nil
+	d.old = nil
+	d.lk.Unlock()
+}
+
+func (d *Datastore) sweepRecords(ctx context.Context) error {
+	d.lk.RLock()
+	old := d.old
+	d.lk.RUnlock()
+	qres, err := old.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := qres.Rest()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		select {
+		case <-ctx.Done():
+			return versioning.ErrContextCancelled
+		default:
+		}
+		if _, err := d.migrateRecord(ctx, datastore.NewKey(entry.Key)); err != nil && err != datastore.ErrNotFound {
+			return fmt.Errorf("sweeping records: %w", err)
+		}
+	}
+	return nil
+}
+
+// WaitSwept blocks until the records left at the previous version have all been
+// migrated, or the context expires
+func (d *Datastore) WaitSwept(ctx context.Context) error {
+	d.lk.RLock()
+	s := d.sweep
+	d.lk.RUnlock()
+	if s == nil {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return versioning.ErrContextCancelled
+	}
+}
+
+var _ versioning.Sweeper = &Datastore{}
+
+// migrateRecord migrates a record from the previous version and writes it to
+// the current version, returning datastore.ErrNotFound if there's no record to
+// migrate. If the record was written to the current version in the meantime,
+// it returns that
+func (d *Datastore) migrateRecord(ctx context.Context, key datastore.Key) ([]byte, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	value, err := d.current.Get(ctx, key)
+	if err != datastore.ErrNotFound || d.step == nil {
+		return value, err
+	}
+	oldValue, err := d.old.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	migrated, selected, err := d.step.Migration.MigrateRecord(ctx, d.old, key, oldValue)
+	if err != nil {
+		return nil, err
+	}
+	if !selected {
+		return nil, datastore.ErrNotFound
+	}
+	if err := d.current.Put(ctx, key, migrated); err != nil {
+		return nil, err
+	}
+	if err := d.old.Delete(ctx, key); err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+func (d *Datastore) migrating() bool {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.step != nil
+}
+
+func (d *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	value, err = d.current.Get(ctx, key)
+	if err != datastore.ErrNotFound || !d.migrating() {
+		return value, err
+	}
+	return d.migrateRecord(ctx, key)
+}
+
+func (d *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	exists, err = d.current.Has(ctx, key)
+	if err != nil || exists || !d.migrating() {
+		return exists, err
+	}
+	_, err = d.migrateRecord(ctx, key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Datastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	size, err = d.current.GetSize(ctx, key)
+	if err != datastore.ErrNotFound || !d.migrating() {
+		return size, err
+	}
+	value, err := d.migrateRecord(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+// Query streams the records still at the previous version, migrating them one
+// at a time, then the records at the current version. Records can move up while
+// the query runs, so it remembers the keys of the records it has migrated, and
+// only queries the current version once it's done with the previous one
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	d.lk.RLock()
+	step, old := d.step, d.old
+	d.lk.RUnlock()
+	if step == nil {
+		return d.current.Query(ctx, q)
+	}
+	oldRes, err := old.Query(ctx, query.Query{Prefix: q.Prefix})
+	if err != nil {
+		return nil, err
+	}
+	migrated := make(map[string]struct{})
+	var currentRes query.Results
+	nextOld := func() (query.Result, bool) {
+		for {
+			result, ok := oldRes.NextSync()
+			if !ok || result.Error != nil {
+				return result, ok
+			}
+			key := datastore.NewKey(result.Key)
+			has, err := d.current.Has(ctx, key)
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+			if has {
+				continue
+			}
+			value, selected, err := step.Migration.MigrateRecord(ctx, old, key, result.Value)
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+			if selected {
+				migrated[result.Key] = struct{}{}
+				return query.Result{Entry: query.Entry{Key: result.Key, Value: value}}, true
+			}
+		}
+	}
+	nextCurrent := func() (query.Result, bool) {
+		if currentRes == nil {
+			res, err := d.current.Query(ctx, query.Query{Prefix: q.Prefix})
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+			currentRes = res
+		}
+		for {
+			result, ok := currentRes.NextSync()
+			if !ok || result.Error != nil {
+				return result, ok
+			}
+			if _, ok := migrated[result.Key]; !ok {
+				return result, true
+			}
+		}
+	}
+	oldDone := false
+	results := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			var result query.Result
+			ok := false
+			if !oldDone {
+				result, ok = nextOld()
+				oldDone = !ok
+			}
+			if oldDone {
+				result, ok = nextCurrent()
+			}
+			if ok && result.Error == nil {
+				result.Size = len(result.Value)
+				if q.KeysOnly {
+					result.Value = nil
+				}
+			}
+			return result, ok
+		},
+		Close: func() error {
+			err := oldRes.Close()
+			if currentRes != nil {
+				err = multierr.Append(err, currentRes.Close())
+			}
+			return err
+		},
+	})
+	return query.NaiveQueryApply(q, results), nil
+}
+
+func (d *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if err := d.current.Put(ctx, key, value); err != nil {
+		return err
+	}
+	return d.deleteOld(ctx, []datastore.Key{key})
+}
+
+func (d *Datastore) Delete(ctx context.Context, key datastore.Key) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if err := d.current.Delete(ctx, key); err != nil {
+		return err
+	}
+	return d.deleteOld(ctx, []datastore.Key{key})
+}
+
+// deleteOld deletes the previous version of records that were written or
+// deleted at the current version, so they don't come back
+func (d *Datastore) deleteOld(ctx context.Context, keys []datastore.Key) error {
+	if d.step == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if err := d.old.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if err := d.current.Sync(ctx, prefix); err != nil {
+		return err
+	}
+	if d.step == nil {
+		return nil
+	}
+	return d.old.Sync(ctx, prefix)
+}
+
+// Close stops sweeping records and closes the underlying datastore
+func (d *Datastore) Close() error {
+	d.lk.RLock()
+	s := d.sweep
+	d.lk.RUnlock()
+	if s != nil {
+		s.cancel()
+		<-s.done
+	}
+	return d.current.Close()
+}
+
+func (d *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	batch, err := d.current.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &lazyBatch{d: d, batch: batch}, nil
+}
+
+var _ datastore.Batching = &Datastore{}
+
+// GetIndexEntry returns the value of a single entry in an index of the current
+// version, which only covers records that have been migrated
+func (d *Datastore) GetIndexEntry(ctx context.Context, index string, key datastore.Key) ([]byte, error) {
+	indexed, ok := d.current.(versioning.IndexQuerier)
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", index)
+	}
+	return indexed.GetIndexEntry(ctx, index, key)
+}
+
+// QueryIndex runs a query over the entries of an index of the current version,
+// which only covers records that have been migrated
+func (d *Datastore) QueryIndex(ctx context.Context, index string, q query.Query) (query.Results, error) {
+	indexed, ok := d.current.(versioning.IndexQuerier)
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", index)
+	}
+	return indexed.QueryIndex(ctx, index, q)
+}
+
+var _ versioning.IndexQuerier = &Datastore{}
+
+// lazyBatch deletes the previous version of every record it writes when it's
+// committed
+type lazyBatch struct {
+	d     *Datastore
+	batch datastore.Batch
+	keys  []datastore.Key
+}
+
+func (lb *lazyBatch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	lb.keys = append(lb.keys, key)
+	return lb.batch.Put(ctx, key, value)
+}
+
+func (lb *lazyBatch) Delete(ctx context.Context, key datastore.Key) error {
+	lb.keys = append(lb.keys, key)
+	return lb.batch.Delete(ctx, key)
+}
+
+func (lb *lazyBatch) Commit(ctx context.Context) error {
+	lb.d.lk.Lock()
+	defer lb.d.lk.Unlock()
+	if err := lb.batch.Commit(ctx); err != nil {
+		return err
+	}
+	return lb.d.deleteOld(ctx, lb.keys)
+}
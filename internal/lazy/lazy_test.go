@@ -0,0 +1,207 @@
+package lazy_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/lazy"
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/builder"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+func TestDatastore(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		if *c < 0 {
+			return nil, errors.New("negative count")
+		}
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "1"),
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1").Exclude(builder.KeyPrefix("/skipped")),
+	}.Build()
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		inputDatabase          map[string][]byte
+		test                   func(t *testing.T, ds datastore.Batching)
+		expectedSweepErr       error
+		expectedOutputDatabase map[string][]byte
+	}{
+		"reads migrate records": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":  numData(t, 7),
+				"/1/skipped": numData(t, 1),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				value, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 14), value)
+				has, err := ds.Has(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.True(t, has)
+				size, err := ds.GetSize(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, len(numData(t, 14)), size)
+				_, err = ds.Get(ctx, datastore.NewKey("/skipped"))
+				require.EqualError(t, err, datastore.ErrNotFound.Error())
+				has, err = ds.Has(ctx, datastore.NewKey("/skipped"))
+				require.NoError(t, err)
+				require.False(t, has)
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+			},
+		},
+		"queries merge both versions": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":  numData(t, 7),
+				"/1/skipped": numData(t, 1),
+				"/2/oranges": numData(t, 10),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				results, err := ds.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+				require.NoError(t, err)
+				entries, err := results.Rest()
+				require.NoError(t, err)
+				require.Len(t, entries, 2)
+				require.Equal(t, "/apples", entries[0].Key)
+				require.Equal(t, numData(t, 14), entries[0].Value)
+				require.Equal(t, "/oranges", entries[1].Key)
+				require.Equal(t, numData(t, 10), entries[1].Value)
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+				"/2/oranges":        numData(t, 10),
+			},
+		},
+		"queries apply offsets and limits to both versions": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":  numData(t, 7),
+				"/1/pears":   numData(t, 2),
+				"/2/oranges": numData(t, 10),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				results, err := ds.Query(ctx, query.Query{Offset: 1, Limit: 1, KeysOnly: true})
+				require.NoError(t, err)
+				entries, err := results.Rest()
+				require.NoError(t, err)
+				require.Len(t, entries, 1)
+				require.Nil(t, entries[0].Value)
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+				"/2/oranges":        numData(t, 10),
+				"/2/pears":          numData(t, 9),
+			},
+		},
+		"writes replace records at the previous version": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":  numData(t, 7),
+				"/1/oranges": numData(t, 3),
+				"/1/pears":   numData(t, 2),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/apples"), numData(t, 100)))
+				require.NoError(t, ds.Delete(ctx, datastore.NewKey("/oranges")))
+				batch, err := ds.Batch(ctx)
+				require.NoError(t, err)
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/pears"), numData(t, 50)))
+				require.NoError(t, batch.Commit(ctx))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 100),
+				"/2/pears":          numData(t, 50),
+			},
+		},
+		"records that fail to migrate stop the sweep": {
+			inputDatabase: map[string][]byte{
+				"/1/apples": numData(t, -1),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				_, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.EqualError(t, err, "attempting to transform to new state '/apples': negative count")
+			},
+			expectedSweepErr: errors.New("sweeping records: attempting to transform to new state '/apples': negative count"),
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": lazyVersionData("2", "1"),
+				"/1/apples":         numData(t, -1),
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			// records are swept in the background, so the datastore has to be safe for concurrent use
+			ds := dssync.MutexWrap(datastore.NewMapDatastore())
+			require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1")))
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			lazyDs := lazy.NewDatastore(ds, namespace.Wrap(ds, datastore.NewKey("/2")))
+			final, err := lazyDs.RunMigrations(migrate.NewMigrator())(ctx, ds, migrations, "2")
+			require.NoError(t, err)
+			require.Equal(t, versioning.VersionKey("2"), final)
+
+			data.test(t, lazyDs)
+			err = lazyDs.WaitSwept(ctx)
+			if data.expectedSweepErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedSweepErr.Error())
+			}
+
+			res, err := ds.Query(ctx, query.Query{})
+			require.NoError(t, err)
+			entries, err := res.Rest()
+			require.NoError(t, err)
+			outputDatabase := make(map[string][]byte)
+			for _, entry := range entries {
+				outputDatabase[entry.Key] = entry.Value
+			}
+			require.Equal(t, data.expectedOutputDatabase, outputDatabase)
+		})
+	}
+}
+
+func versionData(versionKey versioning.VersionKey) []byte {
+	return lazyVersionData(versionKey, "")
+}
+
+func lazyVersionData(versionKey versioning.VersionKey, lazyFrom versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(versionKey),
+		LazyFrom:         string(lazyFrom),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func numData(t *testing.T, num int64) []byte {
+	buf := new(bytes.Buffer)
+	value := cbg.CborInt(num)
+	require.NoError(t, value.MarshalCBOR(buf))
+	return buf.Bytes()
+}
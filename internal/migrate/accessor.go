@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/codec"
+)
+
+type accessor struct {
+	ctx    context.Context
+	ds     datastore.Read
+	codec  versioning.Codec
+	stores map[string]datastore.Read
+}
+
+// NewAccessor returns read-only access to the records in a datastore, decoded
+// with the given codec, and to a set of other named stores, decoded as CBOR
+func NewAccessor(ctx context.Context, ds datastore.Read, inputCodec versioning.Codec, stores map[string]datastore.Read) versioning.Accessor {
+	return accessor{ctx, ds, inputCodec, stores}
+}
+
+func (a accessor) Get(key datastore.Key) ([]byte, error) {
+	return a.ds.Get(a.ctx, key)
+}
+
+func (a accessor) Has(key datastore.Key) (bool, error) {
+	return a.ds.Has(a.ctx, key)
+}
+
+func (a accessor) Load(key datastore.Key, v interface{}) error {
+	data, err := a.ds.Get(a.ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := a.codec.Decode(data, v); err != nil {
+		return decodingError(key, err)
+	}
+	return nil
+}
+
+func (a accessor) Query(q query.Query) (query.Results, error) {
+	return a.ds.Query(a.ctx, q)
+}
+
+func (a accessor) Store(name string) (versioning.Accessor, error) {
+	ds, ok := a.stores[name]
+	if !ok {
+		return nil, fmt.Errorf("no store named %q", name)
+	}
+	return accessor{a.ctx, ds, codec.CBOR, a.stores}, nil
+}
@@ -0,0 +1,555 @@
+// Code generated by github.com/whyrusleeping/cbor-gen. DO NOT EDIT.
+
+package migrate
+
+import (
+	"fmt"
+	"io"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+	xerrors "golang.org/x/xerrors"
+)
+
+var _ = xerrors.Errorf
+
+func (t *MigrationLease) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{163}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Owner (string) (string)
+	if len("Owner") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Owner\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Owner"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Owner")); err != nil {
+		return err
+	}
+
+	if len(t.Owner) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Owner was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Owner))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Owner)); err != nil {
+		return err
+	}
+
+	// t.Heartbeat (int64) (int64)
+	if len("Heartbeat") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Heartbeat\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Heartbeat"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Heartbeat")); err != nil {
+		return err
+	}
+
+	if t.Heartbeat >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Heartbeat)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Heartbeat-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.Expiry (int64) (int64)
+	if len("Expiry") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Expiry\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Expiry"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Expiry")); err != nil {
+		return err
+	}
+
+	if t.Expiry >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Expiry)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Expiry-1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *MigrationLease) UnmarshalCBOR(r io.Reader) error {
+	*t = MigrationLease{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("MigrationLease: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Owner (string) (string)
+		case "Owner":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.Owner = string(sval)
+			}
+			// t.Heartbeat (int64) (int64)
+		case "Heartbeat":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Heartbeat = int64(extraI)
+			}
+			// t.Expiry (int64) (int64)
+		case "Expiry":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Expiry = int64(extraI)
+			}
+
+		default:
+			return fmt.Errorf("unknown struct field %d: '%s'", i, name)
+		}
+	}
+
+	return nil
+}
+func (t *VersionRecord) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{169}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Format (uint64) (uint64)
+	if len("Format") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Format\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Format"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Format")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Format)); err != nil {
+		return err
+	}
+
+	// t.Version (string) (string)
+	if len("Version") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Version\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Version"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Version")); err != nil {
+		return err
+	}
+
+	if len(t.Version) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Version was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Version))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Version)); err != nil {
+		return err
+	}
+
+	// t.WrittenBy (string) (string)
+	if len("WrittenBy") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"WrittenBy\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("WrittenBy"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("WrittenBy")); err != nil {
+		return err
+	}
+
+	if len(t.WrittenBy) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.WrittenBy was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.WrittenBy))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.WrittenBy)); err != nil {
+		return err
+	}
+
+	// t.MinReaderVersion (string) (string)
+	if len("MinReaderVersion") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"MinReaderVersion\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("MinReaderVersion"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("MinReaderVersion")); err != nil {
+		return err
+	}
+
+	if len(t.MinReaderVersion) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.MinReaderVersion was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.MinReaderVersion))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.MinReaderVersion)); err != nil {
+		return err
+	}
+
+	// t.SchemaFingerprint (string) (string)
+	if len("SchemaFingerprint") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"SchemaFingerprint\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("SchemaFingerprint"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("SchemaFingerprint")); err != nil {
+		return err
+	}
+
+	if len(t.SchemaFingerprint) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.SchemaFingerprint was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.SchemaFingerprint))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.SchemaFingerprint)); err != nil {
+		return err
+	}
+
+	// t.InProgress (bool) (bool)
+	if len("InProgress") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"InProgress\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("InProgress"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("InProgress")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.InProgress); err != nil {
+		return err
+	}
+
+	// t.TargetVersion (string) (string)
+	if len("TargetVersion") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"TargetVersion\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("TargetVersion"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("TargetVersion")); err != nil {
+		return err
+	}
+
+	if len(t.TargetVersion) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.TargetVersion was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.TargetVersion))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.TargetVersion)); err != nil {
+		return err
+	}
+
+	// t.LazyFrom (string) (string)
+	if len("LazyFrom") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LazyFrom\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("LazyFrom"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LazyFrom")); err != nil {
+		return err
+	}
+
+	if len(t.LazyFrom) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.LazyFrom was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.LazyFrom))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.LazyFrom)); err != nil {
+		return err
+	}
+
+	// t.Staged (string) (string)
+	if len("Staged") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Staged\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Staged"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Staged")); err != nil {
+		return err
+	}
+
+	if len(t.Staged) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Staged was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Staged))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Staged)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *VersionRecord) UnmarshalCBOR(r io.Reader) error {
+	*t = VersionRecord{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("VersionRecord: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Format (uint64) (uint64)
+		case "Format":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Format = uint64(extra)
+
+			}
+			// t.Version (string) (string)
+		case "Version":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.Version = string(sval)
+			}
+			// t.WrittenBy (string) (string)
+		case "WrittenBy":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.WrittenBy = string(sval)
+			}
+			// t.MinReaderVersion (string) (string)
+		case "MinReaderVersion":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.MinReaderVersion = string(sval)
+			}
+			// t.SchemaFingerprint (string) (string)
+		case "SchemaFingerprint":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.SchemaFingerprint = string(sval)
+			}
+			// t.InProgress (bool) (bool)
+		case "InProgress":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.InProgress = false
+			case 21:
+				t.InProgress = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
+			// t.TargetVersion (string) (string)
+		case "TargetVersion":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.TargetVersion = string(sval)
+			}
+			// t.LazyFrom (string) (string)
+		case "LazyFrom":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.LazyFrom = string(sval)
+			}
+			// t.Staged (string) (string)
+		case "Staged":
+
+			{
+				sval, err := cbg.ReadStringBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+
+				t.Staged = string(sval)
+			}
+
+		default:
+			return fmt.Errorf("unknown struct field %d: '%s'", i, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/utils"
+	"github.com/filecoin-project/go-ds-versioning/internal/validate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// IndexNamespace returns where the entries of a version's index are kept
+func IndexNamespace(versionsPrefix datastore.Key, version versioning.VersionKey, name string) datastore.Key {
+	return indexesNamespace(versionsPrefix, version).ChildString(name)
+}
+
+func indexesNamespace(versionsPrefix datastore.Key, version versioning.VersionKey) datastore.Key {
+	return versionsPrefix.ChildString("indexes").Child(datastore.NewKey(string(version)))
+}
+
+// IndexNamespace returns where the entries of a version's index are kept, with
+// the migrator's versions namespace
+func (m Migrator) IndexNamespace(version versioning.VersionKey, name string) datastore.Key {
+	return IndexNamespace(m.versionsPrefix, version, name)
+}
+
+// IndexesFor returns the indexes declared by the migration to a version
+func IndexesFor(migrations versioning.VersionedMigrationList, version versioning.VersionKey) []versioning.Index {
+	for _, migration := range migrations {
+		if migration.NewVersion() != version {
+			continue
+		}
+		if indexed, ok := versioning.MigrationAs[versioning.IndexedMigration](migration); ok {
+			return indexed.Indexes()
+		}
+		return nil
+	}
+	return nil
+}
+
+// buildIndexes builds every index from the records at a version
+func buildIndexes(ctx context.Context, ds datastore.Batching, versionsPrefix datastore.Key, version versioning.VersionKey, indexes []versioning.Index) error {
+	for _, index := range indexes {
+		if err := buildIndex(ctx, ds, versionsPrefix, version, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndex writes the entries of an index for every record at a version. It
+// doesn't remove existing entries
+func buildIndex(ctx context.Context, ds datastore.Batching, versionsPrefix datastore.Key, version versioning.VersionKey, index versioning.Index) error {
+	records := namespace.Wrap(ds, datastore.NewKey(string(version)))
+	indexDs := namespace.Wrap(ds, IndexNamespace(versionsPrefix, version, index.Name))
+	qres, err := records.Query(ctx, query.Query{})
+	if err != nil {
+		return fmt.Errorf("building index %q: %w", index.Name, err)
+	}
+	defer qres.Close()
+	batch, err := indexDs.Batch(ctx)
+	if err != nil {
+		return fmt.Errorf("building index %q: batch error: %w", index.Name, err)
+	}
+	indexed := make(map[datastore.Key]datastore.Key)
+	for res := range qres.Next() {
+		select {
+		case <-ctx.Done():
+			return versioning.ErrContextCancelled
+		default:
+		}
+		if res.Error != nil {
+			return fmt.Errorf("building index %q: %w", index.Name, res.Error)
+		}
+		key := datastore.NewKey(res.Key)
+		entries, err := index.Entries(key, res.Value)
+		if err != nil {
+			return fmt.Errorf("building index %q for key '%s': %w", index.Name, key, err)
+		}
+		for _, entry := range entries {
+			if existing, ok := indexed[entry.Key]; ok {
+				first, second := existing, key
+				if second.Less(first) {
+					first, second = second, first
+				}
+				return fmt.Errorf("building index %q: keys '%s' and '%s' both index to '%s'", index.Name, first, second, entry.Key)
+			}
+			indexed[entry.Key] = key
+			if err := batch.Put(ctx, entry.Key, entry.Value); err != nil {
+				return fmt.Errorf("building index %q: %w", index.Name, err)
+			}
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("building index %q: committing: %w", index.Name, err)
+	}
+	return nil
+}
+
+// dropIndexes removes every index at a version
+func dropIndexes(ctx context.Context, ds datastore.Batching, versionsPrefix datastore.Key, version versioning.VersionKey) error {
+	if version == versioning.VersionKey("") {
+		return nil
+	}
+	return dropNamespace(ctx, ds, indexesNamespace(versionsPrefix, version))
+}
+
+func dropNamespace(ctx context.Context, ds datastore.Batching, prefix datastore.Key) error {
+	qres, err := ds.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := qres.Rest()
+	if err != nil {
+		return err
+	}
+	keys := make([]datastore.Key, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, datastore.NewKey(entry.Key))
+	}
+	return deleteKeys(ctx, ds, keys)
+}
+
+// RebuildIndex drops an index of the records at a version and builds it again
+// from the records as they are now, holding the migration lease while it does
+func (m Migrator) RebuildIndex(ctx context.Context, ds datastore.Batching, version versioning.VersionKey, index versioning.Index) error {
+	if err := validate.CheckIndexes([]versioning.Index{index}); err != nil {
+		return err
+	}
+	return m.withLease(ctx, ds, func(ctx context.Context) error {
+		record, err := m.readVersionRecord(ctx, ds)
+		if err != nil && err != datastore.ErrNotFound {
+			return fmt.Errorf("reading version: %w", err)
+		}
+		if err != nil || versioning.VersionKey(record.Version) != version || record.InProgress {
+			return fmt.Errorf("index %q can only be rebuilt for the current version of the datastore", index.Name)
+		}
+		if err := dropNamespace(ctx, ds, m.IndexNamespace(version, index.Name)); err != nil {
+			return fmt.Errorf("dropping index %q: %w", index.Name, err)
+		}
+		err = buildIndex(ctx, ds, m.versionsPrefix, version, index)
+		if err != nil {
+			_ = dropNamespace(utils.Detach(ctx), ds, m.IndexNamespace(version, index.Name))
+		}
+		return err
+	})
+}
+
+// RebuildIndex drops an index of the records at a version and builds it again
+// from the records as they are now
+func RebuildIndex(ctx context.Context, ds datastore.Batching, version versioning.VersionKey, index versioning.Index, opts ...versioning.Option) error {
+	return NewMigrator(opts...).RebuildIndex(ctx, ds, version, index)
+}
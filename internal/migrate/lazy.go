@@ -0,0 +1,195 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/validate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// LazyStep is a version step whose records are migrated one at a time as they
+// are read, rather than all at once
+type LazyStep struct {
+	From      versioning.VersionKey
+	To        versioning.VersionKey
+	Migration versioning.RecordMigration
+}
+
+// lazyStep returns the step between two versions, if its migration can migrate
+// records one at a time
+func lazyStep(migrations versioning.VersionedMigrationList, from versioning.VersionKey, to versioning.VersionKey) (*LazyStep, bool) {
+	if from == versioning.VersionKey("") {
+		return nil, false
+	}
+	for _, migration := range migrations {
+		if migration.OldVersion() != from || migration.NewVersion() != to {
+			continue
+		}
+		recordMigration, ok := versioning.MigrationAs[versioning.RecordMigration](migration)
+		if !ok {
+			return nil, false
+		}
+		return &LazyStep{From: from, To: to, Migration: recordMigration}, true
+	}
+	return nil, false
+}
+
+// LazyTo migrates the database to the target version like To, except that when
+// the target is one version up from the current version, it just records the new
+// version and returns the step, leaving its records to be migrated as they're
+// read and swept up with FinishLazy. Until then, the step is returned again each
+// time the database is migrated to the same version
+func (m Migrator) LazyTo(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) (versioning.VersionKey, *LazyStep, error) {
+	validate.SortMigrations(migrations)
+	if !verifyIntegrity(migrations) {
+		return versioning.VersionKey(""), nil, fmt.Errorf("migrations list must be contiguous")
+	}
+	if err := m.checkCollisions(migrations, to); err != nil {
+		return versioning.VersionKey(""), nil, err
+	}
+
+	var final versioning.VersionKey
+	var step *LazyStep
+	err := m.withLease(ctx, ds, func(ctx context.Context) error {
+		var err error
+		final, step, err = m.lazyTo(ctx, ds, migrations, to)
+		return err
+	})
+	return final, step, err
+}
+
+func (m Migrator) lazyTo(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) (versioning.VersionKey, *LazyStep, error) {
+	record, err := m.readVersionRecord(ctx, ds)
+	if err != nil && err != datastore.ErrNotFound {
+		return versioning.VersionKey(""), nil, fmt.Errorf("reading version: %w", err)
+	}
+	if err == nil && !record.InProgress {
+		current := versioning.VersionKey(record.Version)
+		schema := m.schemaFingerprint(migrations, to)
+		if current == to && record.LazyFrom != "" {
+			if step, ok := lazyStep(migrations, versioning.VersionKey(record.LazyFrom), to); ok {
+				if err := checkSchema(record, schema); err != nil {
+					return current, nil, err
+				}
+				return to, step, nil
+			}
+		}
+		if record.LazyFrom == "" {
+			if step, ok := lazyStep(migrations, current, to); ok {
+				if err := m.dropStaged(ctx, ds, record); err != nil {
+					return current, nil, err
+				}
+				// indexes of the new version are kept up to date as records are migrated
+				if err := dropIndexes(ctx, ds, m.versionsPrefix, to); err != nil {
+					return current, nil, fmt.Errorf("dropping indexes: %w", err)
+				}
+				next := m.movedTo(*record, migrations, to, schema)
+				next.LazyFrom = string(current)
+				if err := m.writeVersionRecord(ctx, ds, next); err != nil {
+					return current, nil, fmt.Errorf("writing version: %w", err)
+				}
+				return to, step, nil
+			}
+		}
+	}
+	final, err := m.migrateTo(ctx, ds, migrations, to)
+	return final, nil, err
+}
+
+// FinishLazy completes a lazy step once every record at the version it started
+// from has been migrated, deleting that version's namespace -- along with any
+// records the migration left out -- and its indexes
+func (m Migrator) FinishLazy(ctx context.Context, ds datastore.Batching, step LazyStep) error {
+	return m.withLease(ctx, ds, func(ctx context.Context) error {
+		record, err := m.readVersionRecord(ctx, ds)
+		if err != nil {
+			return fmt.Errorf("reading version: %w", err)
+		}
+		if versioning.VersionKey(record.Version) != step.To || versioning.VersionKey(record.LazyFrom) != step.From {
+			return fmt.Errorf("datastore is no longer migrating lazily from version %q to %q", step.From, step.To)
+		}
+		return m.dropLazyFrom(ctx, ds, record)
+	})
+}
+
+// sweepLazy migrates every record still at the version a lazy step started from,
+// for when the datastore has to move on before the step has been swept. It
+// rebuilds the current version's indexes afterwards
+func (m Migrator) sweepLazy(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, record *VersionRecord) error {
+	step, ok := lazyStep(migrations, versioning.VersionKey(record.LazyFrom), versioning.VersionKey(record.Version))
+	if !ok {
+		return fmt.Errorf("records are still being migrated lazily from version %q, but there is no migration from it to %q", record.LazyFrom, record.Version)
+	}
+	oldDs := namespace.Wrap(ds, datastore.NewKey(string(step.From)))
+	newDs := namespace.Wrap(ds, datastore.NewKey(string(step.To)))
+	qres, err := oldDs.Query(ctx, query.Query{})
+	if err != nil {
+		return err
+	}
+	defer qres.Close()
+	batch, err := newDs.Batch(ctx)
+	if err != nil {
+		return fmt.Errorf("batch error: %w", err)
+	}
+	for res := range qres.Next() {
+		select {
+		case <-ctx.Done():
+			return versioning.ErrContextCancelled
+		default:
+		}
+		if res.Error != nil {
+			return res.Error
+		}
+		key := datastore.NewKey(res.Key)
+		// records written since the step started take precedence
+		has, err := newDs.Has(ctx, key)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		migrated, selected, err := step.Migration.MigrateRecord(ctx, oldDs, key, res.Value)
+		if err != nil {
+			return err
+		}
+		if !selected {
+			continue
+		}
+		if err := batch.Put(ctx, key, migrated); err != nil {
+			return err
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("committing: %w", err)
+	}
+	if err := dropIndexes(ctx, ds, m.versionsPrefix, step.To); err != nil {
+		return fmt.Errorf("dropping indexes: %w", err)
+	}
+	if err := buildIndexes(ctx, ds, m.versionsPrefix, step.To, IndexesFor(migrations, step.To)); err != nil {
+		return err
+	}
+	return m.dropLazyFrom(ctx, ds, record)
+}
+
+// dropLazyFrom deletes the version a lazy step started from, and records that
+// the step is done
+func (m Migrator) dropLazyFrom(ctx context.Context, ds datastore.Batching, record *VersionRecord) error {
+	from := versioning.VersionKey(record.LazyFrom)
+	if err := dropNamespace(ctx, ds, datastore.NewKey(string(from))); err != nil {
+		return fmt.Errorf("deleting records at version %q: %w", from, err)
+	}
+	if err := dropIndexes(ctx, ds, m.versionsPrefix, from); err != nil {
+		return fmt.Errorf("dropping indexes: %w", err)
+	}
+	record.LazyFrom = ""
+	if err := m.writeVersionRecord(ctx, ds, *record); err != nil {
+		return fmt.Errorf("writing version: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/utils"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+const defaultLeaseTTL = 30 * time.Second
+
+// minLeaseTTL is the shortest lease allowed, so it can be renewed a few times
+// before it expires
+const minLeaseTTL = 3 * time.Millisecond
+
+// heldLease is a migration lease this process has acquired, which is renewed
+// in the background until released
+type heldLease struct {
+	ds     datastore.Batching
+	key    datastore.Key
+	owner  string
+	ttl    time.Duration
+	lost   func()
+	stop   chan struct{}
+	done   chan struct{}
+	stopMu sync.Once
+}
+
+func newOwnerID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func readLease(ctx context.Context, ds datastore.Batching, key datastore.Key) (*MigrationLease, error) {
+	data, err := ds.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var lease MigrationLease
+	if err := cborutil.ReadCborRPC(bytes.NewReader(data), &lease); err != nil {
+		return nil, fmt.Errorf("decoding migration lease: %w", err)
+	}
+	return &lease, nil
+}
+
+func writeLease(ctx context.Context, ds datastore.Batching, key datastore.Key, owner string, ttl time.Duration) error {
+	now := time.Now()
+	data, err := cborutil.Dump(&MigrationLease{
+		Owner:     owner,
+		Heartbeat: now.UnixNano(),
+		Expiry:    now.Add(ttl).UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+	return ds.Put(ctx, key, data)
+}
+
+// acquireLease takes the migration lease for the given owner, unless another
+// owner holds a lease that has not expired. lost is called if the lease is
+// taken over by someone else while it's held
+func acquireLease(ctx context.Context, ds datastore.Batching, key datastore.Key, owner string, ttl time.Duration, lost func()) (*heldLease, error) {
+	existing, err := readLease(ctx, ds, key)
+	if err != nil && err != datastore.ErrNotFound {
+		return nil, fmt.Errorf("reading migration lease: %w", err)
+	}
+	if err == nil && existing.Owner != owner && time.Now().UnixNano() < existing.Expiry {
+		return nil, fmt.Errorf("%w: held by %s until %s", versioning.ErrMigrationLocked, existing.Owner, time.Unix(0, existing.Expiry).UTC().Format(time.RFC3339))
+	}
+	if err := writeLease(ctx, ds, key, owner, ttl); err != nil {
+		return nil, fmt.Errorf("writing migration lease: %w", err)
+	}
+	// the datastore has no compare-and-swap, so read back the lease to catch
+	// the case where another process took it at the same time
+	current, err := readLease(ctx, ds, key)
+	if err != nil {
+		return nil, fmt.Errorf("reading migration lease: %w", err)
+	}
+	if current.Owner != owner {
+		return nil, fmt.Errorf("%w: held by %s", versioning.ErrMigrationLocked, current.Owner)
+	}
+	hl := &heldLease{
+		ds:    ds,
+		key:   key,
+		owner: owner,
+		ttl:   ttl,
+		lost:  lost,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go hl.heartbeat(utils.Detach(ctx))
+	return hl, nil
+}
+
+func (hl *heldLease) heartbeat(ctx context.Context) {
+	defer close(hl.done)
+	ticker := time.NewTicker(hl.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hl.stop:
+			return
+		case <-ticker.C:
+		}
+		current, err := readLease(ctx, hl.ds, hl.key)
+		if err != nil || current.Owner != hl.owner {
+			hl.lost()
+			return
+		}
+		if err := writeLease(ctx, hl.ds, hl.key, hl.owner, hl.ttl); err != nil {
+			hl.lost()
+			return
+		}
+	}
+}
+
+// release stops renewing the lease and removes it, if it is still ours
+func (hl *heldLease) release(ctx context.Context) error {
+	hl.stopMu.Do(func() { close(hl.stop) })
+	<-hl.done
+	current, err := readLease(ctx, hl.ds, hl.key)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading migration lease: %w", err)
+	}
+	if current.Owner != hl.owner {
+		return nil
+	}
+	if err := hl.ds.Delete(ctx, hl.key); err != nil {
+		return fmt.Errorf("releasing migration lease: %w", err)
+	}
+	return nil
+}
@@ -1,26 +1,32 @@
 package migrate
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"reflect"
-	"sort"
 
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	"github.com/ipfs/go-datastore/query"
-	cbg "github.com/whyrusleeping/cbor-gen"
+	"go.uber.org/atomic"
 	"go.uber.org/multierr"
 
-	cborutil "github.com/filecoin-project/go-cbor-util"
-
 	"github.com/filecoin-project/go-ds-versioning/internal/utils"
+	"github.com/filecoin-project/go-ds-versioning/internal/validate"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/codec"
+	"github.com/filecoin-project/go-ds-versioning/pkg/fingerprint"
 )
 
 // Execute executes a database migration from datastore to another, using the given migration function
 func Execute(ctx context.Context, q query.Query, oldDs datastore.Batching, newDS datastore.Batching, oldType reflect.Type, migrateFunc reflect.Value) ([]datastore.Key, error) {
+	return ExecuteTransform(ctx, q, oldDs, newDS, ReflectTransform(oldType, migrateFunc, NewAccessor(ctx, oldDs, codec.CBOR, nil)))
+}
+
+// ExecuteTransform executes a database migration from datastore to another, using
+// the given transform on each record
+func ExecuteTransform(ctx context.Context, q query.Query, oldDs datastore.Batching, newDS datastore.Batching, transform Transform) ([]datastore.Key, error) {
 	qres, err := oldDs.Query(ctx, q)
 	if err != nil {
 		return nil, err
@@ -32,8 +38,10 @@ func Execute(ctx context.Context, q query.Query, oldDs datastore.Batching, newDS
 		return nil, fmt.Errorf("batch error: %w", err)
 	}
 
-	keys, errs := execute(ctx, qres, oldDs, newDS, oldType, migrateFunc, batch)
-	err = batch.Commit(ctx)
+	keys, errs := execute(ctx, qres, newDS, transform, batch)
+	// commit even if the context was cancelled, so that the returned keys match
+	// what was written and callers can roll them back
+	err = batch.Commit(utils.Detach(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("committing: %w", err)
 	}
@@ -41,7 +49,7 @@ func Execute(ctx context.Context, q query.Query, oldDs datastore.Batching, newDS
 	return keys, errs
 }
 
-func execute(ctx context.Context, qres query.Results, oldDs, newDS datastore.Batching, oldType reflect.Type, migrateFunc reflect.Value, batch datastore.Batch) (keys []datastore.Key, errs error) {
+func execute(ctx context.Context, qres query.Results, newDS datastore.Batching, transform Transform, batch datastore.Batch) (keys []datastore.Key, errs error) {
 
 	for res := range qres.Next() {
 		select {
@@ -54,20 +62,13 @@ func execute(ctx context.Context, qres query.Results, oldDs, newDS datastore.Bat
 			errs = res.Error
 			return
 		}
-		oldElem := reflect.New(oldType.Elem())
-		err := cborutil.ReadCborRPC(bytes.NewReader(res.Value), oldElem.Interface())
+		key := datastore.NewKey(res.Key)
+		bts, err := transform(key, res.Value)
 		if err != nil {
-			errs = multierr.Append(errs, fmt.Errorf("decoding state for key '%s': %w", res.Key, err))
+			errs = multierr.Append(errs, err)
 			continue
 		}
-
-		outputs := migrateFunc.Call([]reflect.Value{oldElem})
-		err, ok := outputs[1].Interface().(error)
-		if ok && err != nil {
-			errs = multierr.Append(errs, fmt.Errorf("attempting to transform to new state '%s': %w", res.Key, err))
-			continue
-		}
-		has, err := newDS.Has(ctx, datastore.NewKey(res.Key))
+		has, err := newDS.Has(ctx, key)
 		if err != nil {
 			errs = err
 			return
@@ -76,34 +77,143 @@ func execute(ctx context.Context, qres query.Results, oldDs, newDS datastore.Bat
 			errs = multierr.Append(errs, fmt.Errorf("already tracking state in new db for '%s'", res.Key))
 			continue
 		}
-		bts, err := cborutil.Dump(outputs[0].Interface().(cbg.CBORMarshaler))
-		if err != nil {
-			errs = multierr.Append(errs, fmt.Errorf("encoding state for key '%s': %w", res.Key, err))
-			continue
-		}
-		err = batch.Put(ctx, datastore.NewKey(res.Key), bts)
+		err = batch.Put(ctx, key, bts)
 		if err != nil {
 			errs = err
 			return
 		}
-		keys = append(keys, datastore.NewKey(res.Key))
+		keys = append(keys, key)
 	}
 	return
 }
 
-var versioningKey = datastore.NewKey("/versions/current")
+// Migrator migrates datastores using the settings from a versioned store config
+type Migrator struct {
+	cfg            versioning.Config
+	versionsPrefix datastore.Key
+	runStep        StepRunner
+}
+
+// NewMigrator returns a migrator with the given options applied
+func NewMigrator(opts ...versioning.Option) Migrator {
+	cfg := versioning.NewConfig(opts...)
+	return Migrator{cfg, cfg.VersionsNamespaceKey(), RunStep}
+}
+
+// WithStepRunner returns a migrator that migrates the records for each version
+// step with the given function
+func (m Migrator) WithStepRunner(runStep StepRunner) Migrator {
+	m.runStep = runStep
+	return m
+}
+
+func (m Migrator) versioningKey() datastore.Key {
+	return m.versionsPrefix.ChildString("current")
+}
+
+func (m Migrator) lockKey() datastore.Key {
+	return m.versionsPrefix.ChildString("lock")
+}
+
+// checkCollisions verifies no version namespace overlaps the namespace for versioning's own records
+func (m Migrator) checkCollisions(migrations versioning.VersionedMigrationList, to versioning.VersionKey) error {
+	versions := []versioning.VersionKey{to}
+	for _, migration := range migrations {
+		versions = append(versions, migration.OldVersion(), migration.NewVersion())
+	}
+	for _, version := range versions {
+		if version == versioning.VersionKey("") {
+			continue
+		}
+		versionKey := datastore.NewKey(string(version))
+		if versionKey.Equal(m.versionsPrefix) || versionKey.IsAncestorOf(m.versionsPrefix) || m.versionsPrefix.IsAncestorOf(versionKey) {
+			return fmt.Errorf("%w: version %q, versions namespace %s", versioning.ErrNamespaceCollision, version, m.versionsPrefix)
+		}
+	}
+	return nil
+}
 
 // To attempts to migrate the database to the target version, reading from current version from the predefined key
 // and applying migrations as need to reach the target version
 // it returns the final database version (ideally = target) and any errors encountered
 func To(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) (versioning.VersionKey, error) {
-	sort.Sort(migrations)
+	return NewMigrator().To(ctx, ds, migrations, to)
+}
+
+// To migrates the database to the target version, like the package level To. While
+// migrating it holds a lease in the datastore so no other process can migrate the same
+// datastore at the same time
+func (m Migrator) To(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) (versioning.VersionKey, error) {
+	validate.SortMigrations(migrations)
 	if !verifyIntegrity(migrations) {
 		return versioning.VersionKey(""), fmt.Errorf("migrations list must be contiguous")
 	}
-	verBytes, err := ds.Get(ctx, versioningKey)
+	if err := m.checkCollisions(migrations, to); err != nil {
+		return versioning.VersionKey(""), err
+	}
+
+	var final versioning.VersionKey
+	err := m.withLease(ctx, ds, func(ctx context.Context) error {
+		var err error
+		final, err = m.migrateTo(ctx, ds, migrations, to)
+		return err
+	})
+	return final, err
+}
+
+// withLease runs a function while holding the migration lease for a datastore.
+// The context the function gets is cancelled if the lease is lost
+func (m Migrator) withLease(ctx context.Context, ds datastore.Batching, run func(ctx context.Context) error) error {
+	owner := m.cfg.LockOwner
+	if owner == "" {
+		var err error
+		owner, err = newOwnerID()
+		if err != nil {
+			return fmt.Errorf("generating lease owner: %w", err)
+		}
+	}
+	ttl := m.cfg.LockTTL
+	if ttl == 0 {
+		ttl = defaultLeaseTTL
+	}
+	if ttl < minLeaseTTL {
+		return fmt.Errorf("lock TTL must be at least %s, but is %s", minLeaseTTL, ttl)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var leaseLost atomic.Bool
+	lease, err := acquireLease(ctx, ds, m.lockKey(), owner, ttl, func() {
+		leaseLost.Store(true)
+		cancel()
+	})
+	if err != nil {
+		return err
+	}
+
+	err = run(ctx)
+	rerr := lease.release(utils.Detach(ctx))
+	if err != nil {
+		if leaseLost.Load() {
+			return fmt.Errorf("%w: lease lost while migrating: %s", versioning.ErrMigrationLocked, err)
+		}
+		return err
+	}
+	return rerr
+}
+
+func (m Migrator) migrateTo(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) (versioning.VersionKey, error) {
+	schema := m.schemaFingerprint(migrations, to)
+	record, err := m.readVersionRecord(ctx, ds)
 	if err == datastore.ErrNotFound {
-		hasData, err := notEmpty(ds)
+		// without a version record, the only thing in the versions namespace should be our lease
+		collides, err := notEmpty(utils.HidePrefix(namespace.Wrap(ds, m.versionsPrefix), datastore.NewKey("lock")))
+		if err != nil {
+			return versioning.VersionKey(""), fmt.Errorf("determining if versions namespace has data: %w", err)
+		}
+		if collides {
+			return versioning.VersionKey(""), fmt.Errorf("%w: unversioned data found under %s", versioning.ErrNamespaceCollision, m.versionsPrefix)
+		}
+		hasData, err := notEmpty(utils.HidePrefix(ds, m.versionsPrefix))
 		if err != nil {
 			return versioning.VersionKey(""), fmt.Errorf("determining if store has data: %w", err)
 		}
@@ -111,10 +221,10 @@ func To(ctx context.Context, ds datastore.Batching, migrations versioning.Versio
 			if migrations[0].OldVersion() != versioning.VersionKey("") {
 				return versioning.VersionKey(""), errors.New("cannot migrate from an unversioned database")
 			}
-			verBytes = []byte("")
+			record = &VersionRecord{}
 		} else {
 			// empty database -- we'll treat it as ready to go after writing current version
-			err = ds.Put(ctx, versioningKey, []byte(to))
+			err = m.writeVersionRecord(ctx, ds, VersionRecord{Version: string(to), MinReaderVersion: m.minReaderVersion(migrations, to), SchemaFingerprint: schema})
 			if err != nil {
 				return versioning.VersionKey(""), fmt.Errorf("writing version: %w", err)
 			}
@@ -124,28 +234,219 @@ func To(ctx context.Context, ds datastore.Batching, migrations versioning.Versio
 		return versioning.VersionKey(""), fmt.Errorf("reading version: %w", err)
 	}
 
-	currentVersion := versioning.VersionKey(verBytes)
-	final, err := runMigrations(ctx, ds, migrations, currentVersion, to)
-	ferr := ds.Put(ctx, versioningKey, []byte(final))
+	currentVersion := versioning.VersionKey(record.Version)
+	if readableNewer(migrations, record, to) {
+		// leave the datastore as it is, for this code to read
+		return currentVersion, nil
+	}
+	if record.LazyFrom != "" {
+		if err := m.sweepLazy(ctx, ds, migrations, record); err != nil {
+			return currentVersion, fmt.Errorf("finishing lazy migration: %w", err)
+		}
+	}
+	if err := checkCompatible(migrations, record, to); err != nil {
+		return currentVersion, err
+	}
+	if currentVersion == to {
+		if err := checkSchema(record, schema); err != nil {
+			return currentVersion, err
+		}
+		if schema == "" {
+			schema = record.SchemaFingerprint
+		}
+	}
+	if currentVersion != to {
+		// a staged version is built from the current version, so it's stale once the database moves
+		if err := m.dropStaged(ctx, ds, record); err != nil {
+			return currentVersion, err
+		}
+		inProgress := *record
+		inProgress.InProgress = true
+		inProgress.TargetVersion = string(to)
+		if err := m.writeVersionRecord(ctx, ds, inProgress); err != nil {
+			return currentVersion, fmt.Errorf("writing version: %w", err)
+		}
+	}
+	final, err := runMigrations(ctx, ds, migrations, currentVersion, to, m.versionsPrefix, m.runStep)
+	// record the version we reached even if migrations were cancelled part way through
+	var finalSchema string
+	switch final {
+	case to:
+		finalSchema = schema
+	case currentVersion:
+		finalSchema = record.SchemaFingerprint
+	}
+	finalRecord := m.movedTo(*record, migrations, final, finalSchema)
+	ferr := m.writeVersionRecord(utils.Detach(ctx), ds, finalRecord)
 	if err != nil {
 		return final, err
 	}
 	return final, ferr
 }
 
-func runMigrations(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, current versioning.VersionKey, target versioning.VersionKey) (versioning.VersionKey, error) {
-	if target > current {
+// schemaFingerprint is the fingerprint of the schema of records at the target
+// version, or empty if it isn't known
+func (m Migrator) schemaFingerprint(migrations versioning.VersionedMigrationList, to versioning.VersionKey) string {
+	if m.cfg.SchemaFingerprint != "" {
+		return m.cfg.SchemaFingerprint
+	}
+	for _, migration := range migrations {
+		if migration.NewVersion() != to {
+			continue
+		}
+		typed, ok := versioning.MigrationAs[versioning.TypedMigration](migration)
+		if !ok || typed.OutputType() == nil {
+			return ""
+		}
+		// output types that aren't structs, or aren't known, have no schema to drift
+		schema, err := fingerprint.OfType(typed.OutputType())
+		if err != nil {
+			return ""
+		}
+		return schema
+	}
+	return ""
+}
+
+// checkSchema verifies the records at the current version were written with the
+// schema this code expects. Records written before fingerprints were recorded
+// are assumed to match
+func checkSchema(record *VersionRecord, schema string) error {
+	if schema == "" || record.SchemaFingerprint == "" || record.SchemaFingerprint == schema {
+		return nil
+	}
+	return fmt.Errorf("%w: version %q has schema %s, but this code expects %s", versioning.ErrSchemaDrift, record.Version, record.SchemaFingerprint, schema)
+}
+
+// minReaderVersion is the oldest version of the data code must understand to read this store
+func (m Migrator) minReaderVersion(migrations versioning.VersionedMigrationList, version versioning.VersionKey) string {
+	if m.cfg.MinReaderVersion != versioning.VersionKey("") && before(versionOrder(migrations), m.cfg.MinReaderVersion, version) {
+		return string(m.cfg.MinReaderVersion)
+	}
+	return string(version)
+}
+
+// readableNewer reports whether the datastore is at a version this code doesn't
+// know, but whose writer recorded that code which understands the target version
+// can still read it
+func readableNewer(migrations versioning.VersionedMigrationList, record *VersionRecord, to versioning.VersionKey) bool {
+	current := versioning.VersionKey(record.Version)
+	minReader := versioning.VersionKey(record.MinReaderVersion)
+	if current == versioning.VersionKey("") || minReader == versioning.VersionKey("") || KnownVersion(migrations, current) {
+		return false
+	}
+	if minReader == to {
+		return true
+	}
+	order := versionOrder(migrations)
+	_, minKnown := order[minReader]
+	_, toKnown := order[to]
+	return minKnown && toKnown && !before(order, to, minReader)
+}
+
+// checkCompatible verifies, before doing any work, that this code can bring
+// the datastore from its current version to the target
+func checkCompatible(migrations versioning.VersionedMigrationList, record *VersionRecord, to versioning.VersionKey) error {
+	current := versioning.VersionKey(record.Version)
+	if current == to || current == versioning.VersionKey("") {
+		return nil
+	}
+	order := versionOrder(migrations)
+	if !KnownVersion(migrations, current) {
+		if before(order, current, to) {
+			return fmt.Errorf("no migrations from database version %q", current)
+		}
+		if record.MinReaderVersion != "" {
+			return fmt.Errorf("%w: database is at unknown version %q, which requires code that understands version %q", versioning.ErrStoreTooNew, current, record.MinReaderVersion)
+		}
+		return fmt.Errorf("%w: database is at unknown version %q", versioning.ErrStoreTooNew, current)
+	}
+	if before(order, current, to) {
+		return nil
+	}
+	// walk down from the current version, making sure every step can be undone
+	version := current
+	for before(order, to, version) {
+		var step versioning.VersionedMigration
+		for _, migration := range migrations {
+			if migration.NewVersion() == version {
+				step = migration
+				break
+			}
+		}
+		if step == nil {
+			return fmt.Errorf("%w: database is at version %q, and cannot be migrated down to %q", versioning.ErrStoreTooNew, current, to)
+		}
+		if _, ok := step.(versioning.ReversibleVersionedMigration); !ok && !isDataCompatible(step) {
+			return irreversibleError(step)
+		}
+		version = step.OldVersion()
+	}
+	return nil
+}
+
+func isDataCompatible(migration versioning.VersionedMigration) bool {
+	compatible, ok := migration.(versioning.DataCompatibleMigration)
+	return ok && compatible.DataCompatible()
+}
+
+func irreversibleError(migration versioning.VersionedMigration) error {
+	return fmt.Errorf("%w: migration from version %q to %q", versioning.ErrIrreversibleMigration, migration.OldVersion(), migration.NewVersion())
+}
+
+// copyRecords copies every record in one version's namespace to another's, unchanged
+func copyRecords(ctx context.Context, ds datastore.Batching, from versioning.VersionKey, to versioning.VersionKey) ([]datastore.Key, error) {
+	fromDs := namespace.Wrap(ds, datastore.NewKey(string(from)))
+	toDs := namespace.Wrap(ds, datastore.NewKey(string(to)))
+	return ExecuteTransform(ctx, query.Query{}, fromDs, toDs, identity)
+}
+
+// StepRunner migrates the records for a single version step, up from the
+// migration's old version to its new version, or down the other way, and
+// returns the keys it wrote to the version it migrated to
+type StepRunner func(ctx context.Context, ds datastore.Batching, migration versioning.VersionedMigration, up bool) ([]datastore.Key, error)
+
+// RunStep migrates the records for a version step with the migration's own Up or
+// Down, or by copying them down past a data compatible migration
+func RunStep(ctx context.Context, ds datastore.Batching, migration versioning.VersionedMigration, up bool) ([]datastore.Key, error) {
+	if up {
+		return migration.Up(ctx, ds)
+	}
+	if reversible, ok := migration.(versioning.ReversibleVersionedMigration); ok {
+		return reversible.Down(ctx, ds)
+	}
+	if isDataCompatible(migration) {
+		return copyRecords(ctx, ds, migration.NewVersion(), migration.OldVersion())
+	}
+	return nil, irreversibleError(migration)
+}
+
+func runMigrations(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, current versioning.VersionKey, target versioning.VersionKey, versionsPrefix datastore.Key, runStep StepRunner) (versioning.VersionKey, error) {
+	order := versionOrder(migrations)
+	if before(order, current, target) {
 		for _, migration := range migrations {
 			if migration.OldVersion() == current {
-				keys, err := migration.Up(ctx, ds)
+				upDs := ds
+				if current == versioning.VersionKey("") {
+					// unversioned data lives alongside our bookkeeping records, which shouldn't get migrated
+					upDs = utils.HidePrefix(ds, versionsPrefix)
+				}
+				keys, err := runStep(ctx, upDs, migration, true)
+				if err == nil {
+					err = buildIndexes(ctx, ds, versionsPrefix, migration.NewVersion(), IndexesFor(migrations, migration.NewVersion()))
+				}
 				if err != nil {
 					versionedKeys := utils.KeysForVersion(migration.NewVersion(), keys)
-					_ = deleteKeys(ctx, ds, versionedKeys)
+					_ = deleteKeys(utils.Detach(ctx), ds, versionedKeys)
+					_ = dropIndexes(utils.Detach(ctx), ds, versionsPrefix, migration.NewVersion())
 					return current, fmt.Errorf("running up migration: %w", err)
 				}
 				current = migration.NewVersion()
 				versionedKeys := utils.KeysForVersion(migration.OldVersion(), keys)
 				err = deleteKeys(ctx, ds, versionedKeys)
+				if err == nil {
+					err = dropIndexes(ctx, ds, versionsPrefix, migration.OldVersion())
+				}
 				if err != nil {
 					return current, fmt.Errorf("deleting keys: %w", err)
 				}
@@ -154,26 +455,33 @@ func runMigrations(ctx context.Context, ds datastore.Batching, migrations versio
 				}
 			}
 		}
-	} else if target < current {
-		sort.Sort(sort.Reverse(migrations))
-		for _, migration := range migrations {
-			reversible, ok := migration.(versioning.ReversibleVersionedMigration)
-			if ok && reversible.NewVersion() == current {
-				keys, err := reversible.Down(ctx, ds)
-				if err != nil {
-					versionedKeys := utils.KeysForVersion(migration.OldVersion(), keys)
-					_ = deleteKeys(ctx, ds, versionedKeys)
-					return current, fmt.Errorf("running down migration: %w", err)
-				}
-				current = migration.OldVersion()
-				versionedKeys := utils.KeysForVersion(migration.NewVersion(), keys)
-				err = deleteKeys(ctx, ds, versionedKeys)
-				if err != nil {
-					return current, fmt.Errorf("deleting keys: %w", err)
-				}
-				if current == target {
-					return current, nil
-				}
+	} else if before(order, target, current) {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			migration := migrations[i]
+			if migration.NewVersion() != current {
+				continue
+			}
+			keys, err := runStep(ctx, ds, migration, false)
+			if err == nil {
+				err = buildIndexes(ctx, ds, versionsPrefix, migration.OldVersion(), IndexesFor(migrations, migration.OldVersion()))
+			}
+			if err != nil {
+				versionedKeys := utils.KeysForVersion(migration.OldVersion(), keys)
+				_ = deleteKeys(utils.Detach(ctx), ds, versionedKeys)
+				_ = dropIndexes(utils.Detach(ctx), ds, versionsPrefix, migration.OldVersion())
+				return current, fmt.Errorf("running down migration: %w", err)
+			}
+			current = migration.OldVersion()
+			versionedKeys := utils.KeysForVersion(migration.NewVersion(), keys)
+			err = deleteKeys(ctx, ds, versionedKeys)
+			if err == nil {
+				err = dropIndexes(ctx, ds, versionsPrefix, migration.NewVersion())
+			}
+			if err != nil {
+				return current, fmt.Errorf("deleting keys: %w", err)
+			}
+			if current == target {
+				return current, nil
 			}
 		}
 	} else if target == current {
@@ -183,12 +491,15 @@ func runMigrations(ctx context.Context, ds datastore.Batching, migrations versio
 }
 
 func notEmpty(ds datastore.Batching) (bool, error) {
-	qres, err := ds.Query(context.TODO(), query.Query{})
+	qres, err := ds.Query(context.TODO(), query.Query{KeysOnly: true})
 	if err != nil {
 		return false, err
 	}
-	_, hasData := qres.NextSync()
+	res, hasData := qres.NextSync()
 	err = qres.Close()
+	if res.Error != nil {
+		return false, res.Error
+	}
 	return hasData, err
 }
 
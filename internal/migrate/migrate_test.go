@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
@@ -17,6 +19,8 @@ import (
 
 	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/builder"
+	"github.com/filecoin-project/go-ds-versioning/pkg/fingerprint"
 	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
 )
 
@@ -99,6 +103,22 @@ func TestExecuteMigration(t *testing.T) {
 			expectedErrs:   []error{errors.New("already tracking state in new db for '/apples'")},
 			expectedKeyLen: 1,
 		},
+		"typed transform": {
+			inputDatabase: map[string]cbg.CBORMarshaler{
+				"/apples":          &appleCount,
+				"/oranges":         &orangeCount,
+				"/untransformable": &untransformableCount,
+			},
+			expectedOutputDatabase: map[string]cbg.CborBool{
+				"/apples":  true,
+				"/oranges": false,
+			},
+			expectedErrs:   []error{errors.New("attempting to transform to new state '/untransformable': the meaning of life is untransformable")},
+			expectedKeyLen: 2,
+			execute: func(ctx context.Context, ds1 datastore.Batching, ds2 datastore.Batching) ([]datastore.Key, error) {
+				return migrate.ExecuteTransform(ctx, query.Query{}, ds1, ds2, migrate.TypedTransform(transform))
+			},
+		},
 		"context cancelled": {
 			inputDatabase: map[string]cbg.CBORMarshaler{
 				"/apples":  &appleCount,
@@ -235,6 +255,42 @@ func TestTo(t *testing.T) {
 				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
 			},
 		},
+		"staged versions are kept at the same version": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": stagedVersionData("1", "2"),
+				"/1/apples":         numData(t, 7),
+				"/2/apples":         numData(t, 28),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": stagedVersionData("1", "2"),
+				"/1/apples":         numData(t, 7),
+				"/2/apples":         numData(t, 28),
+			},
+			target:               "1",
+			expectedFinalVersion: "1",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "1").Reversible(subMigration),
+				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
+			},
+		},
+		"staged versions are dropped when migrating": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": stagedVersionData("1", "2"),
+				"/1/apples":         numData(t, 7),
+				"/2/apples":         numData(t, 28),
+				"/2/oranges":        numData(t, 40),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 28),
+			},
+			target:               "2",
+			expectedFinalVersion: "2",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "1").Reversible(subMigration),
+				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
+			},
+		},
 		"unversioned database with data": {
 			inputDatabase: map[string][]byte{
 				"/apples":  numData(t, 7),
@@ -386,6 +442,174 @@ func TestTo(t *testing.T) {
 				versioned.NewVersionedBuilder(errorMigration, "3").OldVersion("2"),
 			},
 		},
+		"dispatch to several migrations in one step": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples/1":       numData(t, 7),
+				"/1/oranges/1":      numData(t, 3),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples/1":       numData(t, 14),
+				"/2/oranges/1":      numData(t, 12),
+			},
+			target:               "2",
+			expectedFinalVersion: "2",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewDispatch("2",
+					builder.Route{Match: builder.KeyPrefix("/apples"), Migration: builder.New(addMigration)},
+					builder.Route{Match: builder.KeyPrefix("/oranges"), Migration: builder.New(multiplyMigration)},
+				).OldVersion("1"),
+			},
+		},
+		"error while migrating, dispatch rolls back every route": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples/1":       numData(t, 7),
+				"/1/oranges/1":      numData(t, 10),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples/1":       numData(t, 7),
+				"/1/oranges/1":      numData(t, 10),
+			},
+			target:               "2",
+			expectedFinalVersion: "1",
+			expectedErr:          errors.New("running up migration: route 1: attempting to transform to new state '/oranges/1': could not migrate"),
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewDispatch("2",
+					builder.Route{Match: builder.KeyPrefix("/apples"), Migration: builder.New(addMigration)},
+					builder.Route{Match: builder.KeyPrefix("/oranges"), Migration: builder.New(errorMigration)},
+				).OldVersion("1"),
+			},
+		},
+		"store at unknown newer version": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("5"),
+				"/5/apples":         numData(t, 14),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("5"),
+				"/5/apples":         numData(t, 14),
+			},
+			target:               "2",
+			expectedFinalVersion: "5",
+			expectedErr:          errors.New("database version is newer than this code supports: database is at unknown version \"5\", which requires code that understands version \"5\""),
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
+			},
+		},
+		"store at unknown newer version, readable by the target": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": readableVersionData("5", "2"),
+				"/5/apples":         numData(t, 14),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": readableVersionData("5", "2"),
+				"/5/apples":         numData(t, 14),
+			},
+			target:               "2",
+			expectedFinalVersion: "5",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
+			},
+		},
+		"store at unknown newer version, readable by an older version": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": readableVersionData("5", "1"),
+				"/5/apples":         numData(t, 14),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": readableVersionData("5", "1"),
+				"/5/apples":         numData(t, 14),
+			},
+			target:               "2",
+			expectedFinalVersion: "5",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
+			},
+		},
+		"versions are ordered by the migration list": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("9"),
+				"/9/apples":         numData(t, 7),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("10"),
+				"/10/apples":        numData(t, 28),
+			},
+			target:               "10",
+			expectedFinalVersion: "10",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "9").Reversible(subMigration),
+				versioned.NewVersionedBuilder(multiplyMigration, "10").Reversible(divideMigration).OldVersion("9"),
+			},
+		},
+		"store newer than target, without reversible path": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("3"),
+				"/3/apples":         numData(t, 56),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("3"),
+				"/3/apples":         numData(t, 56),
+			},
+			target:               "1",
+			expectedFinalVersion: "3",
+			expectedErr:          errors.New("migration is not reversible: migration from version \"1\" to \"2\""),
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(multiplyMigration, "3").Reversible(divideMigration).OldVersion("2"),
+			},
+		},
+		"store newer than target, through data compatible migration": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("3"),
+				"/3/apples":         numData(t, 56),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 49),
+			},
+			target:               "1",
+			expectedFinalVersion: "1",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "2").Reversible(subMigration).OldVersion("1"),
+				versioned.NewVersionedBuilder(multiplyMigration, "3").DataCompatible().OldVersion("2"),
+			},
+		},
+		"legacy version string": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": legacyVersionData("1"),
+				"/1/apples":         numData(t, 14),
+				"/1/oranges":        numData(t, 10),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 56),
+				"/2/oranges":        numData(t, 40),
+			},
+			target:               "2",
+			expectedFinalVersion: "2",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
+			},
+		},
+		"legacy version string, already migrated": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": legacyVersionData("2"),
+				"/2/apples":         numData(t, 56),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 56),
+			},
+			target:               "2",
+			expectedFinalVersion: "2",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(multiplyMigration, "2").Reversible(divideMigration).OldVersion("1"),
+			},
+		},
 		"no migrations": {
 			expectedFinalVersion: "2",
 			target:               "2",
@@ -409,8 +633,13 @@ func TestTo(t *testing.T) {
 					require.NoError(t, err)
 				}
 			}
-			migrations, err := data.migrationBuilders.Build()
-			require.NoError(t, err)
+			// build each migration separately, so To sees lists that wouldn't pass validation
+			var migrations versioning.VersionedMigrationList
+			for _, builder := range data.migrationBuilders {
+				migration, err := builder.Build()
+				require.NoError(t, err)
+				migrations = append(migrations, migration)
+			}
 			finalVersion, err := migrate.To(ctx, ds1, migrations, data.target)
 			require.Equal(t, data.expectedFinalVersion, finalVersion)
 			if data.expectedErr == nil {
@@ -437,6 +666,49 @@ func TestTo(t *testing.T) {
 }
 
 func versionData(versionKey versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(versionKey),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func readableVersionData(versionKey versioning.VersionKey, minReaderVersion versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(minReaderVersion),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// rawVersionRecord encodes a version record with the given names and values of
+// its fields, which needn't be fields VersionRecord has
+func rawVersionRecord(t *testing.T, fields ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	require.NoError(t, cbg.WriteMajorTypeHeader(buf, cbg.MajMap, uint64(len(fields)/2)))
+	for i := 0; i < len(fields); i += 2 {
+		require.NoError(t, cbg.WriteMajorTypeHeader(buf, cbg.MajTextString, uint64(len(fields[i].(string)))))
+		buf.WriteString(fields[i].(string))
+		switch value := fields[i+1].(type) {
+		case uint64:
+			require.NoError(t, cbg.WriteMajorTypeHeader(buf, cbg.MajUnsignedInt, value))
+		case string:
+			require.NoError(t, cbg.WriteMajorTypeHeader(buf, cbg.MajTextString, uint64(len(value))))
+			buf.WriteString(value)
+		}
+	}
+	return buf.Bytes()
+}
+
+func legacyVersionData(versionKey versioning.VersionKey) []byte {
 	return []byte(versionKey)
 }
 
@@ -447,3 +719,874 @@ func numData(t *testing.T, num int64) []byte {
 	require.NoError(t, err)
 	return buf.Bytes()
 }
+
+func TestToCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancellingMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		cancel()
+		newCount := *c * 4
+		return &newCount, nil
+	}
+	ds := datastore.NewMapDatastore()
+	inputDatabase := map[string][]byte{
+		"/versions/current": versionData("1"),
+		"/1/apples":         numData(t, 14),
+		"/1/oranges":        numData(t, 10),
+	}
+	for key, value := range inputDatabase {
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(cancellingMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+	finalVersion, err := migrate.To(ctx, ds, migrations, "2")
+	require.Equal(t, versioning.VersionKey("1"), finalVersion)
+	require.True(t, errors.Is(err, versioning.ErrContextCancelled))
+
+	outputDatabase := make(map[string][]byte)
+	res, err := ds.Query(context.Background(), query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	for _, entry := range entries {
+		outputDatabase[entry.Key] = entry.Value
+	}
+	require.Equal(t, inputDatabase, outputDatabase)
+}
+
+func TestToLocking(t *testing.T) {
+	ctx := context.Background()
+	multiplyMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c * 4
+		return &newCount, nil
+	}
+	testCases := map[string]struct {
+		lease                *migrate.MigrationLease
+		opts                 []versioning.Option
+		expectedErr          error
+		expectedFinalVersion versioning.VersionKey
+		expectLeaseRemains   bool
+	}{
+		"no existing lease": {
+			expectedFinalVersion: "2",
+		},
+		"lease held by another process": {
+			lease: &migrate.MigrationLease{
+				Owner:  "someone-else",
+				Expiry: time.Now().Add(time.Minute).UnixNano(),
+			},
+			expectedErr:          versioning.ErrMigrationLocked,
+			expectedFinalVersion: "",
+			expectLeaseRemains:   true,
+		},
+		"stale lease is taken over": {
+			lease: &migrate.MigrationLease{
+				Owner:  "someone-else",
+				Expiry: time.Now().Add(-time.Minute).UnixNano(),
+			},
+			expectedFinalVersion: "2",
+		},
+		"lease held under our own ID": {
+			lease: &migrate.MigrationLease{
+				Owner:  "me",
+				Expiry: time.Now().Add(time.Minute).UnixNano(),
+			},
+			opts:                 []versioning.Option{versioning.LockOwner("me")},
+			expectedFinalVersion: "2",
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1")))
+			require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 14)))
+			if data.lease != nil {
+				leaseData, err := cborutil.Dump(data.lease)
+				require.NoError(t, err)
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/lock"), leaseData))
+			}
+			migrations, err := versioned.BuilderList{
+				versioned.NewVersionedBuilder(multiplyMigration, "2").OldVersion("1"),
+			}.Build()
+			require.NoError(t, err)
+			finalVersion, err := migrate.NewMigrator(data.opts...).To(ctx, ds, migrations, "2")
+			require.Equal(t, data.expectedFinalVersion, finalVersion)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, data.expectedErr))
+			}
+			has, err := ds.Has(ctx, datastore.NewKey("/versions/lock"))
+			require.NoError(t, err)
+			require.Equal(t, data.expectLeaseRemains, has)
+		})
+	}
+}
+
+func TestToLockTTL(t *testing.T) {
+	ctx := context.Background()
+	testCases := map[string]struct {
+		ttl         time.Duration
+		expectedErr error
+	}{
+		"default": {},
+		"negative": {
+			ttl:         -time.Second,
+			expectedErr: errors.New("lock TTL must be at least 3ms, but is -1s"),
+		},
+		"too short to renew": {
+			ttl:         2 * time.Nanosecond,
+			expectedErr: errors.New("lock TTL must be at least 3ms, but is 2ns"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			_, err := migrate.NewMigrator(versioning.LockTTL(data.ttl)).To(ctx, ds, versioning.VersionedMigrationList{}, "1")
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+		})
+	}
+}
+
+func TestToVersionsNamespace(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	testCases := map[string]struct {
+		inputDatabase          map[string][]byte
+		expectedOutputDatabase map[string][]byte
+		opts                   []versioning.Option
+		migrationBuilders      versioned.BuilderList
+		target                 versioning.VersionKey
+		expectedFinalVersion   versioning.VersionKey
+		expectedErr            error
+	}{
+		"custom namespace": {
+			inputDatabase: map[string][]byte{
+				"/versions/apples": numData(t, 7),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/_meta/current":     versionData("1"),
+				"/1/versions/apples": numData(t, 14),
+			},
+			opts:                 []versioning.Option{versioning.VersionsNamespace(datastore.NewKey("/_meta"))},
+			target:               "1",
+			expectedFinalVersion: "1",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "1"),
+			},
+		},
+		"unversioned data in versions namespace": {
+			inputDatabase: map[string][]byte{
+				"/versions/apples": numData(t, 7),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/apples": numData(t, 7),
+			},
+			target:      "1",
+			expectedErr: errors.New("versions namespace collides with data: unversioned data found under /versions"),
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "1"),
+			},
+		},
+		"version named like versions namespace": {
+			inputDatabase:          map[string][]byte{},
+			expectedOutputDatabase: map[string][]byte{},
+			target:                 "versions",
+			expectedErr:            errors.New("versions namespace collides with data: version \"versions\", versions namespace /versions"),
+		},
+		"version that contains versions namespace": {
+			inputDatabase:          map[string][]byte{},
+			expectedOutputDatabase: map[string][]byte{},
+			opts:                   []versioning.Option{versioning.VersionsNamespace(datastore.NewKey("/2/meta"))},
+			target:                 "2",
+			expectedErr:            errors.New("versions namespace collides with data: version \"2\", versions namespace /2/meta"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			migrations, err := data.migrationBuilders.Build()
+			require.NoError(t, err)
+			finalVersion, err := migrate.NewMigrator(data.opts...).To(ctx, ds, migrations, data.target)
+			require.Equal(t, data.expectedFinalVersion, finalVersion)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+			outputDatabase := make(map[string][]byte)
+			res, err := ds.Query(ctx, query.Query{})
+			require.NoError(t, err)
+			entries, err := res.Rest()
+			require.NoError(t, err)
+			for _, entry := range entries {
+				outputDatabase[entry.Key] = entry.Value
+			}
+			require.Equal(t, data.expectedOutputDatabase, outputDatabase)
+		})
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	ctx := context.Background()
+	newerFormat, err := cborutil.Dump(&migrate.VersionRecord{Format: 4, Version: "3"})
+	require.NoError(t, err)
+	inProgress, err := cborutil.Dump(&migrate.VersionRecord{Format: 3, Version: "2", InProgress: true, TargetVersion: "3"})
+	require.NoError(t, err)
+	testCases := map[string]struct {
+		versionData     []byte
+		expectedVersion versioning.VersionKey
+		expectedErr     error
+	}{
+		"no version": {
+			expectedErr: datastore.ErrNotFound,
+		},
+		"legacy version string": {
+			versionData:     legacyVersionData("2"),
+			expectedVersion: "2",
+		},
+		"version record": {
+			versionData:     versionData("2"),
+			expectedVersion: "2",
+		},
+		"version record, in progress": {
+			versionData:     inProgress,
+			expectedVersion: "2",
+		},
+		"version record format too new": {
+			versionData: newerFormat,
+			expectedErr: errors.New("version record has format 4, but only formats up to 3 are supported"),
+		},
+		"version record format too new, with fields this code doesn't know": {
+			versionData: rawVersionRecord(t, "Format", uint64(4), "Version", "3", "Extra", "x"),
+			expectedErr: errors.New("version record has format 4, but only formats up to 3 are supported"),
+		},
+		"malformed version record": {
+			versionData: rawVersionRecord(t, "Format", uint64(3), "Extra", "x"),
+			expectedErr: errors.New("decoding version record: unknown struct field 1: 'Extra'"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			if data.versionData != nil {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), data.versionData))
+			}
+			version, err := migrate.ReadVersion(ctx, ds)
+			require.Equal(t, data.expectedVersion, version)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+		})
+	}
+}
+
+func TestToMinReaderVersion(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+	finalVersion, err := migrate.NewMigrator(versioning.MinReaderVersion("1"), versioning.CodeVersion("v1.2.0")).To(ctx, ds, nil, "2")
+	require.NoError(t, err)
+	require.Equal(t, versioning.VersionKey("2"), finalVersion)
+	data, err := ds.Get(ctx, datastore.NewKey("/versions/current"))
+	require.NoError(t, err)
+	var record migrate.VersionRecord
+	require.NoError(t, cborutil.ReadCborRPC(bytes.NewReader(data), &record))
+	require.Equal(t, migrate.VersionRecord{
+		Format:           3,
+		Version:          "2",
+		WrittenBy:        "v1.2.0",
+		MinReaderVersion: "1",
+	}, record)
+}
+
+func TestToSchemaFingerprint(t *testing.T) {
+	ctx := context.Background()
+	leaseSchema, err := fingerprint.Of(migrate.MigrationLease{})
+	require.NoError(t, err)
+	toLease := versioned.NewVersionedBuilder(func(old *cbg.CborInt) (*migrate.MigrationLease, error) {
+		return &migrate.MigrationLease{Heartbeat: int64(*old)}, nil
+	}, "1")
+	toVersionRecord := versioned.NewVersionedBuilder(func(old *cbg.CborInt) (*migrate.VersionRecord, error) {
+		return &migrate.VersionRecord{Format: uint64(*old)}, nil
+	}, "1")
+	toInt := versioned.NewVersionedBuilder(func(old *cbg.CborInt) (*cbg.CborInt, error) {
+		return old, nil
+	}, "1")
+	testCases := map[string]struct {
+		stored            *migrate.VersionRecord
+		migrationBuilders versioned.BuilderList
+		opts              []versioning.Option
+		expectedSchema    string
+		expectedErr       error
+	}{
+		"new store, schema from migration": {
+			migrationBuilders: versioned.BuilderList{toLease},
+			expectedSchema:    leaseSchema,
+		},
+		"new store, schema from option": {
+			migrationBuilders: versioned.BuilderList{toLease},
+			opts:              []versioning.Option{versioning.SchemaFingerprint("abc")},
+			expectedSchema:    "abc",
+		},
+		"new store, no known schema": {
+			migrationBuilders: versioned.BuilderList{toInt},
+		},
+		"schema matches": {
+			stored:            &migrate.VersionRecord{Format: 3, Version: "1", MinReaderVersion: "1", SchemaFingerprint: leaseSchema},
+			migrationBuilders: versioned.BuilderList{toLease},
+			expectedSchema:    leaseSchema,
+		},
+		"schema recorded for store written without one": {
+			stored:            &migrate.VersionRecord{Format: 3, Version: "1", MinReaderVersion: "1"},
+			migrationBuilders: versioned.BuilderList{toLease},
+			expectedSchema:    leaseSchema,
+		},
+		"stored schema kept when schema unknown": {
+			stored:            &migrate.VersionRecord{Format: 3, Version: "1", MinReaderVersion: "1", SchemaFingerprint: leaseSchema},
+			migrationBuilders: versioned.BuilderList{toInt},
+			expectedSchema:    leaseSchema,
+		},
+		"schema drift": {
+			stored:            &migrate.VersionRecord{Format: 3, Version: "1", MinReaderVersion: "1", SchemaFingerprint: leaseSchema},
+			migrationBuilders: versioned.BuilderList{toVersionRecord},
+			expectedSchema:    leaseSchema,
+			expectedErr:       fmt.Errorf("record schema does not match the schema this version was written with: version \"1\" has schema %s, but this code expects", leaseSchema),
+		},
+		"schema drift from option": {
+			stored:            &migrate.VersionRecord{Format: 3, Version: "1", MinReaderVersion: "1", SchemaFingerprint: leaseSchema},
+			migrationBuilders: versioned.BuilderList{toLease},
+			opts:              []versioning.Option{versioning.SchemaFingerprint("abc")},
+			expectedSchema:    leaseSchema,
+			expectedErr:       fmt.Errorf("record schema does not match the schema this version was written with: version \"1\" has schema %s, but this code expects abc", leaseSchema),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			if data.stored != nil {
+				stored, err := cborutil.Dump(data.stored)
+				require.NoError(t, err)
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), stored))
+			}
+			migrations, err := data.migrationBuilders.Build()
+			require.NoError(t, err)
+			finalVersion, err := migrate.NewMigrator(data.opts...).To(ctx, ds, migrations, "1")
+			require.Equal(t, versioning.VersionKey("1"), finalVersion)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, versioning.ErrSchemaDrift))
+				require.Contains(t, err.Error(), data.expectedErr.Error())
+			}
+			stored, err := ds.Get(ctx, datastore.NewKey("/versions/current"))
+			require.NoError(t, err)
+			var record migrate.VersionRecord
+			require.NoError(t, cborutil.ReadCborRPC(bytes.NewReader(stored), &record))
+			require.Equal(t, data.expectedSchema, record.SchemaFingerprint)
+		})
+	}
+}
+
+func TestToKeepsVersionRecord(t *testing.T) {
+	ctx := context.Background()
+	failMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		return nil, errors.New("could not migrate")
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(failMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	stored, err := cborutil.Dump(&migrate.VersionRecord{Format: 3, Version: "1", MinReaderVersion: "1", SchemaFingerprint: "abc"})
+	require.NoError(t, err)
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), stored))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 7)))
+	finalVersion, err := migrate.NewMigrator(versioning.CodeVersion("v2.0.0")).To(ctx, ds, migrations, "2")
+	require.EqualError(t, err, "running up migration: attempting to transform to new state '/apples': could not migrate")
+	require.Equal(t, versioning.VersionKey("1"), finalVersion)
+
+	stored, err = ds.Get(ctx, datastore.NewKey("/versions/current"))
+	require.NoError(t, err)
+	var record migrate.VersionRecord
+	require.NoError(t, cborutil.ReadCborRPC(bytes.NewReader(stored), &record))
+	require.Equal(t, migrate.VersionRecord{
+		Format:            3,
+		Version:           "1",
+		WrittenBy:         "v2.0.0",
+		MinReaderVersion:  "1",
+		SchemaFingerprint: "abc",
+	}, record)
+}
+
+func TestToIndexes(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	subMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c - 7
+		return &newCount, nil
+	}
+	// indexes records by their count, pointing back to the record's key
+	byCount := versioned.TypedIndex(func(key datastore.Key, c *cbg.CborInt) ([]versioning.IndexEntry, error) {
+		if *c < 0 {
+			return nil, errors.New("negative count")
+		}
+		return []versioning.IndexEntry{{Key: datastore.NewKey(fmt.Sprint(*c)), Value: key.Bytes()}}, nil
+	})
+	testCases := map[string]struct {
+		inputDatabase          map[string][]byte
+		expectedOutputDatabase map[string][]byte
+		migrationBuilders      versioned.BuilderList
+		target                 versioning.VersionKey
+		expectedFinalVersion   versioning.VersionKey
+		expectedErr            error
+	}{
+		"builds indexes for the new version, drops the old version's": {
+			inputDatabase: map[string][]byte{
+				"/versions/current":             versionData("1"),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+				"/1/apples":                     numData(t, 7),
+				"/1/oranges":                    numData(t, 3),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current":              versionData("2"),
+				"/versions/indexes/2/byCount/14": []byte("/apples"),
+				"/versions/indexes/2/byCount/10": []byte("/oranges"),
+				"/2/apples":                      numData(t, 14),
+				"/2/oranges":                     numData(t, 10),
+			},
+			target:               "2",
+			expectedFinalVersion: "2",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1").Index("byCount", byCount),
+			},
+		},
+		"builds indexes when migrating down": {
+			inputDatabase: map[string][]byte{
+				"/versions/current":              versionData("2"),
+				"/versions/indexes/2/byCount/14": []byte("/apples"),
+				"/2/apples":                      numData(t, 14),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current":             versionData("1"),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+				"/1/apples":                     numData(t, 7),
+			},
+			target:               "1",
+			expectedFinalVersion: "1",
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(subMigration, "1").Index("byCount", byCount),
+				versioned.NewVersionedBuilder(addMigration, "2").Reversible(subMigration).OldVersion("1").Index("byCount", byCount),
+			},
+		},
+		"index error rolls back the step": {
+			inputDatabase: map[string][]byte{
+				"/versions/current":             versionData("1"),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+				"/1/apples":                     numData(t, 7),
+				"/1/oranges":                    numData(t, -20),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current":             versionData("1"),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+				"/1/apples":                     numData(t, 7),
+				"/1/oranges":                    numData(t, -20),
+			},
+			target:               "2",
+			expectedFinalVersion: "1",
+			expectedErr:          errors.New("running up migration: building index \"byCount\" for key '/oranges': negative count"),
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1").Index("byCount", byCount),
+			},
+		},
+		"two records with the same index key": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+				"/1/oranges":        numData(t, 7),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+				"/1/oranges":        numData(t, 7),
+			},
+			target:               "2",
+			expectedFinalVersion: "1",
+			expectedErr:          errors.New("running up migration: building index \"byCount\": keys '/apples' and '/oranges' both index to '/14'"),
+			migrationBuilders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1").Index("byCount", byCount),
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			migrations, err := data.migrationBuilders.Build()
+			require.NoError(t, err)
+			finalVersion, err := migrate.To(ctx, ds, migrations, data.target)
+			require.Equal(t, data.expectedFinalVersion, finalVersion)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+			res, err := ds.Query(ctx, query.Query{})
+			require.NoError(t, err)
+			entries, err := res.Rest()
+			require.NoError(t, err)
+			outputDatabase := make(map[string][]byte)
+			for _, entry := range entries {
+				outputDatabase[entry.Key] = entry.Value
+			}
+			require.Equal(t, data.expectedOutputDatabase, outputDatabase)
+		})
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	ctx := context.Background()
+	byCount := versioning.Index{Name: "byCount", Entries: func(key datastore.Key, value []byte) ([]versioning.IndexEntry, error) {
+		return []versioning.IndexEntry{{Key: key, Value: value}}, nil
+	}}
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/indexes/1/byCount/stale"), []byte("stale")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 7)))
+
+	err := migrate.RebuildIndex(ctx, ds, "2", byCount)
+	require.EqualError(t, err, "index \"byCount\" can only be rebuilt for the current version of the datastore")
+	err = migrate.RebuildIndex(ctx, ds, "1", versioning.Index{Name: "by/count", Entries: byCount.Entries})
+	require.EqualError(t, err, "index name \"by/count\" must be a single key component")
+
+	require.NoError(t, migrate.RebuildIndex(ctx, ds, "1", byCount))
+	res, err := ds.Query(ctx, query.Query{Prefix: "/versions/indexes"})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/versions/indexes/1/byCount/apples", entries[0].Key)
+	require.Equal(t, numData(t, 7), entries[0].Value)
+}
+
+func lazyVersionData(versionKey versioning.VersionKey, lazyFrom versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(versionKey),
+		LazyFrom:         string(lazyFrom),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestLazyTo(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrationBuilders := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+		versioned.NewVersionedBuilder(addMigration, "3").OldVersion("2"),
+	}
+	testCases := map[string]struct {
+		inputDatabase          map[string][]byte
+		expectedOutputDatabase map[string][]byte
+		target                 versioning.VersionKey
+		eager                  bool
+		expectedFinalVersion   versioning.VersionKey
+		expectedStep           *migrate.LazyStep
+	}{
+		"moves up one version without migrating records": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": lazyVersionData("2", "1"),
+				"/1/apples":         numData(t, 7),
+			},
+			target:               "2",
+			expectedFinalVersion: "2",
+			expectedStep:         &migrate.LazyStep{From: "1", To: "2"},
+		},
+		"returns the step until it's finished": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": lazyVersionData("2", "1"),
+				"/1/apples":         numData(t, 7),
+				"/2/oranges":        numData(t, 10),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": lazyVersionData("2", "1"),
+				"/1/apples":         numData(t, 7),
+				"/2/oranges":        numData(t, 10),
+			},
+			target:               "2",
+			expectedFinalVersion: "2",
+			expectedStep:         &migrate.LazyStep{From: "1", To: "2"},
+		},
+		"migrates more than one version up all at once": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("3"),
+				"/3/apples":         numData(t, 21),
+			},
+			target:               "3",
+			expectedFinalVersion: "3",
+		},
+		"finishes a lazy step before moving on": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": lazyVersionData("2", "1"),
+				"/1/apples":         numData(t, 7),
+				"/1/oranges":        numData(t, 3),
+				"/2/oranges":        numData(t, 10),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("3"),
+				"/3/apples":         numData(t, 21),
+				"/3/oranges":        numData(t, 17),
+			},
+			target:               "3",
+			expectedFinalVersion: "3",
+		},
+		"migrating all at once finishes a lazy step": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": lazyVersionData("2", "1"),
+				"/1/apples":         numData(t, 7),
+				"/1/oranges":        numData(t, 3),
+				"/2/oranges":        numData(t, 12),
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+				"/2/oranges":        numData(t, 12),
+			},
+			target:               "2",
+			eager:                true,
+			expectedFinalVersion: "2",
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			migrations, err := migrationBuilders.Build()
+			require.NoError(t, err)
+			var finalVersion versioning.VersionKey
+			var step *migrate.LazyStep
+			if data.eager {
+				finalVersion, err = migrate.To(ctx, ds, migrations, data.target)
+			} else {
+				finalVersion, step, err = migrate.NewMigrator().LazyTo(ctx, ds, migrations, data.target)
+			}
+			require.NoError(t, err)
+			require.Equal(t, data.expectedFinalVersion, finalVersion)
+			if data.expectedStep == nil {
+				require.Nil(t, step)
+			} else {
+				require.NotNil(t, step)
+				require.Equal(t, data.expectedStep.From, step.From)
+				require.Equal(t, data.expectedStep.To, step.To)
+			}
+			res, err := ds.Query(ctx, query.Query{})
+			require.NoError(t, err)
+			entries, err := res.Rest()
+			require.NoError(t, err)
+			outputDatabase := make(map[string][]byte)
+			for _, entry := range entries {
+				outputDatabase[entry.Key] = entry.Value
+			}
+			require.Equal(t, data.expectedOutputDatabase, outputDatabase)
+		})
+	}
+}
+
+func TestFinishLazy(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), lazyVersionData("2", "1")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/indexes/1/byCount/7"), []byte("/apples")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/pears"), numData(t, 3)))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/2/apples"), numData(t, 14)))
+
+	m := migrate.NewMigrator()
+	require.NoError(t, m.FinishLazy(ctx, ds, migrate.LazyStep{From: "1", To: "2"}))
+	res, err := ds.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	outputDatabase := make(map[string][]byte)
+	for _, entry := range entries {
+		outputDatabase[entry.Key] = entry.Value
+	}
+	require.Equal(t, map[string][]byte{
+		"/versions/current": versionData("2"),
+		"/2/apples":         numData(t, 14),
+	}, outputDatabase)
+
+	err = m.FinishLazy(ctx, ds, migrate.LazyStep{From: "1", To: "2"})
+	require.EqualError(t, err, "datastore is no longer migrating lazily from version \"1\" to \"2\"")
+}
+
+func stagedVersionData(versionKey versioning.VersionKey, staged versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(versionKey),
+		Staged:           string(staged),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestStage(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		if *c < 0 {
+			return nil, errors.New("negative count")
+		}
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrationBuilders := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+		versioned.NewVersionedBuilder(addMigration, "3").OldVersion("2"),
+	}
+	testCases := map[string]struct {
+		inputDatabase          map[string][]byte
+		target                 versioning.VersionKey
+		expectedErr            error
+		expectedOutputDatabase map[string][]byte
+	}{
+		"builds the next version alongside the current one": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+			target: "2",
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": stagedVersionData("1", "2"),
+				"/1/apples":         numData(t, 7),
+				"/2/apples":         numData(t, 14),
+			},
+		},
+		"replaces what was staged before": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": stagedVersionData("1", "2"),
+				"/1/apples":         numData(t, 7),
+				"/2/oranges":        numData(t, 10),
+			},
+			target: "2",
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": stagedVersionData("1", "2"),
+				"/1/apples":         numData(t, 7),
+				"/2/apples":         numData(t, 14),
+			},
+		},
+		"only stages the next version": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+			target:      "3",
+			expectedErr: errors.New("version \"3\" can only be staged from the version before it, but the datastore is at version \"1\""),
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+		},
+		"failed builds are cleaned up": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, -1),
+			},
+			target:      "2",
+			expectedErr: errors.New("staging version \"2\": attempting to transform to new state '/apples': negative count"),
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, -1),
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			migrations, err := migrationBuilders.Build()
+			require.NoError(t, err)
+			_, err = migrate.NewMigrator().Stage(ctx, ds, migrations, data.target)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+			res, err := ds.Query(ctx, query.Query{})
+			require.NoError(t, err)
+			entries, err := res.Rest()
+			require.NoError(t, err)
+			outputDatabase := make(map[string][]byte)
+			for _, entry := range entries {
+				outputDatabase[entry.Key] = entry.Value
+			}
+			require.Equal(t, data.expectedOutputDatabase, outputDatabase)
+		})
+	}
+}
+
+func TestPromote(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), stagedVersionData("1", "2")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/indexes/1/byCount/7"), []byte("/apples")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 7)))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/2/apples"), numData(t, 14)))
+
+	m := migrate.NewMigrator()
+	err := m.Promote(ctx, ds, nil, "3")
+	require.EqualError(t, err, "version \"3\" has not been staged")
+	require.NoError(t, m.Promote(ctx, ds, nil, "2"))
+	res, err := ds.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	outputDatabase := make(map[string][]byte)
+	for _, entry := range entries {
+		outputDatabase[entry.Key] = entry.Value
+	}
+	require.Equal(t, map[string][]byte{
+		"/versions/current": versionData("2"),
+		"/2/apples":         numData(t, 14),
+	}, outputDatabase)
+	require.NoError(t, m.Promote(ctx, ds, nil, "2"))
+}
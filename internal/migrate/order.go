@@ -0,0 +1,48 @@
+package migrate
+
+import (
+	"github.com/filecoin-project/go-ds-versioning/internal/validate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// versionOrder returns the position of each version in a sorted migration list
+func versionOrder(migrations versioning.VersionedMigrationList) map[versioning.VersionKey]int {
+	order := make(map[versioning.VersionKey]int, len(migrations)+1)
+	for i, migration := range migrations {
+		if i == 0 {
+			order[migration.OldVersion()] = 0
+		}
+		order[migration.NewVersion()] = i + 1
+	}
+	return order
+}
+
+// before reports whether one version comes before another. Versions that aren't
+// in the migration list can only be compared by their keys
+func before(order map[versioning.VersionKey]int, a versioning.VersionKey, b versioning.VersionKey) bool {
+	aOrder, aKnown := order[a]
+	bOrder, bKnown := order[b]
+	if aKnown && bKnown {
+		return aOrder < bOrder
+	}
+	return a < b
+}
+
+// Before reports whether one version comes before another in a list of
+// migrations. Versions that aren't in the list are compared by their keys
+func Before(migrations versioning.VersionedMigrationList, a versioning.VersionKey, b versioning.VersionKey) bool {
+	sorted := append(versioning.VersionedMigrationList(nil), migrations...)
+	validate.SortMigrations(sorted)
+	return before(versionOrder(sorted), a, b)
+}
+
+// KnownVersion reports whether a version is one the migration list migrates
+// to or from
+func KnownVersion(migrations versioning.VersionedMigrationList, version versioning.VersionKey) bool {
+	for _, migration := range migrations {
+		if migration.OldVersion() == version || migration.NewVersion() == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/utils"
+	"github.com/filecoin-project/go-ds-versioning/internal/validate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// Stage builds the next version of the database alongside the current version,
+// leaving the current version in place until the staged version is promoted. The
+// version must be one up from the current version. Building it again replaces
+// whatever was staged before. It returns the migration that built the version
+func (m Migrator) Stage(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) (versioning.VersionedMigration, error) {
+	validate.SortMigrations(migrations)
+	if !verifyIntegrity(migrations) {
+		return nil, fmt.Errorf("migrations list must be contiguous")
+	}
+	if err := m.checkCollisions(migrations, to); err != nil {
+		return nil, err
+	}
+	var staged versioning.VersionedMigration
+	err := m.withLease(ctx, ds, func(ctx context.Context) error {
+		var err error
+		staged, err = m.stage(ctx, ds, migrations, to)
+		return err
+	})
+	return staged, err
+}
+
+func (m Migrator) stage(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) (versioning.VersionedMigration, error) {
+	record, err := m.readVersionRecord(ctx, ds)
+	if err != nil {
+		return nil, fmt.Errorf("reading version: %w", err)
+	}
+	if record.InProgress || record.LazyFrom != "" {
+		return nil, fmt.Errorf("version %q can't be staged while the datastore is being migrated", to)
+	}
+	current := versioning.VersionKey(record.Version)
+	var staged versioning.VersionedMigration
+	for _, migration := range migrations {
+		if migration.OldVersion() == current && migration.NewVersion() == to && current != versioning.VersionKey("") {
+			staged = migration
+		}
+	}
+	if staged == nil {
+		return nil, fmt.Errorf("version %q can only be staged from the version before it, but the datastore is at version %q", to, current)
+	}
+	if err := m.dropStaged(ctx, ds, record); err != nil {
+		return nil, err
+	}
+	// clear out anything left behind by an earlier attempt
+	if err := dropNamespace(ctx, ds, datastore.NewKey(string(to))); err != nil {
+		return nil, fmt.Errorf("deleting records at version %q: %w", to, err)
+	}
+	keys, err := m.runStep(ctx, ds, staged, true)
+	if err == nil {
+		err = buildIndexes(ctx, ds, m.versionsPrefix, to, IndexesFor(migrations, to))
+	}
+	if err != nil {
+		_ = deleteKeys(utils.Detach(ctx), ds, utils.KeysForVersion(to, keys))
+		_ = dropIndexes(utils.Detach(ctx), ds, m.versionsPrefix, to)
+		return nil, fmt.Errorf("staging version %q: %w", to, err)
+	}
+	record.Staged = string(to)
+	if err := m.writeVersionRecord(ctx, ds, *record); err != nil {
+		return nil, fmt.Errorf("writing version: %w", err)
+	}
+	return staged, nil
+}
+
+// Promote makes a staged version the current version of the database, and
+// deletes the records and indexes of the version it replaces. Promoting the
+// current version does nothing
+func (m Migrator) Promote(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, to versioning.VersionKey) error {
+	validate.SortMigrations(migrations)
+	return m.withLease(ctx, ds, func(ctx context.Context) error {
+		record, err := m.readVersionRecord(ctx, ds)
+		if err != nil {
+			return fmt.Errorf("reading version: %w", err)
+		}
+		if versioning.VersionKey(record.Version) == to && record.Staged == "" {
+			return nil
+		}
+		if versioning.VersionKey(record.Staged) != to {
+			return fmt.Errorf("version %q has not been staged", to)
+		}
+		from := versioning.VersionKey(record.Version)
+		next := m.movedTo(*record, migrations, to, m.schemaFingerprint(migrations, to))
+		next.Staged = ""
+		if err := m.writeVersionRecord(ctx, ds, next); err != nil {
+			return fmt.Errorf("writing version: %w", err)
+		}
+		if err := dropNamespace(ctx, ds, datastore.NewKey(string(from))); err != nil {
+			return fmt.Errorf("deleting records at version %q: %w", from, err)
+		}
+		if err := dropIndexes(ctx, ds, m.versionsPrefix, from); err != nil {
+			return fmt.Errorf("dropping indexes: %w", err)
+		}
+		return nil
+	})
+}
+
+// dropStaged deletes the records and indexes of a staged version, for when the
+// database moves on without promoting it
+func (m Migrator) dropStaged(ctx context.Context, ds datastore.Batching, record *VersionRecord) error {
+	if record.Staged == "" {
+		return nil
+	}
+	staged := versioning.VersionKey(record.Staged)
+	if err := dropNamespace(ctx, ds, datastore.NewKey(string(staged))); err != nil {
+		return fmt.Errorf("deleting records at staged version %q: %w", staged, err)
+	}
+	if err := dropIndexes(ctx, ds, m.versionsPrefix, staged); err != nil {
+		return fmt.Errorf("dropping indexes: %w", err)
+	}
+	record.Staged = ""
+	return nil
+}
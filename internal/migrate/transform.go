@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/ipfs/go-datastore"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/codec"
+)
+
+// Transform converts the encoded value of a single record into the encoded value
+// of the migrated record. Errors it returns apply only to that record
+type Transform func(key datastore.Key, value []byte) ([]byte, error)
+
+// Record is a pointer to a type that can be read from and written to a datastore
+// as CBOR
+type Record[T any] interface {
+	*T
+	cbg.CBORMarshaler
+	cbg.CBORUnmarshaler
+}
+
+// TypedTransform converts a typed migration function into a transform that
+// decodes, transforms, and encodes records as CBOR without reflection
+func TypedTransform[T any, U any, PT Record[T], PU Record[U]](migrateFunc func(PT) (PU, error)) Transform {
+	return TypedCodecTransform(migrateFunc, codec.CBOR, codec.CBOR)
+}
+
+// TypedCodecTransform converts a typed migration function into a transform that
+// decodes records with the input codec and encodes them with the output codec
+func TypedCodecTransform[T any, U any, PT Record[T], PU Record[U]](migrateFunc func(PT) (PU, error), inputCodec versioning.Codec, outputCodec versioning.Codec) Transform {
+	return func(key datastore.Key, value []byte) ([]byte, error) {
+		oldElem := PT(new(T))
+		err := inputCodec.Decode(value, oldElem)
+		if err != nil {
+			return nil, decodingError(key, err)
+		}
+		newElem, err := migrateFunc(oldElem)
+		if err != nil {
+			return nil, transformError(key, err)
+		}
+		return encode(key, outputCodec, newElem)
+	}
+}
+
+// ReflectTransform converts a migration function that has been checked with
+// validate.CheckMigration into a transform that reads and writes records as CBOR.
+// If the function takes an accessor, it is given the one passed here
+func ReflectTransform(oldType reflect.Type, migrateFunc reflect.Value, accessor versioning.Accessor) Transform {
+	return CodecTransform(oldType, migrateFunc, codec.CBOR, codec.CBOR, accessor)
+}
+
+// CodecTransform converts a migration function that has been checked with
+// validate.CheckMigrationFunc and validate.CheckCodecs into a transform that
+// decodes records with the input codec and encodes them with the output codec.
+// If the function takes an accessor, it is given the one passed here
+func CodecTransform(oldType reflect.Type, migrateFunc reflect.Value, inputCodec versioning.Codec, outputCodec versioning.Codec, accessor versioning.Accessor) Transform {
+	withAccessor := migrateFunc.Type().NumIn() == 2
+	return func(key datastore.Key, value []byte) ([]byte, error) {
+		oldElem, err := decode(inputCodec, oldType, value)
+		if err != nil {
+			return nil, decodingError(key, err)
+		}
+		args := []reflect.Value{oldElem}
+		if withAccessor {
+			args = append(args, reflect.ValueOf(&accessor).Elem())
+		}
+		outputs := migrateFunc.Call(args)
+		err, ok := outputs[1].Interface().(error)
+		if ok && err != nil {
+			return nil, transformError(key, err)
+		}
+		return encode(key, outputCodec, outputs[0].Interface())
+	}
+}
+
+// RawTransform converts a raw migration function into a transform
+func RawTransform(migrateFunc versioning.RawMigrationFunc) Transform {
+	return func(key datastore.Key, value []byte) ([]byte, error) {
+		newValue, err := migrateFunc(key, value)
+		if err != nil {
+			return nil, transformError(key, err)
+		}
+		return newValue, nil
+	}
+}
+
+// identity copies records unchanged
+func identity(_ datastore.Key, value []byte) ([]byte, error) {
+	return value, nil
+}
+
+// decode reads a value of the given type, allocating it first if it is a pointer
+func decode(inputCodec versioning.Codec, oldType reflect.Type, value []byte) (reflect.Value, error) {
+	if oldType.Kind() == reflect.Ptr {
+		oldElem := reflect.New(oldType.Elem())
+		return oldElem, inputCodec.Decode(value, oldElem.Interface())
+	}
+	oldElem := reflect.New(oldType)
+	return oldElem.Elem(), inputCodec.Decode(value, oldElem.Interface())
+}
+
+func encode(key datastore.Key, outputCodec versioning.Codec, newElem interface{}) ([]byte, error) {
+	bts, err := outputCodec.Encode(newElem)
+	if err != nil {
+		return nil, fmt.Errorf("encoding state for key '%s': %w", key, err)
+	}
+	return bts, nil
+}
+
+func decodingError(key datastore.Key, err error) error {
+	return fmt.Errorf("decoding state for key '%s': %w", key, err)
+}
+
+func transformError(key datastore.Key, err error) error {
+	return fmt.Errorf("attempting to transform to new state '%s': %w", key, err)
+}
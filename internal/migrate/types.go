@@ -0,0 +1,39 @@
+package migrate
+
+// MigrationLease is an advisory lock, stored in the datastore, that prevents
+// more than one process from migrating a datastore at the same time
+type MigrationLease struct {
+	// Owner identifies the holder of the lease
+	Owner string
+	// Heartbeat is the last time the owner renewed the lease, in unix nanoseconds
+	Heartbeat int64
+	// Expiry is when the lease becomes stale and can be taken over, in unix nanoseconds
+	Expiry int64
+}
+
+// VersionRecord describes the version of the data in a datastore. It is stored
+// at the current version key, in place of the raw version string earlier
+// releases wrote there
+type VersionRecord struct {
+	// Format is the version of the format of this record itself
+	Format uint64
+	// Version is the current version of the data
+	Version string
+	// WrittenBy is the version of the code that last wrote this record
+	WrittenBy string
+	// MinReaderVersion is the lowest version of the data that code reading this
+	// datastore must understand
+	MinReaderVersion string
+	// SchemaFingerprint identifies the schema of the records at the current version
+	SchemaFingerprint string
+	// InProgress is set while migrations are running
+	InProgress bool
+	// TargetVersion is the version migrations are running to, while they are in progress
+	TargetVersion string
+	// LazyFrom is the version records are still being migrated from, one at a
+	// time, when the store moved to the current version lazily
+	LazyFrom string
+	// Staged is a version that has been built alongside the current version,
+	// and is ready to be promoted to current
+	Staged string
+}
@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// versionRecordFormat is the current format of VersionRecord. Increment it
+// whenever fields are added to the record, since older code can't decode
+// fields it doesn't know. Format 2 added LazyFrom, and format 3 added Staged
+const versionRecordFormat = 3
+
+// decodeVersionRecord reads a version record, upgrading the legacy format that
+// was just the version string
+func decodeVersionRecord(data []byte) (*VersionRecord, error) {
+	if len(data) == 0 || data[0]>>5 != cbg.MajMap {
+		return &VersionRecord{Version: string(data)}, nil
+	}
+	var record VersionRecord
+	if err := cborutil.ReadCborRPC(bytes.NewReader(data), &record); err != nil {
+		if format, ok := recordFormat(data); ok && format > versionRecordFormat {
+			return nil, formatError(format)
+		}
+		return nil, fmt.Errorf("decoding version record: %w", err)
+	}
+	if record.Format > versionRecordFormat {
+		return nil, formatError(record.Format)
+	}
+	return &record, nil
+}
+
+func formatError(format uint64) error {
+	return fmt.Errorf("version record has format %d, but only formats up to %d are supported", format, versionRecordFormat)
+}
+
+// recordFormat reads just the format of a version record, which every format
+// writes as its first field, so records with fields this code doesn't know can
+// still be recognised as too new
+func recordFormat(data []byte) (uint64, bool) {
+	r := bytes.NewReader(data)
+	scratch := make([]byte, 8)
+	maj, fields, err := cbg.CborReadHeaderBuf(r, scratch)
+	if err != nil || maj != cbg.MajMap || fields == 0 {
+		return 0, false
+	}
+	name, err := cbg.ReadStringBuf(r, scratch)
+	if err != nil || name != "Format" {
+		return 0, false
+	}
+	maj, format, err := cbg.CborReadHeaderBuf(r, scratch)
+	if err != nil || maj != cbg.MajUnsignedInt {
+		return 0, false
+	}
+	return format, true
+}
+
+// readVersionRecord reads the version record, returning datastore.ErrNotFound
+// if there isn't one
+func (m Migrator) readVersionRecord(ctx context.Context, ds datastore.Batching) (*VersionRecord, error) {
+	data, err := ds.Get(ctx, m.versioningKey())
+	if err != nil {
+		return nil, err
+	}
+	return decodeVersionRecord(data)
+}
+
+func (m Migrator) writeVersionRecord(ctx context.Context, ds datastore.Batching, record VersionRecord) error {
+	record.Format = versionRecordFormat
+	record.WrittenBy = m.cfg.CodeVersion
+	data, err := cborutil.Dump(&record)
+	if err != nil {
+		return err
+	}
+	return ds.Put(ctx, m.versioningKey(), data)
+}
+
+// movedTo updates a version record for the database having moved to a version
+// whose records have the given schema, keeping the rest of what it records
+func (m Migrator) movedTo(record VersionRecord, migrations versioning.VersionedMigrationList, version versioning.VersionKey, schema string) VersionRecord {
+	record.Version = string(version)
+	record.MinReaderVersion = m.minReaderVersion(migrations, version)
+	record.SchemaFingerprint = schema
+	record.InProgress = false
+	record.TargetVersion = ""
+	return record
+}
+
+// ReadVersion returns the current version of the data in a datastore,
+// reading either the version record or the legacy version string
+func ReadVersion(ctx context.Context, ds datastore.Batching, opts ...versioning.Option) (versioning.VersionKey, error) {
+	return NewMigrator(opts...).ReadVersion(ctx, ds)
+}
+
+// ReadVersion returns the current version of the data in a datastore, from the
+// versions namespace the migrator uses
+func (m Migrator) ReadVersion(ctx context.Context, ds datastore.Batching) (versioning.VersionKey, error) {
+	record, err := m.readVersionRecord(ctx, ds)
+	if err != nil {
+		return versioning.VersionKey(""), err
+	}
+	return versioning.VersionKey(record.Version), nil
+}
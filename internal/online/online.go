@@ -0,0 +1,550 @@
+// Package online provides a datastore layer that stays usable while a version
+// step runs, writing to both versions until the step is done
+package online
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/atomic"
+	"go.uber.org/multierr"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// migrateRecordFunc migrates a single record in the direction a step runs
+type migrateRecordFunc func(ctx context.Context, fromDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error)
+
+// step is a version step whose records are being copied while the store stays usable
+type step struct {
+	from          datastore.Batching
+	to            datastore.Batching
+	migrateRecord migrateRecordFunc
+	// migrateBack migrates a record written to the version the step migrates to
+	// back to the version it migrates from, so the write survives if the step fails
+	migrateBack migrateRecordFunc
+	// written is every key written to the version the step migrates to, by the
+	// copy or by writes made while it runs
+	written map[datastore.Key]struct{}
+}
+
+// Datastore reads and writes the records at the target version. While the
+// version step into the target version runs, if it can migrate records one at a
+// time both ways, writes go to the target version as they are, and also back to
+// the version the step migrates from, migrated with the reverse of the step's
+// migration. Reads are served from the target version, and records it doesn't
+// have yet are read from the version the step migrates from and migrated
+// forward. Between steps, and during earlier steps or steps that can't migrate
+// records one at a time both ways, operations wait
+type Datastore struct {
+	target datastore.Batching
+	// targetVersion is the version migrations are running to
+	targetVersion versioning.VersionKey
+
+	// lk is held for writing by the migration between steps, so operations wait
+	lk       sync.RWMutex
+	step     *step
+	frozen   bool
+	stepping atomic.Bool
+}
+
+// NewDatastore returns a datastore over target, the records at the target
+// version, which may be wrapped to maintain indexes
+func NewDatastore(target datastore.Batching) *Datastore {
+	return &Datastore{target: target}
+}
+
+// RunMigrations returns a function to run migrations that copies the records
+// for each version step through this datastore, so it stays usable
+func (d *Datastore) RunMigrations(m migrate.Migrator) runner.RunMigrationsFunc {
+	m = m.WithStepRunner(d.runStep)
+	return func(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (versioning.VersionKey, error) {
+		d.targetVersion = target
+		final, err := m.To(ctx, ds, migrations, target)
+		d.end()
+		return final, err
+	}
+}
+
+// MigrationState reports the store ready while a version step is being copied,
+// as well as once migrations are done
+func (d *Datastore) MigrationState(r *runner.Runner) versioning.MigrationState {
+	return &migrationState{r, d}
+}
+
+type migrationState struct {
+	*runner.Runner
+	d *Datastore
+}
+
+func (ms *migrationState) ReadyError() error {
+	if ms.d.stepping.Load() {
+		return nil
+	}
+	return ms.Runner.ReadyError()
+}
+
+func (ms *migrationState) WaitReady(ctx context.Context) error {
+	if ms.d.stepping.Load() {
+		return nil
+	}
+	return ms.Runner.WaitReady(ctx)
+}
+
+// runStep copies the records for the step into the target version while writes
+// go to both versions, or runs the step with the datastore frozen if it's an
+// earlier step, or its records can't be migrated one at a time both ways
+func (d *Datastore) runStep(ctx context.Context, ds datastore.Batching, migration versioning.VersionedMigration, up bool) ([]datastore.Key, error) {
+	from, to := migration.OldVersion(), migration.NewVersion()
+	if !up {
+		from, to = to, from
+	}
+	migrateRecord, ok := recordMigrator(migration, up)
+	// records written during the step are in the target version's format, and
+	// must be kept at the version it migrates from in case the step fails
+	migrateBack, reversible := recordMigrator(migration, !up)
+	if !ok || !reversible || to != d.targetVersion || migration.OldVersion() == versioning.VersionKey("") {
+		d.freeze()
+		d.stepping.Store(false)
+		return migrate.RunStep(ctx, ds, migration, up)
+	}
+	s := &step{
+		from:          namespace.Wrap(ds, datastore.NewKey(string(from))),
+		to:            namespace.Wrap(ds, datastore.NewKey(string(to))),
+		migrateRecord: migrateRecord,
+		migrateBack:   migrateBack,
+		written:       make(map[datastore.Key]struct{}),
+	}
+	d.begin(s)
+	err := d.copyRecords(ctx, s)
+	d.freeze()
+	keys := make([]datastore.Key, 0, len(s.written))
+	for key := range s.written {
+		keys = append(keys, key)
+	}
+	return keys, err
+}
+
+func recordMigrator(migration versioning.VersionedMigration, up bool) (migrateRecordFunc, bool) {
+	if up {
+		recordMigration, ok := versioning.MigrationAs[versioning.RecordMigration](migration)
+		if !ok {
+			return nil, false
+		}
+		return recordMigration.MigrateRecord, true
+	}
+	if _, ok := migration.(versioning.ReversibleVersionedMigration); ok {
+		recordMigration, ok := migration.(versioning.ReversibleRecordMigration)
+		if !ok {
+			return nil, false
+		}
+		return recordMigration.MigrateRecordDown, true
+	}
+	if compatible, ok := migration.(versioning.DataCompatibleMigration); ok && compatible.DataCompatible() {
+		return func(_ context.Context, _ datastore.Read, _ datastore.Key, value []byte) ([]byte, bool, error) {
+			return value, true, nil
+		}, true
+	}
+	return nil, false
+}
+
+// begin starts serving the records through a step
+func (d *Datastore) begin(s *step) {
+	if !d.frozen {
+		d.lk.Lock()
+	}
+	d.step = s
+	d.frozen = false
+	d.stepping.Store(true)
+	d.lk.Unlock()
+}
+
+// freeze makes operations wait until the next step begins or migrations end
+func (d *Datastore) freeze() {
+	if d.frozen {
+		return
+	}
+	d.lk.Lock()
+	d.frozen = true
+}
+
+// end goes back to serving the target version, once migrations are done
+func (d *Datastore) end() {
+	if !d.frozen {
+		d.lk.Lock()
+	}
+	d.step = nil
+	d.frozen = false
+	d.stepping.Store(false)
+	d.lk.Unlock()
+}
+
+// copyRecords migrates every record for a step that hasn't been written since it began
+func (d *Datastore) copyRecords(ctx context.Context, s *step) error {
+	qres, err := s.from.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := qres.Rest()
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, entry := range entries {
+		select {
+		case <-ctx.Done():
+			return versioning.ErrContextCancelled
+		default:
+		}
+		err := d.copyRecord(ctx, s, datastore.NewKey(entry.Key))
+		if me, ok := err.(migrationError); ok {
+			errs = multierr.Append(errs, me.error)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return errs
+}
+
+func (d *Datastore) copyRecord(ctx context.Context, s *step, key datastore.Key) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	// records written since the step began are already at the new version
+	if _, ok := s.written[key]; ok {
+		return nil
+	}
+	value, err := s.from.Get(ctx, key)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	has, err := s.to.Has(ctx, key)
+	if err != nil {
+		return err
+	}
+	if has {
+		return migrationError{fmt.Errorf("already tracking state in new db for '%s'", key)}
+	}
+	migrated, selected, err := s.migrateRecord(ctx, s.from, key, value)
+	if err != nil {
+		return migrationError{err}
+	}
+	if !selected {
+		return nil
+	}
+	if err := s.to.Put(ctx, key, migrated); err != nil {
+		return err
+	}
+	s.written[key] = struct{}{}
+	return nil
+}
+
+// migrationError is an error migrating a single record, which doesn't stop the
+// rest from being copied
+type migrationError struct {
+	error
+}
+
+// write writes a record to both versions during a step
+func (d *Datastore) write(ctx context.Context, s *step, key datastore.Key, value []byte) error {
+	migrated, selected, err := s.migrateBack(ctx, s.to, key, value)
+	if err != nil {
+		return err
+	}
+	if err := s.to.Put(ctx, key, value); err != nil {
+		return err
+	}
+	s.written[key] = struct{}{}
+	if !selected {
+		return s.from.Delete(ctx, key)
+	}
+	return s.from.Put(ctx, key, migrated)
+}
+
+// delete deletes a record from both versions during a step
+func (d *Datastore) delete(ctx context.Context, s *step, key datastore.Key) error {
+	if err := s.to.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.written[key] = struct{}{}
+	return s.from.Delete(ctx, key)
+}
+
+// get reads a record during a step, from the version the step migrates to, or
+// else from the version it migrates from, migrated forward
+func (d *Datastore) get(ctx context.Context, s *step, key datastore.Key) ([]byte, error) {
+	value, err := s.to.Get(ctx, key)
+	if err != datastore.ErrNotFound {
+		return value, err
+	}
+	if _, ok := s.written[key]; ok {
+		return nil, datastore.ErrNotFound
+	}
+	value, err = s.from.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	migrated, selected, err := s.migrateRecord(ctx, s.from, key, value)
+	if err != nil {
+		return nil, err
+	}
+	if !selected {
+		return nil, datastore.ErrNotFound
+	}
+	return migrated, nil
+}
+
+// query reads the records during a step, merging the records the version the
+// step migrates to doesn't have yet from the version it migrates from
+func (d *Datastore) query(ctx context.Context, s *step, q query.Query) (query.Results, error) {
+	entries, err := queryAll(ctx, s.to, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		seen[entry.Key] = struct{}{}
+	}
+	oldEntries, err := queryAll(ctx, s.from, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range oldEntries {
+		if _, ok := seen[entry.Key]; ok {
+			continue
+		}
+		key := datastore.NewKey(entry.Key)
+		if _, ok := s.written[key]; ok {
+			continue
+		}
+		migrated, selected, err := s.migrateRecord(ctx, s.from, key, entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		if selected {
+			entries = append(entries, query.Entry{Key: entry.Key, Value: migrated, Size: len(migrated)})
+		}
+	}
+	if q.KeysOnly {
+		for i := range entries {
+			entries[i].Value = nil
+		}
+	}
+	return query.NaiveQueryApply(q, query.ResultsWithEntries(q, entries)), nil
+}
+
+func queryAll(ctx context.Context, ds datastore.Read, prefix string) ([]query.Entry, error) {
+	qres, err := ds.Query(ctx, query.Query{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := qres.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Size = len(entries[i].Value)
+	}
+	return entries, nil
+}
+
+func (d *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if d.step == nil {
+		return d.target.Get(ctx, key)
+	}
+	return d.get(ctx, d.step, key)
+}
+
+func (d *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if d.step == nil {
+		return d.target.Has(ctx, key)
+	}
+	_, err = d.get(ctx, d.step, key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Datastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if d.step == nil {
+		return d.target.GetSize(ctx, key)
+	}
+	value, err := d.get(ctx, d.step, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if d.step == nil {
+		return d.target.Query(ctx, q)
+	}
+	// read the results while the records can't move to the next version
+	return d.query(ctx, d.step, q)
+}
+
+func (d *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.step == nil {
+		return d.target.Put(ctx, key, value)
+	}
+	return d.write(ctx, d.step, key, value)
+}
+
+func (d *Datastore) Delete(ctx context.Context, key datastore.Key) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.step == nil {
+		return d.target.Delete(ctx, key)
+	}
+	return d.delete(ctx, d.step, key)
+}
+
+func (d *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if d.step == nil {
+		return d.target.Sync(ctx, prefix)
+	}
+	if err := d.step.from.Sync(ctx, prefix); err != nil {
+		return err
+	}
+	return d.step.to.Sync(ctx, prefix)
+}
+
+func (d *Datastore) Close() error {
+	return d.target.Close()
+}
+
+func (d *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return &onlineBatch{d: d}, nil
+}
+
+var _ datastore.Batching = &Datastore{}
+
+// GetIndexEntry returns the value of a single entry in an index of the target
+// version. Indexes can't be read while a step runs
+func (d *Datastore) GetIndexEntry(ctx context.Context, index string, key datastore.Key) ([]byte, error) {
+	indexed, err := d.indexed(index)
+	if err != nil {
+		return nil, err
+	}
+	return indexed.GetIndexEntry(ctx, index, key)
+}
+
+// QueryIndex runs a query over the entries of an index of the target version.
+// Indexes can't be read while a step runs
+func (d *Datastore) QueryIndex(ctx context.Context, index string, q query.Query) (query.Results, error) {
+	indexed, err := d.indexed(index)
+	if err != nil {
+		return nil, err
+	}
+	return indexed.QueryIndex(ctx, index, q)
+}
+
+func (d *Datastore) indexed(index string) (versioning.IndexQuerier, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	if d.step != nil {
+		return nil, fmt.Errorf("index %q can't be read while the datastore is being migrated", index)
+	}
+	indexed, ok := d.target.(versioning.IndexQuerier)
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", index)
+	}
+	return indexed, nil
+}
+
+var _ versioning.IndexQuerier = &Datastore{}
+
+type batchOp struct {
+	key    datastore.Key
+	value  []byte
+	delete bool
+}
+
+// onlineBatch holds writes until it's committed, when they go to whichever
+// versions are being written then
+type onlineBatch struct {
+	d   *Datastore
+	ops []batchOp
+}
+
+func (ob *onlineBatch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	ob.ops = append(ob.ops, batchOp{key: key, value: value})
+	return nil
+}
+
+func (ob *onlineBatch) Delete(ctx context.Context, key datastore.Key) error {
+	ob.ops = append(ob.ops, batchOp{key: key, delete: true})
+	return nil
+}
+
+func (ob *onlineBatch) Commit(ctx context.Context) error {
+	ob.d.lk.Lock()
+	defer ob.d.lk.Unlock()
+	if ob.d.step == nil {
+		return commitOps(ctx, ob.d.target, ob.ops)
+	}
+	s := ob.d.step
+	// migrate every record back before writing any, so a record that fails
+	// leaves both versions untouched
+	fromOps := make([]batchOp, 0, len(ob.ops))
+	for _, op := range ob.ops {
+		if op.delete {
+			fromOps = append(fromOps, op)
+			continue
+		}
+		migrated, selected, err := s.migrateBack(ctx, s.to, op.key, op.value)
+		if err != nil {
+			return err
+		}
+		fromOps = append(fromOps, batchOp{key: op.key, value: migrated, delete: !selected})
+	}
+	if err := commitOps(ctx, s.to, ob.ops); err != nil {
+		return err
+	}
+	for _, op := range ob.ops {
+		s.written[op.key] = struct{}{}
+	}
+	return commitOps(ctx, s.from, fromOps)
+}
+
+func commitOps(ctx context.Context, ds datastore.Batching, ops []batchOp) error {
+	batch, err := ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.delete {
+			err = batch.Delete(ctx, op.key)
+		} else {
+			err = batch.Put(ctx, op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(ctx)
+}
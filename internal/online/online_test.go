@@ -0,0 +1,343 @@
+package online_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/online"
+	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+func TestDatastore(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		if *c < 0 {
+			return nil, errors.New("negative count")
+		}
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	subMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		if *c < 7 {
+			return nil, errors.New("count too low")
+		}
+		newCount := *c - 7
+		return &newCount, nil
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "1"),
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1").Reversible(subMigration),
+	}.Build()
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		inputDatabase          map[string][]byte
+		target                 versioning.VersionKey
+		copyPrefix             string
+		duringStep             func(t *testing.T, ds datastore.Batching)
+		expectedErr            error
+		expectedOutputDatabase map[string][]byte
+	}{
+		"writes during the copy go to both versions": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+				"/1/oranges":        numData(t, 3),
+				"/1/pears":          numData(t, 1),
+			},
+			target:     "2",
+			copyPrefix: "/1",
+			duringStep: func(t *testing.T, ds datastore.Batching) {
+				value, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 14), value)
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/oranges"), numData(t, 10)))
+				value, err = ds.Get(ctx, datastore.NewKey("/oranges"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 10), value)
+				require.NoError(t, ds.Delete(ctx, datastore.NewKey("/pears")))
+				has, err := ds.Has(ctx, datastore.NewKey("/pears"))
+				require.NoError(t, err)
+				require.False(t, has)
+				batch, err := ds.Batch(ctx)
+				require.NoError(t, err)
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/plums"), numData(t, 9)))
+				require.NoError(t, batch.Commit(ctx))
+				results, err := ds.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+				require.NoError(t, err)
+				entries, err := results.Rest()
+				require.NoError(t, err)
+				require.Len(t, entries, 3)
+				require.Equal(t, "/apples", entries[0].Key)
+				require.Equal(t, numData(t, 14), entries[0].Value)
+				require.Equal(t, "/oranges", entries[1].Key)
+				require.Equal(t, numData(t, 10), entries[1].Value)
+				require.Equal(t, "/plums", entries[2].Key)
+				require.Equal(t, numData(t, 9), entries[2].Value)
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+				"/2/oranges":        numData(t, 10),
+				"/2/plums":          numData(t, 9),
+			},
+		},
+		"writes the migration can't migrate back fail": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+			target:     "2",
+			copyPrefix: "/1",
+			duringStep: func(t *testing.T, ds datastore.Batching) {
+				err := ds.Put(ctx, datastore.NewKey("/apples"), numData(t, 3))
+				require.EqualError(t, err, "attempting to transform to new state '/apples': count too low")
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+			},
+		},
+		"failed steps keep writes at the previous version": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, -1),
+				"/1/oranges":        numData(t, 3),
+			},
+			target:     "2",
+			copyPrefix: "/1",
+			duringStep: func(t *testing.T, ds datastore.Batching) {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/oranges"), numData(t, 17)))
+			},
+			expectedErr: errors.New("running up migration: attempting to transform to new state '/apples': negative count"),
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, -1),
+				"/1/oranges":        numData(t, 10),
+			},
+		},
+		"writes flow back when migrating down": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+			},
+			target:     "1",
+			copyPrefix: "/2",
+			duringStep: func(t *testing.T, ds datastore.Batching) {
+				value, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 7), value)
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/oranges"), numData(t, 3)))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+				"/1/oranges":        numData(t, 3),
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := newBlockingDatastore(data.copyPrefix)
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			onlineDs := online.NewDatastore(namespace.Wrap(ds, datastore.NewKey(string(data.target))))
+			r := runner.NewRunner(ds, migrations, data.target, onlineDs.RunMigrations(migrate.NewMigrator()))
+			ms := onlineDs.MigrationState(r)
+			require.EqualError(t, ms.ReadyError(), versioning.ErrMigrationsNotRun.Error())
+
+			migrated := make(chan error, 1)
+			go func() {
+				migrated <- r.Migrate(ctx)
+			}()
+			<-ds.copying
+			require.NoError(t, ms.ReadyError())
+			data.duringStep(t, onlineDs)
+			close(ds.release)
+
+			err := <-migrated
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+				require.NoError(t, ms.ReadyError())
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+				require.Error(t, ms.ReadyError())
+			}
+
+			require.Equal(t, data.expectedOutputDatabase, dump(t, ds.MapDatastore))
+		})
+	}
+}
+
+func TestDatastoreEarlierSteps(t *testing.T) {
+	ctx := context.Background()
+	shift := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c*10 + 1
+		return &newCount, nil
+	}
+	unshift := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		oldCount := (*c - 1) / 10
+		return &oldCount, nil
+	}
+	migrating := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	blockingShift := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		once.Do(func() {
+			close(migrating)
+			<-release
+		})
+		return shift(c)
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(shift, "1"),
+		versioned.NewVersionedBuilder(blockingShift, "2").OldVersion("1").Reversible(unshift),
+		versioned.NewVersionedBuilder(shift, "3").OldVersion("2").Reversible(unshift),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := newBlockingDatastore("/2")
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 1)))
+	onlineDs := online.NewDatastore(namespace.Wrap(ds, datastore.NewKey("/3")))
+	r := runner.NewRunner(ds, migrations, "3", onlineDs.RunMigrations(migrate.NewMigrator()))
+	ms := onlineDs.MigrationState(r)
+
+	migrated := make(chan error, 1)
+	go func() {
+		migrated <- r.Migrate(ctx)
+	}()
+	// the step from 1 to 2 runs with the store not ready, and only the step into
+	// the target version is copied while the store is usable
+	<-migrating
+	require.EqualError(t, ms.ReadyError(), versioning.ErrMigrationsNotRun.Error())
+	close(release)
+	<-ds.copying
+	require.NoError(t, ms.ReadyError())
+	value, err := onlineDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	require.Equal(t, numData(t, 111), value)
+	require.NoError(t, onlineDs.Put(ctx, datastore.NewKey("/oranges"), numData(t, 221)))
+	close(ds.release)
+	require.NoError(t, <-migrated)
+
+	require.Equal(t, map[string][]byte{
+		"/versions/current": versionData("3"),
+		"/3/apples":         numData(t, 111),
+		"/3/oranges":        numData(t, 221),
+	}, dump(t, ds.MapDatastore))
+}
+
+func TestDatastoreIrreversibleStep(t *testing.T) {
+	ctx := context.Background()
+	migrating := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		once.Do(func() {
+			close(migrating)
+			<-release
+		})
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "1"),
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/versions/current"), versionData("1")))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/1/apples"), numData(t, 7)))
+	onlineDs := online.NewDatastore(namespace.Wrap(ds, datastore.NewKey("/2")))
+	r := runner.NewRunner(ds, migrations, "2", onlineDs.RunMigrations(migrate.NewMigrator()))
+	ms := onlineDs.MigrationState(r)
+
+	migrated := make(chan error, 1)
+	go func() {
+		migrated <- r.Migrate(ctx)
+	}()
+	// writes couldn't be kept at version 1 if the step failed, so the store isn't
+	// usable while it runs
+	<-migrating
+	require.EqualError(t, ms.ReadyError(), versioning.ErrMigrationsNotRun.Error())
+	close(release)
+	require.NoError(t, <-migrated)
+
+	require.Equal(t, map[string][]byte{
+		"/versions/current": versionData("2"),
+		"/2/apples":         numData(t, 14),
+	}, dump(t, ds))
+}
+
+// blockingDatastore holds up the query that lists the records a step copies,
+// so writes can be made while the step runs
+type blockingDatastore struct {
+	*datastore.MapDatastore
+	prefix  string
+	copying chan struct{}
+	release chan struct{}
+}
+
+func newBlockingDatastore(prefix string) *blockingDatastore {
+	return &blockingDatastore{datastore.NewMapDatastore(), prefix, make(chan struct{}), make(chan struct{})}
+}
+
+func (bd *blockingDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	if q.Prefix == bd.prefix && q.KeysOnly {
+		close(bd.copying)
+		<-bd.release
+	}
+	return bd.MapDatastore.Query(ctx, q)
+}
+
+func (bd *blockingDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return datastore.NewBasicBatch(bd), nil
+}
+
+func dump(t *testing.T, ds datastore.Read) map[string][]byte {
+	res, err := ds.Query(context.Background(), query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	outputDatabase := make(map[string][]byte)
+	for _, entry := range entries {
+		outputDatabase[entry.Key] = entry.Value
+	}
+	return outputDatabase
+}
+
+func versionData(versionKey versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(versionKey),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func numData(t *testing.T, num int64) []byte {
+	buf := new(bytes.Buffer)
+	value := cbg.CborInt(num)
+	require.NoError(t, value.MarshalCBOR(buf))
+	return buf.Bytes()
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ipfs/go-datastore"
-	"go.uber.org/atomic"
 
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 )
@@ -14,56 +14,228 @@ import (
 // RunMigrationsFunc is a function that runs migrations
 type RunMigrationsFunc func(ctx context.Context, ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (versioning.VersionKey, error)
 
-// Runner executes a migrations exactly once
-// and can queried for status of that migration and any migration errors
+type runState int
+
+const (
+	stateNotRun runState = iota
+	stateRunning
+	stateReady
+	stateFailed
+	stateCancelled
+)
+
+// run tracks a single call to execute migrations, including any automatic retries
+type run struct {
+	done chan struct{}
+	err  error
+}
+
+// Runner executes migrations, never more than one at a time,
+// and can queried for status of that migration and any migration errors.
+// Once migrations succeed they are never run again, but failed migrations
+// can be retried
 type Runner struct {
-	doMigration    sync.Once
-	migrationsDone chan struct{}
-	migrationError atomic.Error
-	migrations     versioning.VersionedMigrationList
-	target         versioning.VersionKey
-	ready          atomic.Bool
-	ds             datastore.Batching
-	runMigrations  RunMigrationsFunc
+	lk             sync.Mutex
+	state          runState
+	migrationError error
+	current        *run
+	active         bool
+	cancel         context.CancelFunc
+	changed        chan struct{}
+	retryNow       chan struct{}
+
+	migrations    versioning.VersionedMigrationList
+	target        versioning.VersionKey
+	ds            datastore.Batching
+	runMigrations RunMigrationsFunc
+	retryPolicy   versioning.RetryPolicy
 }
 
 // NewRunner returns a new runner instance for the given datastore, migrations, and target
-func NewRunner(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey, runMigrations RunMigrationsFunc) *Runner {
+func NewRunner(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey, runMigrations RunMigrationsFunc, opts ...versioning.Option) *Runner {
+	cfg := versioning.NewConfig(opts...)
 	return &Runner{
-		ds:             ds,
-		migrations:     migrations,
-		target:         target,
-		runMigrations:  runMigrations,
-		migrationsDone: make(chan struct{}),
+		ds:            ds,
+		migrations:    migrations,
+		target:        target,
+		runMigrations: runMigrations,
+		retryPolicy:   cfg.RetryPolicy,
+		changed:       make(chan struct{}),
+		retryNow:      make(chan struct{}, 1),
 	}
 }
 
 // Migrate executes the migration, if it has not already been executed
 func (m *Runner) Migrate(ctx context.Context) error {
-	go func() {
-		m.doMigration.Do(func() {
-			_, err := m.runMigrations(ctx, m.ds, m.migrations, m.target)
-			m.migrationError.Store(err)
-			m.ready.Store(true)
-			close(m.migrationsDone)
-		})
-	}()
+	m.lk.Lock()
+	if m.state == stateNotRun {
+		m.startLocked(ctx)
+	}
+	current := m.current
+	m.lk.Unlock()
+	return m.wait(ctx, current)
+}
+
+// Retry executes the migration again if the last attempt failed. If a
+// migration is already running, it waits for it rather than starting another,
+// and if one is waiting to be retried automatically, it starts it immediately
+func (m *Runner) Retry(ctx context.Context) error {
+	m.lk.Lock()
+	if m.active {
+		select {
+		case m.retryNow <- struct{}{}:
+		default:
+		}
+	} else if m.state != stateReady {
+		m.startLocked(ctx)
+	}
+	current := m.current
+	m.lk.Unlock()
+	return m.wait(ctx, current)
+}
+
+func (m *Runner) wait(ctx context.Context, current *run) error {
+	select {
+	case <-current.done:
+	case <-ctx.Done():
+		return versioning.ErrContextCancelled
+	}
+	return current.err
+}
+
+// Cancel stops a running migration, and waits for it to roll back the partially
+// migrated version step. Afterward, the runner reports ErrMigrationsCancelled
+// until migrations are retried
+func (m *Runner) Cancel(ctx context.Context) error {
+	m.lk.Lock()
+	if !m.active {
+		m.lk.Unlock()
+		return nil
+	}
+	m.cancel()
+	current := m.current
+	m.lk.Unlock()
 	select {
-	case <-m.migrationsDone:
+	case <-current.done:
+		return nil
 	case <-ctx.Done():
 		return versioning.ErrContextCancelled
 	}
-	return m.migrationError.Load()
+}
+
+func (m *Runner) startLocked(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	m.current = &run{done: make(chan struct{})}
+	m.active = true
+	m.cancel = cancel
+	m.setStateLocked(stateRunning)
+	go m.execute(ctx, m.current)
+}
+
+func (m *Runner) execute(ctx context.Context, current *run) {
+	for attempt := 1; ; attempt++ {
+		_, err := m.runMigrations(ctx, m.ds, m.migrations, m.target)
+
+		m.lk.Lock()
+		m.migrationError = err
+		if err == nil {
+			m.finishLocked(current, stateReady)
+			m.lk.Unlock()
+			return
+		}
+		if ctx.Err() != nil {
+			m.finishLocked(current, stateCancelled)
+			m.lk.Unlock()
+			return
+		}
+		var delay time.Duration
+		retry := false
+		if m.retryPolicy != nil {
+			delay, retry = m.retryPolicy(attempt, err)
+		}
+		if !retry {
+			m.finishLocked(current, stateFailed)
+			m.lk.Unlock()
+			return
+		}
+		// clear any retry requested while we were running, since we're about to retry anyway
+		select {
+		case <-m.retryNow:
+		default:
+		}
+		m.setStateLocked(stateFailed)
+		m.lk.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-m.retryNow:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+
+		m.lk.Lock()
+		if ctx.Err() != nil {
+			m.finishLocked(current, stateCancelled)
+			m.lk.Unlock()
+			return
+		}
+		m.setStateLocked(stateRunning)
+		m.lk.Unlock()
+	}
+}
+
+func (m *Runner) finishLocked(current *run, state runState) {
+	if state == stateCancelled {
+		m.migrationError = versioning.ErrMigrationsCancelled
+	}
+	current.err = m.migrationError
+	m.active = false
+	m.cancel()
+	m.setStateLocked(state)
+	close(current.done)
+}
+
+func (m *Runner) setStateLocked(state runState) {
+	m.state = state
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// WaitReady blocks until the migration finishes or the context expires,
+// then returns the ready state of the migration. If a failed migration
+// will be retried automatically, it keeps waiting for the retry
+func (m *Runner) WaitReady(ctx context.Context) error {
+	for {
+		m.lk.Lock()
+		settled := m.state == stateReady || ((m.state == stateFailed || m.state == stateCancelled) && !m.active)
+		changed := m.changed
+		m.lk.Unlock()
+		if settled {
+			break
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return m.ReadyError()
+		}
+	}
+	return m.ReadyError()
 }
 
 // ReadyError returns the ready state of the migration -
 // either nil for ready or err for not ready or a migration error
 func (m *Runner) ReadyError() error {
-	if err := m.migrationError.Load(); err != nil {
-		return fmt.Errorf("Error migrating database: %w", err)
-	}
-	if m.ready.Load() {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	switch m.state {
+	case stateReady:
 		return nil
+	case stateFailed:
+		return fmt.Errorf("Error migrating database: %w", m.migrationError)
+	case stateCancelled:
+		return versioning.ErrMigrationsCancelled
+	default:
+		return versioning.ErrMigrationsNotRun
 	}
-	return versioning.ErrMigrationsNotRun
 }
@@ -145,3 +145,160 @@ func TestMigrate(t *testing.T) {
 		})
 	}
 }
+
+func TestWaitReady(t *testing.T) {
+	ctx := context.Background()
+	blocker := make(chan struct{})
+	runMigrations := func(context.Context, datastore.Batching, versioning.VersionedMigrationList, versioning.VersionKey) (versioning.VersionKey, error) {
+		<-blocker
+		return versioning.VersionKey("3"), nil
+	}
+	r := runner.NewRunner(datastore.NewMapDatastore(), nil, "3", runMigrations)
+
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, r.WaitReady(shortCtx), versioning.ErrMigrationsNotRun.Error())
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- r.WaitReady(ctx)
+	}()
+	go func() {
+		_ = r.Migrate(ctx)
+	}()
+	close(blocker)
+	select {
+	case err := <-waitErr:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WaitReady did not return after migrations finished")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	testCases := map[string]struct {
+		failures      uint64
+		opts          []versioning.Option
+		retry         bool
+		expectedErr   error
+		expectedReady error
+		expectedRuns  uint64
+	}{
+		"failed migrations are not re-run by migrate": {
+			failures:      1,
+			expectedErr:   errors.New("something went wrong"),
+			expectedReady: errors.New("Error migrating database: something went wrong"),
+			expectedRuns:  1,
+		},
+		"explicit retry after failure": {
+			failures:     1,
+			retry:        true,
+			expectedRuns: 2,
+		},
+		"explicit retry after success does nothing": {
+			retry:        true,
+			expectedRuns: 1,
+		},
+		"automatic retry": {
+			failures:     3,
+			opts:         []versioning.Option{versioning.RetryMigrations(versioning.ExponentialBackoff(time.Millisecond, 5*time.Millisecond, 0))},
+			expectedRuns: 4,
+		},
+		"automatic retry gives up": {
+			failures:      5,
+			opts:          []versioning.Option{versioning.RetryMigrations(versioning.ExponentialBackoff(time.Millisecond, 5*time.Millisecond, 3))},
+			expectedErr:   errors.New("something went wrong"),
+			expectedReady: errors.New("Error migrating database: something went wrong"),
+			expectedRuns:  3,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			runs := atomic.NewUint64(0)
+			running := atomic.NewBool(false)
+			runMigrations := func(context.Context, datastore.Batching, versioning.VersionedMigrationList, versioning.VersionKey) (versioning.VersionKey, error) {
+				if !running.CAS(false, true) {
+					t.Error("migrations run concurrently")
+				}
+				defer running.Store(false)
+				time.Sleep(time.Millisecond)
+				if runs.Inc() <= data.failures {
+					return versioning.VersionKey(""), errors.New("something went wrong")
+				}
+				return versioning.VersionKey("3"), nil
+			}
+			r := runner.NewRunner(datastore.NewMapDatastore(), nil, "3", runMigrations, data.opts...)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					_ = r.Migrate(ctx)
+					wg.Done()
+				}()
+			}
+			wg.Wait()
+			var err error
+			if data.retry {
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						_ = r.Retry(ctx)
+						wg.Done()
+					}()
+				}
+				wg.Wait()
+				err = r.Retry(ctx)
+			} else {
+				err = r.Migrate(ctx)
+			}
+			if data.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, data.expectedErr.Error())
+			}
+			if data.expectedReady == nil {
+				assert.NoError(t, r.ReadyError())
+			} else {
+				assert.EqualError(t, r.ReadyError(), data.expectedReady.Error())
+			}
+			assert.Equal(t, data.expectedRuns, runs.Load())
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	started := make(chan struct{}, 1)
+	runs := atomic.NewUint64(0)
+	runMigrations := func(ctx context.Context, _ datastore.Batching, _ versioning.VersionedMigrationList, _ versioning.VersionKey) (versioning.VersionKey, error) {
+		if runs.Inc() > 1 {
+			return versioning.VersionKey("3"), nil
+		}
+		started <- struct{}{}
+		<-ctx.Done()
+		return versioning.VersionKey(""), versioning.ErrContextCancelled
+	}
+	r := runner.NewRunner(datastore.NewMapDatastore(), nil, "3", runMigrations)
+
+	// nothing to cancel yet
+	assert.NoError(t, r.Cancel(ctx))
+
+	migrateErr := make(chan error, 1)
+	go func() {
+		migrateErr <- r.Migrate(ctx)
+	}()
+	<-started
+	assert.EqualError(t, r.ReadyError(), versioning.ErrMigrationsNotRun.Error())
+	assert.NoError(t, r.Cancel(ctx))
+	assert.EqualError(t, <-migrateErr, versioning.ErrMigrationsCancelled.Error())
+	assert.EqualError(t, r.ReadyError(), versioning.ErrMigrationsCancelled.Error())
+	assert.EqualError(t, r.Migrate(ctx), versioning.ErrMigrationsCancelled.Error())
+
+	assert.NoError(t, r.Retry(ctx))
+	assert.NoError(t, r.ReadyError())
+	assert.Equal(t, uint64(2), runs.Load())
+}
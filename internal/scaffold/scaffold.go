@@ -0,0 +1,429 @@
+// Package scaffold generates the boilerplate for migrating records from one
+// cbor-gen struct to another: a frozen copy of the old struct with its cbor-gen
+// methods, a stub migration function, and a versioned builder for it
+package scaffold
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+const (
+	versioningPath = "github.com/filecoin-project/go-ds-versioning/pkg"
+	versionedPath  = "github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+// Config describes the migration to scaffold
+type Config struct {
+	// Dir is the directory of the package with both struct types
+	Dir string
+	// OldType is the struct records are migrated from
+	OldType string
+	// NewType is the struct records are migrated to
+	NewType string
+	// FrozenType is the name for the frozen copy of OldType. If empty, it is
+	// OldType with the old version appended
+	FrozenType string
+	// OldVersion is the version records are migrated from
+	OldVersion versioning.VersionKey
+	// NewVersion is the version records are migrated to
+	NewVersion versioning.VersionKey
+}
+
+func (cfg Config) frozenType() string {
+	if cfg.FrozenType != "" {
+		return cfg.FrozenType
+	}
+	return cfg.OldType + "V" + identifier(string(cfg.OldVersion))
+}
+
+// Generate returns the source of a file, in the same package as the two types,
+// that holds the frozen copy of the old type, the migration function stub, and
+// the versioned builder for the migration
+func Generate(cfg Config) ([]byte, error) {
+	if cfg.OldType == "" || cfg.NewType == "" {
+		return nil, errors.New("both an old and a new type are required")
+	}
+	if cfg.NewVersion == "" {
+		return nil, errors.New("a new version is required")
+	}
+	fset := token.NewFileSet()
+	pkg, err := parsePackage(fset, cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	frozen := cfg.frozenType()
+	g := &generator{fset: fset, pkg: pkg, cfg: cfg, frozen: frozen}
+	return g.generate()
+}
+
+func parsePackage(fset *token.FileSet, dir string) (*ast.Package, error) {
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("parsing package: %w", err)
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+	for _, pkg := range pkgs {
+		return pkg, nil
+	}
+	return nil, nil
+}
+
+type generator struct {
+	fset   *token.FileSet
+	pkg    *ast.Package
+	cfg    Config
+	frozen string
+	buf    bytes.Buffer
+}
+
+func (g *generator) generate() ([]byte, error) {
+	if g.findType(g.frozen) != nil {
+		return nil, fmt.Errorf("type %s already exists", g.frozen)
+	}
+	oldSpec := g.findType(g.cfg.OldType)
+	if oldSpec == nil {
+		return nil, fmt.Errorf("type %s not found", g.cfg.OldType)
+	}
+	newSpec := g.findType(g.cfg.NewType)
+	if newSpec == nil {
+		return nil, fmt.Errorf("type %s not found", g.cfg.NewType)
+	}
+	oldStruct, ok := oldSpec.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("type %s is not a struct", g.cfg.OldType)
+	}
+	newStruct, ok := newSpec.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("type %s is not a struct", g.cfg.NewType)
+	}
+
+	// work out the migration function before renaming anything in the old type
+	migrateFunc := g.migrateFuncName()
+	stub := g.stub(migrateFunc, oldStruct, newStruct)
+
+	methods, vars, imports := g.cborGen()
+	renames := map[string]string{g.cfg.OldType: g.frozen}
+	for _, v := range vars {
+		for _, name := range v.Specs[0].(*ast.ValueSpec).Names {
+			renames[name.Name] = frozenName(name.Name, g.cfg.OldType, g.frozen)
+		}
+	}
+	frozenSpec := &ast.TypeSpec{Name: ast.NewIdent(g.frozen), Type: oldSpec.Type}
+	rename(frozenSpec, renames)
+	for _, decl := range methods {
+		rename(decl, renames)
+	}
+	for _, v := range vars {
+		rename(v, renames)
+	}
+	used := usedPackages(append([]ast.Node{frozenSpec}, nodes(methods, vars)...))
+
+	fmt.Fprintf(&g.buf, "// Scaffolded by migration-scaffold from %s and %s.\n", g.cfg.OldType, g.cfg.NewType)
+	fmt.Fprintf(&g.buf, "// Fill in the TODOs in %s, then add %s to your versioned.BuilderList.\n\n", migrateFunc, g.builderName())
+	fmt.Fprintf(&g.buf, "package %s\n\n", g.pkg.Name)
+	g.writeImports(imports, used)
+
+	fmt.Fprintf(&g.buf, "// %s is a frozen copy of %s as it was stored at version %q\n", g.frozen, g.cfg.OldType, g.cfg.OldVersion)
+	g.buf.WriteString("type ")
+	if err := g.print(frozenSpec); err != nil {
+		return nil, err
+	}
+	g.buf.WriteString("\n\n")
+	if len(methods) == 0 {
+		fmt.Fprintf(&g.buf, "// TODO: no cbor-gen methods were found for %s -- run cbor-gen for %s\n\n", g.cfg.OldType, g.frozen)
+	}
+	for _, v := range vars {
+		if err := g.print(v); err != nil {
+			return nil, err
+		}
+		g.buf.WriteString("\n\n")
+	}
+	for _, decl := range methods {
+		if err := g.print(decl); err != nil {
+			return nil, err
+		}
+		g.buf.WriteString("\n\n")
+	}
+	g.buf.WriteString(stub)
+	g.writeBuilder(migrateFunc)
+
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting output: %w", err)
+	}
+	return out, nil
+}
+
+func (g *generator) findType(name string) *ast.TypeSpec {
+	for _, file := range g.pkg.Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				if ts := spec.(*ast.TypeSpec); ts.Name.Name == name {
+					return ts
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// cborGen finds the cbor-gen methods for the old type, the package level
+// variables they use from the same file, and the imports of the package
+func (g *generator) cborGen() ([]*ast.FuncDecl, []*ast.GenDecl, map[string]string) {
+	var methods []*ast.FuncDecl
+	var vars []*ast.GenDecl
+	imports := map[string]string{}
+	for _, file := range g.pkg.Files {
+		var found []*ast.FuncDecl
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || receiverType(fn) != g.cfg.OldType {
+				continue
+			}
+			if fn.Name.Name == "MarshalCBOR" || fn.Name.Name == "UnmarshalCBOR" {
+				found = append(found, fn)
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		methods = append(methods, found...)
+		referenced := map[string]bool{}
+		for _, fn := range found {
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					referenced[id.Name] = true
+				}
+				return true
+			})
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for _, name := range vs.Names {
+					if name.Name != "_" && referenced[name.Name] {
+						vars = append(vars, &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{vs}})
+						break
+					}
+				}
+			}
+		}
+	}
+	// the methods and the struct's fields may use packages imported by any file
+	for _, file := range g.pkg.Files {
+		for _, spec := range file.Imports {
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			name := path.Base(importPath)
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			if _, ok := imports[name]; !ok {
+				imports[name] = importPath
+			}
+		}
+	}
+	return methods, vars, imports
+}
+
+func receiverType(fn *ast.FuncDecl) string {
+	expr := fn.Recv.List[0].Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if id, ok := expr.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+func (g *generator) writeImports(imports map[string]string, used map[string]bool) {
+	var std, other []string
+	for name, importPath := range imports {
+		if !used[name] {
+			continue
+		}
+		line := strconv.Quote(importPath)
+		if path.Base(importPath) != name {
+			line = name + " " + line
+		}
+		if strings.Contains(strings.Split(importPath, "/")[0], ".") {
+			other = append(other, line)
+		} else {
+			std = append(std, line)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	g.buf.WriteString("import (\n")
+	for _, group := range [][]string{std, other} {
+		for _, line := range group {
+			g.buf.WriteString("\t" + line + "\n")
+		}
+		if len(group) > 0 {
+			g.buf.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&g.buf, "\tversioning %q\n\t%q\n)\n\n", versioningPath, versionedPath)
+}
+
+func (g *generator) migrateFuncName() string {
+	return "Migrate" + g.cfg.NewType + "V" + identifier(string(g.cfg.NewVersion))
+}
+
+func (g *generator) builderName() string {
+	name := []rune(g.cfg.NewType)
+	name[0] = unicode.ToLower(name[0])
+	return string(name) + "MigrationV" + identifier(string(g.cfg.NewVersion))
+}
+
+// stub writes a migration function that copies the fields the two types share,
+// and leaves TODOs for the rest
+func (g *generator) stub(migrateFunc string, oldStruct *ast.StructType, newStruct *ast.StructType) string {
+	oldFields := map[string]string{}
+	var oldNames []string
+	for _, field := range oldStruct.Fields.List {
+		for _, name := range field.Names {
+			oldFields[name.Name] = g.typeString(field.Type)
+			oldNames = append(oldNames, name.Name)
+		}
+	}
+	var body strings.Builder
+	migrated := map[string]bool{}
+	for _, field := range newStruct.Fields.List {
+		newType := g.typeString(field.Type)
+		if len(field.Names) == 0 {
+			fmt.Fprintf(&body, "\t\t// TODO: set embedded %s\n", newType)
+			continue
+		}
+		for _, name := range field.Names {
+			oldType, ok := oldFields[name.Name]
+			switch {
+			case !ok:
+				fmt.Fprintf(&body, "\t\t// TODO: set %s, which is new\n", name.Name)
+			case oldType != newType:
+				migrated[name.Name] = true
+				fmt.Fprintf(&body, "\t\t// TODO: set %s, which was %s and is now %s\n", name.Name, oldType, newType)
+			default:
+				migrated[name.Name] = true
+				fmt.Fprintf(&body, "\t\t%s: old.%s,\n", name.Name, name.Name)
+			}
+		}
+	}
+	for _, name := range oldNames {
+		if !migrated[name] {
+			fmt.Fprintf(&body, "\t\t// TODO: old.%s is no longer stored\n", name)
+		}
+	}
+	return fmt.Sprintf(`// %s migrates a %s from version %q to a %s at version %q
+func %s(old *%s) (*%s, error) {
+	return &%s{
+%s	}, nil
+}
+
+`, migrateFunc, g.frozen, g.cfg.OldVersion, g.cfg.NewType, g.cfg.NewVersion,
+		migrateFunc, g.frozen, g.cfg.NewType, g.cfg.NewType, body.String())
+}
+
+func (g *generator) writeBuilder(migrateFunc string) {
+	builder := g.builderName()
+	fmt.Fprintf(&g.buf, "// %s migrates records to version %q. Add it to your versioned.BuilderList\n", builder, g.cfg.NewVersion)
+	fmt.Fprintf(&g.buf, "var %s = versioned.NewVersionedBuilder(%s, versioning.VersionKey(%q))", builder, migrateFunc, g.cfg.NewVersion)
+	if g.cfg.OldVersion != "" {
+		fmt.Fprintf(&g.buf, ".OldVersion(%q)", g.cfg.OldVersion)
+	}
+	g.buf.WriteString("\n")
+}
+
+func (g *generator) typeString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	_ = printer.Fprint(&buf, g.fset, expr)
+	return buf.String()
+}
+
+func (g *generator) print(node ast.Node) error {
+	return printer.Fprint(&g.buf, g.fset, node)
+}
+
+// rename renames identifiers in a node
+func rename(node ast.Node, renames map[string]string) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			if name, ok := renames[id.Name]; ok {
+				id.Name = name
+			}
+		}
+		return true
+	})
+}
+
+// usedPackages returns the names of the packages a set of nodes refer to
+func usedPackages(nodes []ast.Node) map[string]bool {
+	used := map[string]bool{}
+	for _, node := range nodes {
+		ast.Inspect(node, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if id, ok := sel.X.(*ast.Ident); ok {
+					used[id.Name] = true
+				}
+			}
+			return true
+		})
+	}
+	return used
+}
+
+func nodes(methods []*ast.FuncDecl, vars []*ast.GenDecl) []ast.Node {
+	var out []ast.Node
+	for _, method := range methods {
+		out = append(out, method)
+	}
+	for _, v := range vars {
+		out = append(out, v)
+	}
+	return out
+}
+
+// frozenName renames a variable that belongs to the old type
+func frozenName(name string, oldType string, frozen string) string {
+	if strings.HasSuffix(name, oldType) {
+		return strings.TrimSuffix(name, oldType) + frozen
+	}
+	return name + frozen
+}
+
+// identifier turns a version into something that can be part of a Go identifier
+func identifier(version string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, version)
+}
@@ -0,0 +1,111 @@
+package scaffold_test
+
+import (
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/scaffold"
+)
+
+func TestGenerate(t *testing.T) {
+	testCases := map[string]struct {
+		cfg              scaffold.Config
+		expectedErr      string
+		expectedContents []string
+	}{
+		"fruit basket": {
+			cfg: scaffold.Config{
+				Dir:        "testdata/fruit",
+				OldType:    "FruitBasket",
+				NewType:    "FruitBasketNew",
+				OldVersion: "1",
+				NewVersion: "2",
+			},
+			expectedContents: []string{
+				"type FruitBasketV1 struct",
+				"var lengthBufFruitBasketV1 = []byte{132}",
+				"func (t *FruitBasketV1) MarshalCBOR(w io.Writer) error",
+				"func (t *FruitBasketV1) UnmarshalCBOR(r io.Reader) error",
+				"*t = FruitBasketV1{}",
+				`cbg "github.com/whyrusleeping/cbor-gen"`,
+				"func MigrateFruitBasketNewV2(old *FruitBasketV1) (*FruitBasketNew, error)",
+				"Type: old.Type,",
+				"Count: old.Count,",
+				"// TODO: set Kinds, which is new",
+				"// TODO: set Price, which was int64 and is now uint64",
+				"// TODO: set Ripe, which is new",
+				"// TODO: old.Color is no longer stored",
+				`var fruitBasketNewMigrationV2 = versioned.NewVersionedBuilder(MigrateFruitBasketNewV2, versioning.VersionKey("2")).OldVersion("1")`,
+			},
+		},
+		"custom frozen name": {
+			cfg: scaffold.Config{
+				Dir:        "testdata/fruit",
+				OldType:    "FruitBasket",
+				NewType:    "FruitBasketNew",
+				FrozenType: "OldFruitBasket",
+				OldVersion: "1",
+				NewVersion: "2",
+			},
+			expectedContents: []string{
+				"type OldFruitBasket struct",
+				"var lengthBufOldFruitBasket = []byte{132}",
+				"func MigrateFruitBasketNewV2(old *OldFruitBasket) (*FruitBasketNew, error)",
+			},
+		},
+		"missing old type": {
+			cfg: scaffold.Config{
+				Dir:        "testdata/fruit",
+				OldType:    "AppleBasket",
+				NewType:    "FruitBasketNew",
+				NewVersion: "2",
+			},
+			expectedErr: "type AppleBasket not found",
+		},
+		"frozen type already exists": {
+			cfg: scaffold.Config{
+				Dir:        "testdata/fruit",
+				OldType:    "FruitBasket",
+				NewType:    "FruitBasketNew",
+				FrozenType: "FruitBasketNew",
+				NewVersion: "2",
+			},
+			expectedErr: "type FruitBasketNew already exists",
+		},
+		"old type not a struct": {
+			cfg: scaffold.Config{
+				Dir:        "testdata/fruit",
+				OldType:    "FruitType",
+				NewType:    "FruitBasketNew",
+				NewVersion: "2",
+			},
+			expectedErr: "type FruitType is not a struct",
+		},
+		"no new version": {
+			cfg: scaffold.Config{
+				Dir:     "testdata/fruit",
+				OldType: "FruitBasket",
+				NewType: "FruitBasketNew",
+			},
+			expectedErr: "a new version is required",
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			src, err := scaffold.Generate(data.cfg)
+			if data.expectedErr != "" {
+				require.EqualError(t, err, data.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			_, err = parser.ParseFile(token.NewFileSet(), "migration.go", src, 0)
+			require.NoError(t, err)
+			for _, contents := range data.expectedContents {
+				require.Contains(t, string(src), contents)
+			}
+		})
+	}
+}
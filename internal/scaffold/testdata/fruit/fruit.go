@@ -0,0 +1,21 @@
+package fruit
+
+// FruitType is a kind of fruit
+type FruitType string
+
+// FruitBasket is the basket as stored at version 1
+type FruitBasket struct {
+	Type  FruitType
+	Count uint64
+	Color string
+	Price int64
+}
+
+// FruitBasketNew is the basket at version 2
+type FruitBasketNew struct {
+	Type  FruitType
+	Kinds []uint64
+	Count uint64
+	Price uint64
+	Ripe  bool
+}
@@ -0,0 +1,217 @@
+// Package stale provides a read-only view of a versioned datastore that serves
+// records from the version it's at, migrated on the fly to the target version,
+// while migrations run
+package stale
+
+import (
+	"context"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// Datastore reads the records of the version a datastore is at and migrates
+// them to the target version as they're read, without writing them back. It can
+// only do so when the datastore is at the target version, or one version below
+// it and the migration to the target version can migrate records one at a time.
+// Otherwise, and for every write, it returns an error
+type Datastore struct {
+	ds         datastore.Batching
+	migrations versioning.VersionedMigrationList
+	target     versioning.VersionKey
+	ms         versioning.MigrationState
+	opts       []versioning.Option
+}
+
+// NewDatastore returns a stale view of ds for the given migrations and target
+// version. Reads fail with the ready error of ms when there's nothing to serve
+func NewDatastore(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey, ms versioning.MigrationState, opts ...versioning.Option) *Datastore {
+	return &Datastore{ds: ds, migrations: migrations, target: target, ms: ms, opts: opts}
+}
+
+// view is the records a read is served from
+type view struct {
+	// old holds the records at the version the datastore is at
+	old datastore.Batching
+	// migration migrates records from old to the target version, or is nil if
+	// the datastore is at the target version already
+	migration versioning.RecordMigration
+	// current holds the records at the target version, which a step writes
+	// before it deletes the records it migrated
+	current datastore.Batching
+}
+
+func (d *Datastore) view(ctx context.Context) (*view, error) {
+	version, err := migrate.ReadVersion(ctx, d.ds, d.opts...)
+	if err != nil {
+		return nil, d.notReady()
+	}
+	current := namespace.Wrap(d.ds, datastore.NewKey(string(d.target)))
+	if version == d.target {
+		return &view{old: current, current: current}, nil
+	}
+	for _, migration := range d.migrations {
+		if migration.OldVersion() != version || migration.NewVersion() != d.target {
+			continue
+		}
+		recordMigration, ok := versioning.MigrationAs[versioning.RecordMigration](migration)
+		if !ok {
+			break
+		}
+		old := namespace.Wrap(d.ds, datastore.NewKey(string(version)))
+		return &view{old: old, migration: recordMigration, current: current}, nil
+	}
+	return nil, d.notReady()
+}
+
+// notReady is the error for reads that can't be served, which is the ready
+// error of the migration state, unless migrations have since finished
+func (d *Datastore) notReady() error {
+	if err := d.ms.ReadyError(); err != nil {
+		return err
+	}
+	return versioning.ErrMigrationsNotRun
+}
+
+// get reads a record from the view, returning datastore.ErrNotFound if there's
+// no record or the migration leaves it out
+func (v *view) get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	value, err := v.old.Get(ctx, key)
+	if v.migration == nil {
+		return value, err
+	}
+	if err == datastore.ErrNotFound {
+		return v.current.Get(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	migrated, selected, err := v.migration.MigrateRecord(ctx, v.old, key, value)
+	if err != nil {
+		return nil, err
+	}
+	if !selected {
+		return nil, datastore.ErrNotFound
+	}
+	return migrated, nil
+}
+
+func (d *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	v, err := d.view(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return v.get(ctx, key)
+}
+
+func (d *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	v, err := d.view(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, err = v.get(ctx, key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Datastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	v, err := d.view(ctx)
+	if err != nil {
+		return -1, err
+	}
+	value, err := v.get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+// Query migrates the records at the version the datastore is at, and merges in
+// records already written to the target version
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	v, err := d.view(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if v.migration == nil {
+		return v.current.Query(ctx, q)
+	}
+	oldEntries, err := queryAll(ctx, v.old, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(oldEntries))
+	entries := make([]query.Entry, 0, len(oldEntries))
+	for _, entry := range oldEntries {
+		seen[entry.Key] = struct{}{}
+		migrated, selected, err := v.migration.MigrateRecord(ctx, v.old, datastore.NewKey(entry.Key), entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		if selected {
+			entries = append(entries, query.Entry{Key: entry.Key, Value: migrated, Size: len(migrated)})
+		}
+	}
+	currentEntries, err := queryAll(ctx, v.current, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range currentEntries {
+		if _, ok := seen[entry.Key]; !ok {
+			entries = append(entries, entry)
+		}
+	}
+	if q.KeysOnly {
+		for i := range entries {
+			entries[i].Value = nil
+		}
+	}
+	return query.NaiveQueryApply(q, query.ResultsWithEntries(q, entries)), nil
+}
+
+func queryAll(ctx context.Context, ds datastore.Read, prefix string) ([]query.Entry, error) {
+	qres, err := ds.Query(ctx, query.Query{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := qres.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Size = len(entries[i].Value)
+	}
+	return entries, nil
+}
+
+// Put fails, since stale records can't be written back
+func (d *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return versioning.ErrStaleReadOnly
+}
+
+// Delete fails, since stale records can't be written back
+func (d *Datastore) Delete(ctx context.Context, key datastore.Key) error {
+	return versioning.ErrStaleReadOnly
+}
+
+func (d *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return nil
+}
+
+// Close does nothing, since the view doesn't own the underlying datastore
+func (d *Datastore) Close() error {
+	return nil
+}
+
+// Batch fails, since stale records can't be written back
+func (d *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return nil, versioning.ErrStaleReadOnly
+}
+
+var _ datastore.Batching = &Datastore{}
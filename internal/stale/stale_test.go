@@ -0,0 +1,158 @@
+package stale_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	"github.com/filecoin-project/go-ds-versioning/internal/stale"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/builder"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+func TestDatastore(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		if *c < 0 {
+			return nil, errors.New("negative count")
+		}
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versioned.BuilderList{
+		versioned.NewVersionedBuilder(addMigration, "1"),
+		versioned.NewVersionedBuilder(addMigration, "2").OldVersion("1").Exclude(builder.KeyPrefix("/skipped")),
+		versioned.NewVersionedBuilder(addMigration, "3").OldVersion("2"),
+	}.Build()
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		inputDatabase map[string][]byte
+		target        versioning.VersionKey
+		test          func(t *testing.T, ds datastore.Batching)
+	}{
+		"reads migrate records from the previous version": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+				"/1/skipped":        numData(t, 1),
+				"/1/pears":          numData(t, -1),
+			},
+			target: "2",
+			test: func(t *testing.T, ds datastore.Batching) {
+				value, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 14), value)
+				size, err := ds.GetSize(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, len(numData(t, 14)), size)
+				has, err := ds.Has(ctx, datastore.NewKey("/skipped"))
+				require.NoError(t, err)
+				require.False(t, has)
+				_, err = ds.Get(ctx, datastore.NewKey("/pears"))
+				require.EqualError(t, err, "attempting to transform to new state '/pears': negative count")
+			},
+		},
+		"queries merge records already migrated": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+				"/1/skipped":        numData(t, 1),
+				"/2/oranges":        numData(t, 10),
+			},
+			target: "2",
+			test: func(t *testing.T, ds datastore.Batching) {
+				results, err := ds.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+				require.NoError(t, err)
+				entries, err := results.Rest()
+				require.NoError(t, err)
+				require.Len(t, entries, 2)
+				require.Equal(t, "/apples", entries[0].Key)
+				require.Equal(t, numData(t, 14), entries[0].Value)
+				require.Equal(t, "/oranges", entries[1].Key)
+				require.Equal(t, numData(t, 10), entries[1].Value)
+				value, err := ds.Get(ctx, datastore.NewKey("/oranges"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 10), value)
+			},
+		},
+		"reads at the target version aren't migrated": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("2"),
+				"/2/apples":         numData(t, 14),
+			},
+			target: "2",
+			test: func(t *testing.T, ds datastore.Batching) {
+				value, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.NoError(t, err)
+				require.Equal(t, numData(t, 14), value)
+			},
+		},
+		"reads more than a version behind fail": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+			target: "3",
+			test: func(t *testing.T, ds datastore.Batching) {
+				_, err := ds.Get(ctx, datastore.NewKey("/apples"))
+				require.EqualError(t, err, versioning.ErrMigrationsNotRun.Error())
+			},
+		},
+		"writes fail": {
+			inputDatabase: map[string][]byte{
+				"/versions/current": versionData("1"),
+				"/1/apples":         numData(t, 7),
+			},
+			target: "2",
+			test: func(t *testing.T, ds datastore.Batching) {
+				err := ds.Put(ctx, datastore.NewKey("/apples"), numData(t, 1))
+				require.EqualError(t, err, versioning.ErrStaleReadOnly.Error())
+				err = ds.Delete(ctx, datastore.NewKey("/apples"))
+				require.EqualError(t, err, versioning.ErrStaleReadOnly.Error())
+				_, err = ds.Batch(ctx)
+				require.EqualError(t, err, versioning.ErrStaleReadOnly.Error())
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			r := runner.NewRunner(ds, migrations, data.target, migrate.To)
+			data.test(t, stale.NewDatastore(ds, migrations, data.target, r))
+		})
+	}
+}
+
+func versionData(versionKey versioning.VersionKey) []byte {
+	data, err := cborutil.Dump(&migrate.VersionRecord{
+		Format:           3,
+		Version:          string(versionKey),
+		MinReaderVersion: string(versionKey),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func numData(t *testing.T, num int64) []byte {
+	buf := new(bytes.Buffer)
+	value := cbg.CborInt(num)
+	require.NoError(t, value.MarshalCBOR(buf))
+	return buf.Bytes()
+}
@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}             { return nil }
+func (dc detachedContext) Err() error                        { return nil }
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
+
+// Detach returns a context that keeps the values of the given context but is never
+// cancelled, so cleanup work like rolling back a migration can finish after the
+// context for the migration itself is cancelled
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// outsidePrefix is a query filter that drops entries at or under a key prefix
+type outsidePrefix struct {
+	prefix datastore.Key
+}
+
+func (op outsidePrefix) Filter(e query.Entry) bool {
+	key := datastore.RawKey(e.Key)
+	return !op.prefix.Equal(key) && !op.prefix.IsAncestorOf(key)
+}
+
+func (op outsidePrefix) String() string {
+	return fmt.Sprintf("KEY NOT UNDER %q", op.prefix.String())
+}
+
+type hidePrefixDatastore struct {
+	datastore.Batching
+	prefix datastore.Key
+}
+
+// HidePrefix returns a datastore whose queries never return keys at or
+// under the given prefix -- used to keep versioning's own records out of
+// migrations of unversioned data at the root of a datastore
+func HidePrefix(ds datastore.Batching, prefix datastore.Key) datastore.Batching {
+	return &hidePrefixDatastore{ds, prefix}
+}
+
+func (hpd *hidePrefixDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	filters := make([]query.Filter, 0, len(q.Filters)+1)
+	filters = append(filters, q.Filters...)
+	q.Filters = append(filters, outsidePrefix{hpd.prefix})
+	return hpd.Batching.Query(ctx, q)
+}
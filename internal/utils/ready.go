@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// ReadyGate checks migration state before a store operation runs, and
+// if configured to, waits for migrations to finish
+type ReadyGate struct {
+	ms  versioning.MigrationState
+	cfg versioning.Config
+}
+
+// NewReadyGate returns a gate for the given migration state and config
+func NewReadyGate(ms versioning.MigrationState, cfg versioning.Config) ReadyGate {
+	return ReadyGate{ms, cfg}
+}
+
+// Ready returns nil if migrations are complete. When waiting is enabled and
+// the migration state supports it, it blocks until migrations finish or the
+// context expires
+func (g ReadyGate) Ready(ctx context.Context) error {
+	if !g.cfg.WaitForReady {
+		return g.ms.ReadyError()
+	}
+	waiter, ok := g.ms.(versioning.ReadyWaiter)
+	if !ok {
+		return g.ms.ReadyError()
+	}
+	return waiter.WaitReady(ctx)
+}
+
+// ReadyWithTimeout is Ready for operations that do not take a context --
+// when waiting is enabled, it waits up to the configured ready timeout
+func (g ReadyGate) ReadyWithTimeout() error {
+	if !g.cfg.WaitForReady {
+		return g.ms.ReadyError()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), g.cfg.ReadyTimeout)
+	defer cancel()
+	return g.Ready(ctx)
+}
+
+// ReadyNow returns nil if migrations are complete, without waiting for them
+// even when waiting is enabled
+func (g ReadyGate) ReadyNow() error {
+	return g.ms.ReadyError()
+}
+
+// Retry retries migrations if the migration state supports it
+func (g ReadyGate) Retry(ctx context.Context) error {
+	retrier, ok := g.ms.(versioning.Retrier)
+	if !ok {
+		return versioning.ErrRetryNotSupported
+	}
+	return retrier.Retry(ctx)
+}
+
+// Cancel cancels running migrations if the migration state supports it
+func (g ReadyGate) Cancel(ctx context.Context) error {
+	canceller, ok := g.ms.(versioning.Canceller)
+	if !ok {
+		return versioning.ErrCancelNotSupported
+	}
+	return canceller.Cancel(ctx)
+}
@@ -1,7 +1,9 @@
 package utils_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-datastore"
 	"github.com/stretchr/testify/require"
@@ -20,3 +22,103 @@ func TestKeysForVersion(t *testing.T) {
 	}
 	require.Equal(t, expectedOutput, utils.KeysForVersion(version, testKeys))
 }
+
+func TestReadyGate(t *testing.T) {
+	ctx := context.Background()
+	testCases := map[string]struct {
+		opts        []versioning.Option
+		ms          versioning.MigrationState
+		expectedErr error
+		useTimeout  bool
+	}{
+		"fail fast by default": {
+			ms:          &waitingState{readyAfter: make(chan struct{})},
+			expectedErr: versioning.ErrMigrationsNotRun,
+		},
+		"ready state passes": {
+			ms: &waitingState{readyAfter: closedChan()},
+		},
+		"waits until ready": {
+			opts: []versioning.Option{versioning.WaitForReady(time.Second)},
+			ms:   &waitingState{readyAfter: closeAfter(10 * time.Millisecond)},
+		},
+		"waits until ready, without context": {
+			opts:       []versioning.Option{versioning.WaitForReady(time.Second)},
+			ms:         &waitingState{readyAfter: closeAfter(10 * time.Millisecond)},
+			useTimeout: true,
+		},
+		"wait times out": {
+			opts:        []versioning.Option{versioning.WaitForReady(10 * time.Millisecond)},
+			ms:          &waitingState{readyAfter: make(chan struct{})},
+			useTimeout:  true,
+			expectedErr: versioning.ErrMigrationsNotRun,
+		},
+		"state that cannot wait fails fast": {
+			opts:        []versioning.Option{versioning.WaitForReady(time.Second)},
+			ms:          staticState{versioning.ErrMigrationsNotRun},
+			expectedErr: versioning.ErrMigrationsNotRun,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			gate := utils.NewReadyGate(data.ms, versioning.NewConfig(data.opts...))
+			var err error
+			if data.useTimeout {
+				err = gate.ReadyWithTimeout()
+			} else {
+				ctx, cancel := context.WithTimeout(ctx, time.Second)
+				defer cancel()
+				err = gate.Ready(ctx)
+			}
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+		})
+	}
+}
+
+type staticState struct {
+	err error
+}
+
+func (ss staticState) ReadyError() error {
+	return ss.err
+}
+
+type waitingState struct {
+	readyAfter chan struct{}
+}
+
+func (ws *waitingState) ReadyError() error {
+	select {
+	case <-ws.readyAfter:
+		return nil
+	default:
+		return versioning.ErrMigrationsNotRun
+	}
+}
+
+func (ws *waitingState) WaitReady(ctx context.Context) error {
+	select {
+	case <-ws.readyAfter:
+	case <-ctx.Done():
+	}
+	return ws.ReadyError()
+}
+
+func closedChan() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+func closeAfter(d time.Duration) chan struct{} {
+	c := make(chan struct{})
+	go func() {
+		time.Sleep(d)
+		close(c)
+	}()
+	return c
+}
@@ -2,37 +2,204 @@ package validate
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sort"
 
-	cbg "github.com/whyrusleeping/cbor-gen"
+	"github.com/ipfs/go-datastore"
+	"go.uber.org/multierr"
 
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/codec"
 )
 
 // CheckMigration validationes that a migration func matches the required signature for
 // this kind of function
 func CheckMigration(migrate versioning.MigrationFunc) (reflect.Type, reflect.Type, error) {
+	input, output, err := CheckMigrationFunc(migrate)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := CheckCodecs(input, output, codec.CBOR, codec.CBOR); err != nil {
+		return nil, nil, err
+	}
+	return input, output, nil
+}
+
+var accessorType = reflect.TypeOf((*versioning.Accessor)(nil)).Elem()
+
+// CheckMigrationFunc validates that a migration func takes one record, and
+// optionally an accessor, and returns a record and an error, without checking
+// the record types can be read or written
+func CheckMigrationFunc(migrate versioning.MigrationFunc) (reflect.Type, reflect.Type, error) {
 	migrateType := reflect.TypeOf(migrate)
-	if migrateType.Kind() != reflect.Func {
+	if migrateType == nil || migrateType.Kind() != reflect.Func {
 		return nil, nil, errors.New("migration must be a function")
 	}
-	if migrateType.NumIn() != 1 {
-		return nil, nil, errors.New("migration must take exactly one argument")
+	if migrateType.NumIn() != 1 && migrateType.NumIn() != 2 {
+		return nil, nil, errors.New("migration must take exactly one argument, or a record and an accessor")
+	}
+	if migrateType.NumIn() == 2 && migrateType.In(1) != accessorType {
+		return nil, nil, errors.New("second argument must be a versioning.Accessor")
 	}
 	if migrateType.NumOut() != 2 {
 		return nil, nil, errors.New("migration must produce exactly two return values")
 	}
-	input := migrateType.In(0)
-	if !input.Implements(reflect.TypeOf((*cbg.CBORUnmarshaler)(nil)).Elem()) {
-		return nil, nil, errors.New("input must be an unmarshallable CBOR struct")
-	}
-	output := migrateType.Out(0)
-	if !output.Implements(reflect.TypeOf((*cbg.CBORMarshaler)(nil)).Elem()) {
-		return nil, nil, errors.New("first output must be an marshallable CBOR struct")
-	}
 	errOutValue := reflect.New(migrateType.Out(1))
 	if _, ok := errOutValue.Interface().(*error); !ok {
 		return nil, nil, errors.New("second output must be an error interface")
 	}
-	return input, output, nil
+	return migrateType.In(0), migrateType.Out(0), nil
+}
+
+// CheckCodecs validates that records of the input type can be read with the input
+// codec and records of the output type can be written with the output codec, for
+// codecs that can check types
+func CheckCodecs(input reflect.Type, output reflect.Type, inputCodec versioning.Codec, outputCodec versioning.Codec) error {
+	if checker, ok := inputCodec.(versioning.CodecTypeChecker); ok {
+		if err := checker.CheckDecode(input); err != nil {
+			return err
+		}
+	}
+	if checker, ok := outputCodec.(versioning.CodecTypeChecker); ok {
+		if err := checker.CheckEncode(output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SortMigrations sorts migrations into the order they apply in, following each
+// migration on from the version the one before it migrates to. Lists that aren't
+// a single chain are left sorted by version, for CheckMigrationList to report
+func SortMigrations(migrations versioning.VersionedMigrationList) {
+	sort.Stable(migrations)
+	byOld := make(map[versioning.VersionKey]versioning.VersionedMigration, len(migrations))
+	newVersions := make(map[versioning.VersionKey]struct{}, len(migrations))
+	for _, migration := range migrations {
+		byOld[migration.OldVersion()] = migration
+		newVersions[migration.NewVersion()] = struct{}{}
+	}
+	if len(byOld) != len(migrations) {
+		return
+	}
+	var first versioning.VersionedMigration
+	for _, migration := range migrations {
+		if _, ok := newVersions[migration.OldVersion()]; ok {
+			continue
+		}
+		if first != nil {
+			return
+		}
+		first = migration
+	}
+	chain := make(versioning.VersionedMigrationList, 0, len(migrations))
+	for migration := first; migration != nil && len(chain) < len(migrations); migration = byOld[migration.NewVersion()] {
+		chain = append(chain, migration)
+	}
+	if len(chain) != len(migrations) {
+		return
+	}
+	copy(migrations, chain)
+}
+
+// CheckMigrationList validates the structure of a list of versioned migrations:
+// every version is migrated to once, there is at most one initial migration, each
+// migration moves to a version not seen earlier in the chain and starts from the
+// version before it, and each migration takes the type of record the one before
+// it produces. It reports every problem it finds, rather than just the first
+func CheckMigrationList(migrations versioning.VersionedMigrationList) error {
+	sorted := make(versioning.VersionedMigrationList, len(migrations))
+	copy(sorted, migrations)
+	SortMigrations(sorted)
+
+	var err error
+	produced := make(map[versioning.VersionKey]bool, len(sorted))
+	for _, migration := range sorted {
+		produced[migration.NewVersion()] = true
+	}
+	seen := make(map[versioning.VersionKey]bool, len(sorted)+1)
+	var initial versioning.VersionedMigration
+	for i, migration := range sorted {
+		oldVersion, newVersion := migration.OldVersion(), migration.NewVersion()
+		if newVersion == "" {
+			err = multierr.Append(err, fmt.Errorf("migration from version %q has no new version", oldVersion))
+			continue
+		}
+		duplicate := i > 0 && sorted[i-1].NewVersion() == newVersion
+		if !duplicate && (oldVersion == newVersion || seen[newVersion]) {
+			err = multierr.Append(err, fmt.Errorf("migration from version %q to %q does not move to a later version", oldVersion, newVersion))
+			continue
+		}
+		seen[oldVersion], seen[newVersion] = true, true
+		if i == 0 {
+			if oldVersion == "" {
+				initial = migration
+			}
+			continue
+		}
+		previous := sorted[i-1]
+		switch {
+		case duplicate:
+			err = multierr.Append(err, fmt.Errorf("more than one migration to version %q", newVersion))
+		case oldVersion == "" && initial != nil:
+			err = multierr.Append(err, fmt.Errorf("migrations to versions %q and %q both start from an unversioned datastore (missing OldVersion?)", initial.NewVersion(), newVersion))
+		case oldVersion == "":
+			err = multierr.Append(err, fmt.Errorf("migration to version %q starts from an unversioned datastore, but follows version %q (missing OldVersion?)", newVersion, previous.NewVersion()))
+		case !produced[oldVersion]:
+			err = multierr.Append(err, fmt.Errorf("migration to version %q migrates from version %q, which no migration produces", newVersion, oldVersion))
+		case oldVersion != previous.NewVersion():
+			err = multierr.Append(err, fmt.Errorf("migration to version %q migrates from version %q, but should migrate from the previous version, %q", newVersion, oldVersion, previous.NewVersion()))
+		default:
+			if typeErr := checkContinuity(previous, migration); typeErr != nil {
+				err = multierr.Append(err, typeErr)
+			}
+		}
+	}
+	return err
+}
+
+// checkContinuity makes sure a migration takes the type of record the previous
+// migration produces, when both migrations report their types
+func checkContinuity(previous versioning.VersionedMigration, next versioning.VersionedMigration) error {
+	previousTyped, ok := versioning.MigrationAs[versioning.TypedMigration](previous)
+	if !ok {
+		return nil
+	}
+	nextTyped, ok := versioning.MigrationAs[versioning.TypedMigration](next)
+	if !ok {
+		return nil
+	}
+	produces, takes := previousTyped.OutputType(), nextTyped.InputType()
+	if produces == nil || takes == nil || produces.AssignableTo(takes) {
+		return nil
+	}
+	return fmt.Errorf("migration to version %q takes %s, but migration to version %q produces %s", next.NewVersion(), takes, previous.NewVersion(), produces)
+}
+
+// checkIndex verifies an index has a name that fits in a single key component,
+// and a function to derive its entries
+func checkIndex(index versioning.Index) error {
+	if namespaces := datastore.NewKey(index.Name).Namespaces(); index.Name == "" || len(namespaces) != 1 || namespaces[0] != index.Name {
+		return fmt.Errorf("index name %q must be a single key component", index.Name)
+	}
+	if index.Entries == nil {
+		return fmt.Errorf("index %q has no entries function", index.Name)
+	}
+	return nil
+}
+
+// CheckIndexes verifies a version's indexes are well formed, with no two sharing a name
+func CheckIndexes(indexes []versioning.Index) error {
+	names := make(map[string]bool, len(indexes))
+	for _, index := range indexes {
+		if err := checkIndex(index); err != nil {
+			return err
+		}
+		if names[index.Name] {
+			return fmt.Errorf("more than one index named %q", index.Name)
+		}
+		names[index.Name] = true
+	}
+	return nil
 }
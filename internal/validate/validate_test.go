@@ -7,9 +7,11 @@ import (
 
 	"github.com/stretchr/testify/require"
 	cbg "github.com/whyrusleeping/cbor-gen"
+	"go.uber.org/multierr"
 
 	"github.com/filecoin-project/go-ds-versioning/internal/validate"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
 )
 
 func TestCheckMigration(t *testing.T) {
@@ -25,7 +27,7 @@ func TestCheckMigration(t *testing.T) {
 		},
 		"given a function that takes the wrong number of arguments": {
 			migrateFunc: func() {},
-			expectedErr: errors.New("migration must take exactly one argument"),
+			expectedErr: errors.New("migration must take exactly one argument, or a record and an accessor"),
 		},
 		"given a function that produces the wrong number of outputs": {
 			migrateFunc: func(c *cbg.CborInt) *cbg.CborBool {
@@ -79,6 +81,22 @@ func TestCheckMigration(t *testing.T) {
 			expectedInputType:  reflect.TypeOf(new(cbg.CborInt)),
 			expectedOutputType: reflect.TypeOf(new(cbg.CborBool)),
 		},
+		"given a function that also takes an accessor": {
+			migrateFunc: func(c *cbg.CborInt, accessor versioning.Accessor) (*cbg.CborBool, error) {
+				out := cbg.CborBool(*c != 0)
+				return &out, nil
+			},
+			expectedErr:        nil,
+			expectedInputType:  reflect.TypeOf(new(cbg.CborInt)),
+			expectedOutputType: reflect.TypeOf(new(cbg.CborBool)),
+		},
+		"given a function whose second argument isn't an accessor": {
+			migrateFunc: func(c *cbg.CborInt, other *cbg.CborInt) (*cbg.CborBool, error) {
+				out := cbg.CborBool(*c != *other)
+				return &out, nil
+			},
+			expectedErr: errors.New("second argument must be a versioning.Accessor"),
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -93,3 +111,129 @@ func TestCheckMigration(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckMigrationList(t *testing.T) {
+	intToInt := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		return c, nil
+	}
+	intToBool := func(c *cbg.CborInt) (*cbg.CborBool, error) {
+		out := cbg.CborBool(*c != 0)
+		return &out, nil
+	}
+	build := func(builders ...versioned.Builder) versioning.VersionedMigrationList {
+		var migrations versioning.VersionedMigrationList
+		for _, builder := range builders {
+			migration, err := builder.Build()
+			require.NoError(t, err)
+			migrations = append(migrations, migration)
+		}
+		return migrations
+	}
+	testCases := map[string]struct {
+		migrations   versioning.VersionedMigrationList
+		expectedErrs []error
+	}{
+		"empty list": {},
+		"valid list, out of order": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToBool, "3").OldVersion("2"),
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+			),
+		},
+		"valid list, with versions that don't sort lexically": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToBool, "9").OldVersion("b"),
+				versioned.NewVersionedBuilder(intToInt, "a"),
+				versioned.NewVersionedBuilder(intToInt, "b").OldVersion("a"),
+			),
+		},
+		"valid list, without initial migration": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(intToInt, "3").OldVersion("2"),
+			),
+		},
+		"duplicate new version": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+			),
+			expectedErrs: []error{errors.New("more than one migration to version \"2\"")},
+		},
+		"missing old version": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2"),
+			),
+			expectedErrs: []error{errors.New("migrations to versions \"1\" and \"2\" both start from an unversioned datastore (missing OldVersion?)")},
+		},
+		"missing old version after first migration": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(intToInt, "3"),
+			),
+			expectedErrs: []error{errors.New("migration to version \"3\" starts from an unversioned datastore, but follows version \"2\" (missing OldVersion?)")},
+		},
+		"gap": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(intToInt, "3").OldVersion("2"),
+			),
+			expectedErrs: []error{errors.New("migration to version \"3\" migrates from version \"2\", which no migration produces")},
+		},
+		"branch": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(intToInt, "3").OldVersion("1"),
+			),
+			expectedErrs: []error{errors.New("migration to version \"3\" migrates from version \"1\", but should migrate from the previous version, \"2\"")},
+		},
+		"cycle": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(intToInt, "1").OldVersion("2"),
+			),
+			expectedErrs: []error{errors.New("migration from version \"2\" to \"1\" does not move to a later version")},
+		},
+		"cycle without an initial migration": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToInt, "b").OldVersion("a"),
+				versioned.NewVersionedBuilder(intToInt, "a").OldVersion("b"),
+			),
+			expectedErrs: []error{errors.New("migration from version \"a\" to \"b\" does not move to a later version")},
+		},
+		"type mismatch": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToBool, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+			),
+			expectedErrs: []error{errors.New("migration to version \"2\" takes *typegen.CborInt, but migration to version \"1\" produces *typegen.CborBool")},
+		},
+		"multiple problems": {
+			migrations: build(
+				versioned.NewVersionedBuilder(intToBool, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(intToInt, "3"),
+				versioned.NewVersionedBuilder(intToInt, "5").OldVersion("4"),
+			),
+			expectedErrs: []error{
+				errors.New("migration to version \"2\" takes *typegen.CborInt, but migration to version \"1\" produces *typegen.CborBool"),
+				errors.New("migrations to versions \"1\" and \"3\" both start from an unversioned datastore (missing OldVersion?)"),
+				errors.New("migration to version \"5\" migrates from version \"4\", which no migration produces"),
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			errs := multierr.Errors(validate.CheckMigrationList(data.migrations))
+			require.Len(t, errs, len(data.expectedErrs))
+			for i, err := range errs {
+				require.EqualError(t, err, data.expectedErrs[i].Error())
+			}
+		})
+	}
+}
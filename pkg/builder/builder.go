@@ -5,6 +5,7 @@ package builder
 import (
 	"context"
 	"errors"
+	"fmt"
 	"reflect"
 
 	"github.com/ipfs/go-datastore"
@@ -13,6 +14,7 @@ import (
 	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
 	"github.com/filecoin-project/go-ds-versioning/internal/validate"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/codec"
 )
 
 // Builder is an interface for constructing migrations
@@ -20,27 +22,63 @@ type Builder interface {
 	Reversible(down versioning.MigrationFunc) Builder
 	FilterKeys([]string) Builder
 	Only([]string) Builder
+	Select(...query.Filter) Builder
+	Exclude(...query.Filter) Builder
+	WithStore(name string, ds datastore.Read) Builder
+	InputCodec(versioning.Codec) Builder
+	OutputCodec(versioning.Codec) Builder
 	Build() (versioning.DatastoreMigration, error)
 }
 
 type migrationBuilder struct {
 	oldType      reflect.Type
 	newType      reflect.Type
-	upFunc       reflect.Value
+	up           transform
 	filters      []query.Filter
 	isReversible bool
-	downFunc     reflect.Value
+	down         transform
+	inputCodec   versioning.Codec
+	outputCodec  versioning.Codec
+	stores       map[string]datastore.Read
+}
+
+// transform is a migration function, given either as a function checked by
+// reflection, as a typed transform, or as a raw transform that ignores codecs
+type transform struct {
+	migrateFunc reflect.Value
+	typed       func(inputCodec versioning.Codec, outputCodec versioning.Codec) migrate.Transform
+	raw         versioning.RawMigrationFunc
+}
+
+func (t transform) withCodecs(oldType reflect.Type, inputCodec versioning.Codec, outputCodec versioning.Codec, accessor versioning.Accessor) migrate.Transform {
+	if t.raw != nil {
+		return migrate.RawTransform(t.raw)
+	}
+	if t.typed != nil {
+		return t.typed(inputCodec, outputCodec)
+	}
+	return migrate.CodecTransform(oldType, t.migrateFunc, inputCodec, outputCodec, accessor)
 }
 
 func (mb migrationBuilder) Reversible(down versioning.MigrationFunc) Builder {
-	reversibleNewType, reversibleOldType, err := validate.CheckMigration(down)
+	if raw, ok := asRaw(down); ok {
+		mb.isReversible = true
+		mb.down = transform{raw: raw}
+		return mb
+	}
+	if mb.up.raw != nil {
+		return errorBuilder{errors.New("reversible function does not have inverse types")}
+	}
+	reversibleNewType, reversibleOldType, err := validate.CheckMigrationFunc(down)
 	if err != nil {
 		return errorBuilder{err}
 	}
 	if !mb.oldType.AssignableTo(reversibleOldType) || !mb.newType.AssignableTo(reversibleNewType) {
 		return errorBuilder{errors.New("reversible function does not have inverse types")}
 	}
-	return migrationBuilder{mb.oldType, mb.newType, mb.upFunc, mb.filters, true, reflect.ValueOf(down)}
+	mb.isReversible = true
+	mb.down = transform{migrateFunc: reflect.ValueOf(down)}
+	return mb
 }
 
 func (mb migrationBuilder) FilterKeys(keys []string) Builder {
@@ -48,33 +86,108 @@ func (mb migrationBuilder) FilterKeys(keys []string) Builder {
 	for _, key := range keys {
 		newFilters = append(newFilters, query.FilterKeyCompare{Key: key, Op: query.NotEqual})
 	}
-	return migrationBuilder{mb.oldType, mb.newType, mb.upFunc, newFilters, mb.isReversible, mb.downFunc}
+	mb.filters = newFilters
+	return mb
 }
 
+// Only migrates just the records with the given keys
 func (mb migrationBuilder) Only(keys []string) Builder {
-	var newFilters = mb.filters
+	var filters []query.Filter
 	for _, key := range keys {
-		newFilters = append(newFilters, query.FilterKeyCompare{Key: key, Op: query.Equal})
+		filters = append(filters, query.FilterKeyCompare{Key: key, Op: query.Equal})
+	}
+	return mb.Select(filters...)
+}
+
+// Select migrates just the records that match at least one of the given
+// filters, like KeyPrefix, KeyGlob, KeyRegexp or Predicate. Selecting more than
+// once migrates the records that match every selection
+func (mb migrationBuilder) Select(filters ...query.Filter) Builder {
+	if len(filters) == 0 {
+		return mb
+	}
+	if err := checkFilters(filters); err != nil {
+		return errorBuilder{err}
+	}
+	mb.filters = append(mb.filters[:len(mb.filters):len(mb.filters)], anyOf(filters))
+	return mb
+}
+
+// Exclude leaves out the records that match any of the given filters
+func (mb migrationBuilder) Exclude(filters ...query.Filter) Builder {
+	if len(filters) == 0 {
+		return mb
 	}
-	return migrationBuilder{mb.oldType, mb.newType, mb.upFunc, newFilters, mb.isReversible, mb.downFunc}
+	if err := checkFilters(filters); err != nil {
+		return errorBuilder{err}
+	}
+	mb.filters = append(mb.filters[:len(mb.filters):len(mb.filters)], noneOf(filters))
+	return mb
+}
+
+// WithStore gives migration functions that take a versioning.Accessor read-only
+// access to another store, under the given name
+func (mb migrationBuilder) WithStore(name string, ds datastore.Read) Builder {
+	stores := make(map[string]datastore.Read, len(mb.stores)+1)
+	for storeName, store := range mb.stores {
+		stores[storeName] = store
+	}
+	stores[name] = ds
+	mb.stores = stores
+	return mb
+}
+
+// InputCodec sets the codec for reading records before they are migrated. It
+// defaults to codec.CBOR
+func (mb migrationBuilder) InputCodec(inputCodec versioning.Codec) Builder {
+	mb.inputCodec = inputCodec
+	return mb
+}
+
+// OutputCodec sets the codec for writing records after they are migrated. It
+// defaults to codec.CBOR
+func (mb migrationBuilder) OutputCodec(outputCodec versioning.Codec) Builder {
+	mb.outputCodec = outputCodec
+	return mb
 }
 
 func (mb migrationBuilder) Build() (versioning.DatastoreMigration, error) {
+	inputCodec, outputCodec := orCBOR(mb.inputCodec), orCBOR(mb.outputCodec)
+	if mb.up.raw == nil {
+		if err := validate.CheckCodecs(mb.oldType, mb.newType, inputCodec, outputCodec); err != nil {
+			return nil, err
+		}
+	}
 	baseMigration := dsMigration{
-		query:   query.Query{Filters: mb.filters},
-		oldType: mb.oldType,
-		newType: mb.newType,
-		upFunc:  mb.upFunc,
+		query:       query.Query{Filters: mb.filters},
+		oldType:     mb.oldType,
+		newType:     mb.newType,
+		up:          mb.up,
+		inputCodec:  mb.inputCodec,
+		outputCodec: mb.outputCodec,
+		stores:      mb.stores,
 	}
 	if !mb.isReversible {
 		return &baseMigration, nil
 	}
+	if mb.down.raw == nil {
+		if err := validate.CheckCodecs(mb.newType, mb.oldType, outputCodec, inputCodec); err != nil {
+			return nil, fmt.Errorf("reversible function: %w", err)
+		}
+	}
 	return &reversibleDsMigration{
 		dsMigration: baseMigration,
-		downFunc:    mb.downFunc,
+		down:        mb.down,
 	}, nil
 }
 
+func orCBOR(c versioning.Codec) versioning.Codec {
+	if c == nil {
+		return codec.CBOR
+	}
+	return c
+}
+
 type errorBuilder struct {
 	err error
 }
@@ -82,37 +195,169 @@ type errorBuilder struct {
 func (eb errorBuilder) Reversible(versioning.MigrationFunc) Builder   { return eb }
 func (eb errorBuilder) FilterKeys([]string) Builder                   { return eb }
 func (eb errorBuilder) Only([]string) Builder                         { return eb }
+func (eb errorBuilder) Select(...query.Filter) Builder                { return eb }
+func (eb errorBuilder) Exclude(...query.Filter) Builder               { return eb }
+func (eb errorBuilder) WithStore(string, datastore.Read) Builder      { return eb }
+func (eb errorBuilder) InputCodec(versioning.Codec) Builder           { return eb }
+func (eb errorBuilder) OutputCodec(versioning.Codec) Builder          { return eb }
 func (eb errorBuilder) Build() (versioning.DatastoreMigration, error) { return nil, eb.err }
 
 type dsMigration struct {
-	query   query.Query
-	oldType reflect.Type
-	newType reflect.Type
-	upFunc  reflect.Value
+	query       query.Query
+	oldType     reflect.Type
+	newType     reflect.Type
+	up          transform
+	inputCodec  versioning.Codec
+	outputCodec versioning.Codec
+	stores      map[string]datastore.Read
 }
 
 func (dm *dsMigration) Up(ctx context.Context, oldDs datastore.Batching, newDS datastore.Batching) ([]datastore.Key, error) {
-	return migrate.Execute(ctx, dm.query, oldDs, newDS, dm.oldType, dm.upFunc)
+	inputCodec := orCBOR(dm.inputCodec)
+	accessor := migrate.NewAccessor(ctx, oldDs, inputCodec, dm.stores)
+	up := dm.up.withCodecs(dm.oldType, inputCodec, orCBOR(dm.outputCodec), accessor)
+	return migrate.ExecuteTransform(ctx, dm.query, oldDs, newDS, up)
+}
+
+// MigrateRecord migrates a single record, if the migration's filters select it
+func (dm *dsMigration) MigrateRecord(ctx context.Context, oldDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error) {
+	if !dm.selects(key, value) {
+		return nil, false, nil
+	}
+	inputCodec := orCBOR(dm.inputCodec)
+	accessor := migrate.NewAccessor(ctx, oldDs, inputCodec, dm.stores)
+	up := dm.up.withCodecs(dm.oldType, inputCodec, orCBOR(dm.outputCodec), accessor)
+	migrated, err := up(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+	return migrated, true, nil
+}
+
+func (dm *dsMigration) selects(key datastore.Key, value []byte) bool {
+	entry := query.Entry{Key: key.String(), Value: value, Size: len(value)}
+	for _, filter := range dm.query.Filters {
+		if !filter.Filter(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+func (dm *dsMigration) InputType() reflect.Type {
+	return dm.oldType
+}
+
+func (dm *dsMigration) OutputType() reflect.Type {
+	return dm.newType
 }
 
 type reversibleDsMigration struct {
 	dsMigration
-	downFunc reflect.Value
+	down transform
 }
 
 func (rdm *reversibleDsMigration) Down(ctx context.Context, newDs datastore.Batching, oldDs datastore.Batching) ([]datastore.Key, error) {
-	return migrate.Execute(ctx, rdm.query, newDs, oldDs, rdm.newType, rdm.downFunc)
+	outputCodec := orCBOR(rdm.outputCodec)
+	accessor := migrate.NewAccessor(ctx, newDs, outputCodec, rdm.stores)
+	down := rdm.down.withCodecs(rdm.newType, outputCodec, orCBOR(rdm.inputCodec), accessor)
+	return migrate.ExecuteTransform(ctx, rdm.query, newDs, oldDs, down)
+}
+
+// MigrateRecordDown migrates a single record back, if the migration's filters
+// select it
+func (rdm *reversibleDsMigration) MigrateRecordDown(ctx context.Context, newDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error) {
+	if !rdm.selects(key, value) {
+		return nil, false, nil
+	}
+	outputCodec := orCBOR(rdm.outputCodec)
+	accessor := migrate.NewAccessor(ctx, newDs, outputCodec, rdm.stores)
+	down := rdm.down.withCodecs(rdm.newType, outputCodec, orCBOR(rdm.inputCodec), accessor)
+	migrated, err := down(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+	return migrated, true, nil
 }
 
-// NewMigrationBuilder returns an interface that can be used to build a data base migration
+// NewMigrationBuilder returns an interface that can be used to build a data base migration.
+// Raw migration functions are built as they are by NewRaw
 func NewMigrationBuilder(up versioning.MigrationFunc) Builder {
-	oldType, newType, err := validate.CheckMigration(up)
+	if raw, ok := asRaw(up); ok {
+		return NewRaw(raw)
+	}
+	oldType, newType, err := validate.CheckMigrationFunc(up)
 	if err != nil {
 		return errorBuilder{err}
 	}
 	return migrationBuilder{
 		oldType: oldType,
 		newType: newType,
-		upFunc:  reflect.ValueOf(up),
+		up:      transform{migrateFunc: reflect.ValueOf(up)},
+	}
+}
+
+// Record is a pointer to a record type that can be read and written as CBOR,
+// like the types cbor-gen generates code for
+type Record[T any] interface {
+	migrate.Record[T]
+}
+
+// New returns a builder for a migration from a typed function. Unlike
+// NewMigrationBuilder, the function's signature is checked at compile time, and
+// records are transformed without reflection
+func New[T any, U any, PT Record[T], PU Record[U]](up func(PT) (PU, error)) Builder {
+	return migrationBuilder{
+		oldType: reflect.TypeOf(PT(nil)),
+		newType: reflect.TypeOf(PU(nil)),
+		up:      typedTransform(up),
+	}
+}
+
+// NewReversible returns a builder for a reversible migration from a pair of typed
+// functions, which are checked at compile time to be inverses of each other
+func NewReversible[T any, U any, PT Record[T], PU Record[U]](up func(PT) (PU, error), down func(PU) (PT, error)) Builder {
+	return migrationBuilder{
+		oldType:      reflect.TypeOf(PT(nil)),
+		newType:      reflect.TypeOf(PU(nil)),
+		up:           typedTransform(up),
+		isReversible: true,
+		down:         typedTransform(down),
+	}
+}
+
+func typedTransform[T any, U any, PT Record[T], PU Record[U]](migrateFunc func(PT) (PU, error)) transform {
+	return transform{typed: func(inputCodec versioning.Codec, outputCodec versioning.Codec) migrate.Transform {
+		return migrate.TypedCodecTransform(migrateFunc, inputCodec, outputCodec)
+	}}
+}
+
+// NewRaw returns a builder for a migration that transforms the stored bytes of
+// each record directly, for records that can't be decoded or whose types are no
+// longer around. Codecs set on the builder are ignored
+func NewRaw(up versioning.RawMigrationFunc) Builder {
+	if up == nil {
+		return errorBuilder{errors.New("migration must be a function")}
+	}
+	return migrationBuilder{up: transform{raw: up}}
+}
+
+// NewRawReversible returns a builder for a reversible migration that transforms
+// the stored bytes of each record directly in both directions
+func NewRawReversible(up versioning.RawMigrationFunc, down versioning.RawMigrationFunc) Builder {
+	if up == nil || down == nil {
+		return errorBuilder{errors.New("migration must be a function")}
+	}
+	return migrationBuilder{up: transform{raw: up}, isReversible: true, down: transform{raw: down}}
+}
+
+func asRaw(migrateFunc versioning.MigrationFunc) (versioning.RawMigrationFunc, bool) {
+	switch raw := migrateFunc.(type) {
+	case versioning.RawMigrationFunc:
+		return raw, raw != nil
+	case func(datastore.Key, []byte) ([]byte, error):
+		return raw, raw != nil
+	default:
+		return nil, false
 	}
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"regexp"
 	"testing"
 
 	"github.com/ipfs/go-datastore"
@@ -15,6 +17,7 @@ import (
 
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	"github.com/filecoin-project/go-ds-versioning/pkg/builder"
+	"github.com/filecoin-project/go-ds-versioning/pkg/codec"
 )
 
 func TestExecuteMigration(t *testing.T) {
@@ -38,6 +41,7 @@ func TestExecuteMigration(t *testing.T) {
 		inputDatabase          map[string]*cbg.CborInt
 		expectedOutputDatabase map[string]*cbg.CborInt
 		upFunc                 versioning.MigrationFunc
+		newBuilder             func() builder.Builder
 		configure              func(builder.Builder) builder.Builder
 		expectedErr            error
 	}{
@@ -92,6 +96,164 @@ func TestExecuteMigration(t *testing.T) {
 				return builder.Only([]string{"/apples"})
 			},
 		},
+		"with several specific keys": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &appleCount,
+				"/oranges": &orangeCount,
+				"/pears":   &appleCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/apples": &changedAppleCount,
+				"/pears":  &changedAppleCount,
+			},
+			upFunc: migrateFunc,
+			configure: func(builder builder.Builder) builder.Builder {
+				return builder.Only([]string{"/apples", "/pears"})
+			},
+		},
+		"selecting by key prefix": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/baskets/apples":  &appleCount,
+				"/baskets/oranges": &orangeCount,
+				"/basketsofapples": &appleCount,
+				"/crates/apples":   &appleCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/baskets/apples":  &changedAppleCount,
+				"/baskets/oranges": &changedOrangeCount,
+			},
+			upFunc: migrateFunc,
+			configure: func(migrationBuilder builder.Builder) builder.Builder {
+				return migrationBuilder.Select(builder.KeyPrefix("/baskets"))
+			},
+		},
+		"selecting by glob or regexp": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/baskets/apples":  &appleCount,
+				"/baskets/oranges": &orangeCount,
+				"/crates/apples":   &appleCount,
+				"/crates/a/apples": &appleCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/baskets/oranges": &changedOrangeCount,
+				"/crates/apples":   &changedAppleCount,
+			},
+			upFunc: migrateFunc,
+			configure: func(migrationBuilder builder.Builder) builder.Builder {
+				return migrationBuilder.Select(builder.KeyGlob("/crates/*"), builder.KeyRegexp(regexp.MustCompile("oranges$")))
+			},
+		},
+		"selecting more than once": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/baskets/apples":  &appleCount,
+				"/baskets/oranges": &orangeCount,
+				"/crates/apples":   &appleCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/baskets/apples": &changedAppleCount,
+			},
+			upFunc: migrateFunc,
+			configure: func(migrationBuilder builder.Builder) builder.Builder {
+				return migrationBuilder.Select(builder.KeyPrefix("/baskets")).Select(builder.KeyGlob("/*/apples"))
+			},
+		},
+		"excluding by predicate": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &appleCount,
+				"/oranges": &orangeCount,
+				"/pears":   &orangeCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/apples": &changedAppleCount,
+			},
+			upFunc: migrateFunc,
+			configure: func(migrationBuilder builder.Builder) builder.Builder {
+				return migrationBuilder.Exclude(builder.Predicate(func(key datastore.Key, value []byte) bool {
+					var count cbg.CborInt
+					return count.UnmarshalCBOR(bytes.NewReader(value)) == nil && count == 0
+				}))
+			},
+		},
+		"excluding by prefix, typed": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/baskets/apples":  &appleCount,
+				"/baskets/oranges": &orangeCount,
+				"/crates/apples":   &appleCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/crates/apples": &changedAppleCount,
+			},
+			newBuilder: func() builder.Builder {
+				return builder.New(migrateFunc)
+			},
+			configure: func(migrationBuilder builder.Builder) builder.Builder {
+				return migrationBuilder.Exclude(builder.KeyPrefix("/baskets"))
+			},
+		},
+		"malformed glob": {
+			upFunc:      migrateFunc,
+			expectedErr: errors.New("key glob \"[\": syntax error in pattern"),
+			configure: func(migrationBuilder builder.Builder) builder.Builder {
+				return migrationBuilder.Select(builder.KeyGlob("["))
+			},
+		},
+		"typed": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &appleCount,
+				"/oranges": &orangeCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &changedAppleCount,
+				"/oranges": &changedOrangeCount,
+			},
+			newBuilder: func() builder.Builder {
+				return builder.New(migrateFunc)
+			},
+		},
+		"typed, when reversible": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &appleCount,
+				"/oranges": &orangeCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &changedAppleCount,
+				"/oranges": &changedOrangeCount,
+			},
+			newBuilder: func() builder.Builder {
+				return builder.NewReversible(migrateFunc, unmigrateFunc)
+			},
+		},
+		"typed, with key filtering": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &appleCount,
+				"/oranges": &orangeCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/apples": &changedAppleCount,
+			},
+			newBuilder: func() builder.Builder {
+				return builder.New(migrateFunc)
+			},
+			configure: func(builder builder.Builder) builder.Builder {
+				return builder.FilterKeys([]string{"/oranges"})
+			},
+		},
+		"typed, made reversible with an untyped function": {
+			inputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &appleCount,
+				"/oranges": &orangeCount,
+			},
+			expectedOutputDatabase: map[string]*cbg.CborInt{
+				"/apples":  &changedAppleCount,
+				"/oranges": &changedOrangeCount,
+			},
+			newBuilder: func() builder.Builder {
+				return builder.New(migrateFunc)
+			},
+			configure: func(builder builder.Builder) builder.Builder {
+				return builder.Reversible(unmigrateFunc)
+			},
+		},
 		"down migration doesn't map up ": {
 			inputDatabase: map[string]*cbg.CborInt{
 				"/apples":  &appleCount,
@@ -123,11 +285,16 @@ func TestExecuteMigration(t *testing.T) {
 					require.NoError(t, err)
 				}
 			}
-			builder := builder.NewMigrationBuilder(data.upFunc)
+			var migrationBuilder builder.Builder
+			if data.newBuilder != nil {
+				migrationBuilder = data.newBuilder()
+			} else {
+				migrationBuilder = builder.NewMigrationBuilder(data.upFunc)
+			}
 			if data.configure != nil {
-				builder = data.configure(builder)
+				migrationBuilder = data.configure(migrationBuilder)
 			}
-			migration, err := builder.Build()
+			migration, err := migrationBuilder.Build()
 			if data.expectedErr == nil {
 				require.NoError(t, err)
 
@@ -182,3 +349,621 @@ func TestExecuteMigration(t *testing.T) {
 	}
 
 }
+
+type jsonFruit struct {
+	Count int64
+}
+
+func TestCodecs(t *testing.T) {
+	ctx := context.Background()
+	jsonToCBOR := func(f jsonFruit) (*cbg.CborInt, error) {
+		count := cbg.CborInt(f.Count)
+		return &count, nil
+	}
+	cborToJSON := func(c *cbg.CborInt) (jsonFruit, error) {
+		return jsonFruit{Count: int64(*c)}, nil
+	}
+	testCases := map[string]struct {
+		builder        builder.Builder
+		inputDatabase  map[string][]byte
+		expectedOutput map[string][]byte
+		expectedErr    error
+	}{
+		"converts json to cbor": {
+			builder: builder.NewMigrationBuilder(jsonToCBOR).Reversible(cborToJSON).InputCodec(codec.JSON),
+			inputDatabase: map[string][]byte{
+				"/apples": []byte(`{"Count":30}`),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": cborData(t, 30),
+			},
+		},
+		"raw bytes": {
+			builder: builder.NewMigrationBuilder(func(old []byte) ([]byte, error) {
+				return append([]byte("fixed:"), old...), nil
+			}).InputCodec(codec.Raw).OutputCodec(codec.Raw),
+			inputDatabase: map[string][]byte{
+				"/apples": []byte("broken"),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": []byte("fixed:broken"),
+			},
+		},
+		"input type doesn't match codec": {
+			builder:     builder.NewMigrationBuilder(jsonToCBOR),
+			expectedErr: errors.New("input must be an unmarshallable CBOR struct"),
+		},
+		"reversible output type doesn't match codec": {
+			builder:     builder.NewMigrationBuilder(jsonToCBOR).Reversible(cborToJSON).InputCodec(codec.Raw),
+			expectedErr: errors.New("input must be a byte slice"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migration, err := data.builder.Build()
+			if data.expectedErr != nil {
+				require.EqualError(t, err, data.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			ds1 := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds1.Put(ctx, datastore.NewKey(key), value))
+			}
+			ds2 := datastore.NewMapDatastore()
+			_, err = migration.Up(ctx, ds1, ds2)
+			require.NoError(t, err)
+			require.Equal(t, data.expectedOutput, readAll(t, ds2))
+
+			if reversible, ok := migration.(versioning.ReversableDatastoreMigration); ok {
+				ds3 := datastore.NewMapDatastore()
+				_, err = reversible.Down(ctx, ds2, ds3)
+				require.NoError(t, err)
+				require.Equal(t, data.inputDatabase, readAll(t, ds3))
+			}
+		})
+	}
+}
+
+func cborData(t *testing.T, n int64) []byte {
+	count := cbg.CborInt(n)
+	data, err := cborutil.Dump(&count)
+	require.NoError(t, err)
+	return data
+}
+
+func readAll(t *testing.T, ds datastore.Batching) map[string][]byte {
+	res, err := ds.Query(context.Background(), query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	out := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		out[entry.Key] = entry.Value
+	}
+	return out
+}
+
+func TestRawMigrations(t *testing.T) {
+	ctx := context.Background()
+	prefix := []byte("fixed:")
+	fix := func(key datastore.Key, old []byte) ([]byte, error) {
+		if key.String() == "/rotten" {
+			return nil, errors.New("cannot be fixed")
+		}
+		return append(append([]byte{}, prefix...), old...), nil
+	}
+	unfix := func(key datastore.Key, fixed []byte) ([]byte, error) {
+		return bytes.TrimPrefix(fixed, prefix), nil
+	}
+	decrement := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c - 1
+		return &newCount, nil
+	}
+	testCases := map[string]struct {
+		builder        builder.Builder
+		inputDatabase  map[string][]byte
+		expectedOutput map[string][]byte
+		expectedErr    error
+		expectedDown   map[string][]byte
+	}{
+		"raw": {
+			builder: builder.NewRaw(fix),
+			inputDatabase: map[string][]byte{
+				"/apples":  {0x1b, 0x00},
+				"/oranges": []byte("oranges"),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples":  []byte("fixed:\x1b\x00"),
+				"/oranges": []byte("fixed:oranges"),
+			},
+		},
+		"raw, through NewMigrationBuilder": {
+			builder: builder.NewMigrationBuilder(fix).Reversible(unfix),
+			inputDatabase: map[string][]byte{
+				"/apples": []byte("apples"),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": []byte("fixed:apples"),
+			},
+			expectedDown: map[string][]byte{
+				"/apples": []byte("apples"),
+			},
+		},
+		"raw, reversible": {
+			builder: builder.NewRawReversible(fix, unfix),
+			inputDatabase: map[string][]byte{
+				"/apples": []byte("apples"),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": []byte("fixed:apples"),
+			},
+			expectedDown: map[string][]byte{
+				"/apples": []byte("apples"),
+			},
+		},
+		"raw, reversed with Reversible": {
+			builder: builder.NewRaw(fix).Reversible(versioning.RawMigrationFunc(unfix)),
+			inputDatabase: map[string][]byte{
+				"/apples": []byte("apples"),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": []byte("fixed:apples"),
+			},
+			expectedDown: map[string][]byte{
+				"/apples": []byte("apples"),
+			},
+		},
+		"raw, with key filtering": {
+			builder: builder.NewRaw(fix).FilterKeys([]string{"/oranges"}),
+			inputDatabase: map[string][]byte{
+				"/apples":  []byte("apples"),
+				"/oranges": []byte("oranges"),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": []byte("fixed:apples"),
+			},
+		},
+		"raw, transform error": {
+			builder: builder.NewRaw(fix),
+			inputDatabase: map[string][]byte{
+				"/apples": []byte("apples"),
+				"/rotten": []byte("rotten"),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": []byte("fixed:apples"),
+			},
+			expectedErr: errors.New("attempting to transform to new state '/rotten': cannot be fixed"),
+		},
+		"typed, reversed with a raw function": {
+			builder: builder.New(decrement).Reversible(func(key datastore.Key, _ []byte) ([]byte, error) {
+				return cborData(t, 0), nil
+			}),
+			inputDatabase: map[string][]byte{
+				"/apples": cborData(t, 30),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": cborData(t, 29),
+			},
+			expectedDown: map[string][]byte{
+				"/apples": cborData(t, 0),
+			},
+		},
+		"raw, reversed with a typed function": {
+			builder:     builder.NewRaw(fix).Reversible(decrement),
+			expectedErr: errors.New("reversible function does not have inverse types"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migration, err := data.builder.Build()
+			if data.inputDatabase == nil {
+				require.EqualError(t, err, data.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			ds1 := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds1.Put(ctx, datastore.NewKey(key), value))
+			}
+			ds2 := datastore.NewMapDatastore()
+			_, err = migration.Up(ctx, ds1, ds2)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+			require.Equal(t, data.expectedOutput, readAll(t, ds2))
+
+			reversible, ok := migration.(versioning.ReversableDatastoreMigration)
+			require.Equal(t, data.expectedDown != nil, ok)
+			if ok {
+				ds3 := datastore.NewMapDatastore()
+				_, err = reversible.Down(ctx, ds2, ds3)
+				require.NoError(t, err)
+				require.Equal(t, data.expectedDown, readAll(t, ds3))
+			}
+		})
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+	increment := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		if *c < 0 {
+			return nil, errors.New("negative deal")
+		}
+		newCount := *c + 1
+		return &newCount, nil
+	}
+	decrement := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c - 1
+		return &newCount, nil
+	}
+	toConfig := func(key datastore.Key, old []byte) ([]byte, error) {
+		return append([]byte("config:"), old...), nil
+	}
+	fromConfig := func(key datastore.Key, config []byte) ([]byte, error) {
+		return bytes.TrimPrefix(config, []byte("config:")), nil
+	}
+	testCases := map[string]struct {
+		builder        builder.Builder
+		inputDatabase  map[string][]byte
+		expectedOutput map[string][]byte
+		expectedKeys   []string
+		expectedErr    error
+		expectedDown   map[string][]byte
+	}{
+		"routes by prefix": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.New(increment)},
+				builder.Route{Match: builder.KeyPrefix("/config"), Migration: builder.NewRaw(toConfig)},
+			),
+			inputDatabase: map[string][]byte{
+				"/deals/1":     cborData(t, 1),
+				"/deals/2":     cborData(t, 2),
+				"/config/name": []byte("fruit"),
+				"/unknown":     []byte("unknown"),
+			},
+			expectedOutput: map[string][]byte{
+				"/deals/1":     cborData(t, 2),
+				"/deals/2":     cborData(t, 3),
+				"/config/name": []byte("config:fruit"),
+			},
+			expectedKeys: []string{"/config/name", "/deals/1", "/deals/2"},
+		},
+		"first matching route wins": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyGlob("/deals/special"), Migration: builder.NewRaw(toConfig)},
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.New(increment)},
+				builder.Route{Migration: builder.NewRaw(toConfig)},
+			),
+			inputDatabase: map[string][]byte{
+				"/deals/1":       cborData(t, 1),
+				"/deals/special": []byte("special"),
+				"/other":         []byte("other"),
+			},
+			expectedOutput: map[string][]byte{
+				"/deals/1":       cborData(t, 2),
+				"/deals/special": []byte("config:special"),
+				"/other":         []byte("config:other"),
+			},
+			expectedKeys: []string{"/deals/1", "/deals/special", "/other"},
+		},
+		"routes by predicate": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.Predicate(func(key datastore.Key, value []byte) bool {
+					return bytes.HasPrefix(value, []byte("name="))
+				}), Migration: builder.NewRaw(toConfig)},
+				builder.Route{Migration: builder.New(increment)},
+			),
+			inputDatabase: map[string][]byte{
+				"/1": cborData(t, 1),
+				"/2": []byte("name=fruit"),
+			},
+			expectedOutput: map[string][]byte{
+				"/1": cborData(t, 2),
+				"/2": []byte("config:name=fruit"),
+			},
+			expectedKeys: []string{"/1", "/2"},
+		},
+		"reversible when every route is": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.NewReversible(increment, decrement)},
+				builder.Route{Match: builder.KeyPrefix("/config"), Migration: builder.NewRawReversible(toConfig, fromConfig)},
+			),
+			inputDatabase: map[string][]byte{
+				"/deals/1":     cborData(t, 1),
+				"/config/name": []byte("fruit"),
+			},
+			expectedOutput: map[string][]byte{
+				"/deals/1":     cborData(t, 2),
+				"/config/name": []byte("config:fruit"),
+			},
+			expectedKeys: []string{"/config/name", "/deals/1"},
+			expectedDown: map[string][]byte{
+				"/deals/1":     cborData(t, 1),
+				"/config/name": []byte("fruit"),
+			},
+		},
+		"filters apply to every route": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.New(increment)},
+				builder.Route{Match: builder.KeyPrefix("/config"), Migration: builder.NewRaw(toConfig)},
+			).Exclude(builder.KeyGlob("/*/old")),
+			inputDatabase: map[string][]byte{
+				"/deals/1":     cborData(t, 1),
+				"/deals/old":   cborData(t, 1),
+				"/config/name": []byte("fruit"),
+				"/config/old":  []byte("old"),
+			},
+			expectedOutput: map[string][]byte{
+				"/deals/1":     cborData(t, 2),
+				"/config/name": []byte("config:fruit"),
+			},
+			expectedKeys: []string{"/config/name", "/deals/1"},
+		},
+		"route fails": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/config"), Migration: builder.NewRaw(toConfig)},
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.New(increment)},
+			),
+			inputDatabase: map[string][]byte{
+				"/deals/1":     cborData(t, -1),
+				"/config/name": []byte("fruit"),
+			},
+			expectedOutput: map[string][]byte{
+				"/config/name": []byte("config:fruit"),
+			},
+			// keys written by earlier routes are returned, so they are rolled back
+			expectedKeys: []string{"/config/name"},
+			expectedErr:  errors.New("route 1: attempting to transform to new state '/deals/1': negative deal"),
+		},
+		"no routes": {
+			builder:     builder.NewDispatch(),
+			expectedErr: errors.New("dispatch needs at least one route"),
+		},
+		"catch all route before the last": {
+			builder: builder.NewDispatch(
+				builder.Route{Migration: builder.NewRaw(toConfig)},
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.New(increment)},
+			),
+			expectedErr: errors.New("route 0 matches every record, so only the last route can leave out Match"),
+		},
+		"route build error": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.NewMigrationBuilder(7)},
+			),
+			expectedErr: errors.New("route 0: migration must be a function"),
+		},
+		"made reversible as a whole": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/deals"), Migration: builder.New(increment)},
+			).Reversible(decrement),
+			expectedErr: errors.New("dispatch migrations are made reversible route by route"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migration, err := data.builder.Build()
+			if data.inputDatabase == nil {
+				require.EqualError(t, err, data.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			ds1 := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds1.Put(ctx, datastore.NewKey(key), value))
+			}
+			ds2 := datastore.NewMapDatastore()
+			keys, err := migration.Up(ctx, ds1, ds2)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+			require.Equal(t, data.expectedOutput, readAll(t, ds2))
+			var keyStrings []string
+			for _, key := range keys {
+				keyStrings = append(keyStrings, key.String())
+			}
+			require.ElementsMatch(t, data.expectedKeys, keyStrings)
+
+			reversible, ok := migration.(versioning.ReversableDatastoreMigration)
+			require.Equal(t, data.expectedDown != nil, ok)
+			if ok {
+				ds3 := datastore.NewMapDatastore()
+				_, err = reversible.Down(ctx, ds2, ds3)
+				require.NoError(t, err)
+				require.Equal(t, data.expectedDown, readAll(t, ds3))
+			}
+		})
+	}
+}
+
+func TestAccessor(t *testing.T) {
+	ctx := context.Background()
+	// each deal's count names the price record to add to it
+	addPrice := func(c *cbg.CborInt, accessor versioning.Accessor) (*cbg.CborInt, error) {
+		var price cbg.CborInt
+		if err := accessor.Load(datastore.NewKey(fmt.Sprintf("/prices/%d", *c)), &price); err != nil {
+			return nil, err
+		}
+		newCount := *c + price
+		return &newCount, nil
+	}
+	addExternalPrice := func(c *cbg.CborInt, accessor versioning.Accessor) (*cbg.CborInt, error) {
+		prices, err := accessor.Store("prices")
+		if err != nil {
+			return nil, err
+		}
+		var price cbg.CborInt
+		if err := prices.Load(datastore.NewKey(fmt.Sprintf("/%d", *c)), &price); err != nil {
+			return nil, err
+		}
+		newCount := *c + price
+		return &newCount, nil
+	}
+	// on the way down, the accessor reads the namespace being migrated from
+	countDeals := func(c *cbg.CborInt, accessor versioning.Accessor) (*cbg.CborInt, error) {
+		res, err := accessor.Query(query.Query{Prefix: "/deals", KeysOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			return nil, err
+		}
+		count := cbg.CborInt(len(entries))
+		return &count, nil
+	}
+	prices := datastore.NewMapDatastore()
+	require.NoError(t, prices.Put(ctx, datastore.NewKey("/1"), cborData(t, 100)))
+	testCases := map[string]struct {
+		builder        builder.Builder
+		inputDatabase  map[string][]byte
+		expectedOutput map[string][]byte
+		expectedErr    error
+		expectedDown   map[string][]byte
+	}{
+		"reads other records in the old namespace": {
+			builder: builder.NewMigrationBuilder(addPrice).Select(builder.KeyPrefix("/deals")),
+			inputDatabase: map[string][]byte{
+				"/deals/a":  cborData(t, 1),
+				"/deals/b":  cborData(t, 2),
+				"/prices/1": cborData(t, 10),
+				"/prices/2": cborData(t, 20),
+			},
+			expectedOutput: map[string][]byte{
+				"/deals/a": cborData(t, 11),
+				"/deals/b": cborData(t, 22),
+			},
+		},
+		"reads other stores": {
+			builder: builder.NewMigrationBuilder(addExternalPrice).WithStore("prices", prices),
+			inputDatabase: map[string][]byte{
+				"/deals/a": cborData(t, 1),
+			},
+			expectedOutput: map[string][]byte{
+				"/deals/a": cborData(t, 101),
+			},
+		},
+		"reads the new namespace when reversed": {
+			builder: builder.NewMigrationBuilder(addPrice).Select(builder.KeyPrefix("/deals")).Reversible(countDeals),
+			inputDatabase: map[string][]byte{
+				"/deals/a":  cborData(t, 1),
+				"/deals/b":  cborData(t, 1),
+				"/prices/1": cborData(t, 10),
+			},
+			expectedOutput: map[string][]byte{
+				"/deals/a": cborData(t, 11),
+				"/deals/b": cborData(t, 11),
+			},
+			expectedDown: map[string][]byte{
+				"/deals/a": cborData(t, 2),
+				"/deals/b": cborData(t, 2),
+			},
+		},
+		"missing record": {
+			builder: builder.NewMigrationBuilder(addPrice).Select(builder.KeyPrefix("/deals")),
+			inputDatabase: map[string][]byte{
+				"/deals/a": cborData(t, 1),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/deals/a': datastore: key not found"),
+		},
+		"missing store": {
+			builder: builder.NewMigrationBuilder(addExternalPrice),
+			inputDatabase: map[string][]byte{
+				"/deals/a": cborData(t, 1),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/deals/a': no store named \"prices\""),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migration, err := data.builder.Build()
+			require.NoError(t, err)
+			ds1 := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds1.Put(ctx, datastore.NewKey(key), value))
+			}
+			ds2 := datastore.NewMapDatastore()
+			_, err = migration.Up(ctx, ds1, ds2)
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+			require.Equal(t, data.expectedOutput, readAll(t, ds2))
+
+			if data.expectedDown != nil {
+				ds3 := datastore.NewMapDatastore()
+				_, err = migration.(versioning.ReversableDatastoreMigration).Down(ctx, ds2, ds3)
+				require.NoError(t, err)
+				require.Equal(t, data.expectedDown, readAll(t, ds3))
+			}
+		})
+	}
+}
+
+func TestMigrateRecord(t *testing.T) {
+	ctx := context.Background()
+	toBytes := func(i int64) []byte {
+		buf := new(bytes.Buffer)
+		value := cbg.CborInt(i)
+		require.NoError(t, value.MarshalCBOR(buf))
+		return buf.Bytes()
+	}
+	addSeven := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	double := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c * 2
+		return &newCount, nil
+	}
+	testCases := map[string]struct {
+		builder          builder.Builder
+		key              string
+		expectedValue    []byte
+		expectedSelected bool
+	}{
+		"migrates a record": {
+			builder:          builder.NewMigrationBuilder(addSeven),
+			key:              "/apples",
+			expectedValue:    toBytes(12),
+			expectedSelected: true,
+		},
+		"leaves out filtered records": {
+			builder: builder.NewMigrationBuilder(addSeven).Exclude(builder.KeyPrefix("/apples")),
+			key:     "/apples",
+		},
+		"migrates a record with the route it matches": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/apples"), Migration: builder.NewMigrationBuilder(addSeven)},
+				builder.Route{Match: builder.KeyPrefix("/oranges"), Migration: builder.NewMigrationBuilder(double)},
+			),
+			key:              "/oranges/navel",
+			expectedValue:    toBytes(10),
+			expectedSelected: true,
+		},
+		"leaves out records no route matches": {
+			builder: builder.NewDispatch(
+				builder.Route{Match: builder.KeyPrefix("/apples"), Migration: builder.NewMigrationBuilder(addSeven)},
+			),
+			key: "/pears",
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migration, err := data.builder.Build()
+			require.NoError(t, err)
+			value, selected, err := migration.(versioning.RecordMigration).MigrateRecord(ctx, datastore.NewMapDatastore(), datastore.NewKey(data.key), toBytes(5))
+			require.NoError(t, err)
+			require.Equal(t, data.expectedSelected, selected)
+			require.Equal(t, data.expectedValue, value)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// Route sends the records that match a filter to their own migration
+type Route struct {
+	// Match selects the records for the migration, like KeyPrefix or Predicate.
+	// When migrating down, it sees records as the migration wrote them. If nil,
+	// it matches every record, which is useful for a final route that catches
+	// the records no other route matched
+	Match query.Filter
+	// Migration migrates the records the route matches
+	Migration Builder
+}
+
+// NewDispatch returns a builder for a migration that sends each record to the
+// first route that matches it, so a store that keeps several record types
+// under one namespace can migrate all of them in one step. Records no route
+// matches are not migrated. The migration is reversible if every route is, and
+// fails as a whole if any route fails.
+//
+// Calling FilterKeys, Only, Select, Exclude, WithStore, InputCodec or OutputCodec
+// on the dispatch builder applies to every route. Reversible can't be, since each
+// route has its own types -- make each route reversible instead
+func NewDispatch(routes ...Route) Builder {
+	if len(routes) == 0 {
+		return errorBuilder{errors.New("dispatch needs at least one route")}
+	}
+	for i, route := range routes {
+		if route.Migration == nil {
+			return errorBuilder{fmt.Errorf("route %d has no migration", i)}
+		}
+		if route.Match == nil && i < len(routes)-1 {
+			return errorBuilder{fmt.Errorf("route %d matches every record, so only the last route can leave out Match", i)}
+		}
+	}
+	return dispatchBuilder{routes}
+}
+
+type dispatchBuilder struct {
+	routes []Route
+}
+
+func (db dispatchBuilder) each(configure func(Builder) Builder) Builder {
+	routes := make([]Route, 0, len(db.routes))
+	for _, route := range db.routes {
+		routes = append(routes, Route{route.Match, configure(route.Migration)})
+	}
+	return dispatchBuilder{routes}
+}
+
+func (db dispatchBuilder) Reversible(versioning.MigrationFunc) Builder {
+	return errorBuilder{errors.New("dispatch migrations are made reversible route by route")}
+}
+
+func (db dispatchBuilder) FilterKeys(keys []string) Builder {
+	return db.each(func(b Builder) Builder { return b.FilterKeys(keys) })
+}
+
+func (db dispatchBuilder) Only(keys []string) Builder {
+	return db.each(func(b Builder) Builder { return b.Only(keys) })
+}
+
+func (db dispatchBuilder) Select(filters ...query.Filter) Builder {
+	return db.each(func(b Builder) Builder { return b.Select(filters...) })
+}
+
+func (db dispatchBuilder) Exclude(filters ...query.Filter) Builder {
+	return db.each(func(b Builder) Builder { return b.Exclude(filters...) })
+}
+
+func (db dispatchBuilder) WithStore(name string, ds datastore.Read) Builder {
+	return db.each(func(b Builder) Builder { return b.WithStore(name, ds) })
+}
+
+func (db dispatchBuilder) InputCodec(inputCodec versioning.Codec) Builder {
+	return db.each(func(b Builder) Builder { return b.InputCodec(inputCodec) })
+}
+
+func (db dispatchBuilder) OutputCodec(outputCodec versioning.Codec) Builder {
+	return db.each(func(b Builder) Builder { return b.OutputCodec(outputCodec) })
+}
+
+func (db dispatchBuilder) Build() (versioning.DatastoreMigration, error) {
+	var migrations []versioning.DatastoreMigration
+	var matched []query.Filter
+	var err error
+	reversible := true
+	for i, route := range db.routes {
+		// records matched by an earlier route never reach this one
+		routeBuilder := route.Migration.Exclude(matched...)
+		if route.Match != nil {
+			routeBuilder = routeBuilder.Select(route.Match)
+			matched = append(matched, route.Match)
+		}
+		migration, buildErr := routeBuilder.Build()
+		if buildErr != nil {
+			err = multierr.Append(err, fmt.Errorf("route %d: %w", i, buildErr))
+			continue
+		}
+		if _, ok := migration.(versioning.ReversableDatastoreMigration); !ok {
+			reversible = false
+		}
+		migrations = append(migrations, migration)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reversible {
+		return reversibleDispatchMigration{dispatchMigration{migrations}}, nil
+	}
+	return dispatchMigration{migrations}, nil
+}
+
+type dispatchMigration struct {
+	migrations []versioning.DatastoreMigration
+}
+
+// Up runs every route's migration. If one fails, it returns the keys every route
+// wrote so far, so they are all rolled back together
+func (dm dispatchMigration) Up(ctx context.Context, oldDs datastore.Batching, newDS datastore.Batching) ([]datastore.Key, error) {
+	var keys []datastore.Key
+	for i, migration := range dm.migrations {
+		routeKeys, err := migration.Up(ctx, oldDs, newDS)
+		keys = append(keys, routeKeys...)
+		if err != nil {
+			return keys, fmt.Errorf("route %d: %w", i, err)
+		}
+	}
+	return keys, nil
+}
+
+// MigrateRecord migrates a single record with the migration for the route it
+// matches
+func (dm dispatchMigration) MigrateRecord(ctx context.Context, oldDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error) {
+	for i, migration := range dm.migrations {
+		recordMigration, ok := migration.(versioning.RecordMigration)
+		if !ok {
+			return nil, false, fmt.Errorf("route %d: migration cannot migrate records one at a time", i)
+		}
+		migrated, selected, err := recordMigration.MigrateRecord(ctx, oldDs, key, value)
+		if err != nil {
+			return nil, false, fmt.Errorf("route %d: %w", i, err)
+		}
+		if selected {
+			return migrated, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+type reversibleDispatchMigration struct {
+	dispatchMigration
+}
+
+func (rdm reversibleDispatchMigration) Down(ctx context.Context, newDs datastore.Batching, oldDs datastore.Batching) ([]datastore.Key, error) {
+	var keys []datastore.Key
+	for i, migration := range rdm.migrations {
+		routeKeys, err := migration.(versioning.ReversableDatastoreMigration).Down(ctx, newDs, oldDs)
+		keys = append(keys, routeKeys...)
+		if err != nil {
+			return keys, fmt.Errorf("route %d: %w", i, err)
+		}
+	}
+	return keys, nil
+}
+
+// MigrateRecordDown migrates a single record back with the migration for the
+// route it matches
+func (rdm reversibleDispatchMigration) MigrateRecordDown(ctx context.Context, newDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error) {
+	for i, migration := range rdm.migrations {
+		recordMigration, ok := migration.(versioning.ReversibleRecordMigration)
+		if !ok {
+			return nil, false, fmt.Errorf("route %d: migration cannot migrate records back one at a time", i)
+		}
+		migrated, selected, err := recordMigration.MigrateRecordDown(ctx, newDs, key, value)
+		if err != nil {
+			return nil, false, fmt.Errorf("route %d: %w", i, err)
+		}
+		if selected {
+			return migrated, true, nil
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,123 @@
+package builder
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// KeyPrefix matches records whose key is the given key, or is under it
+func KeyPrefix(prefix string) query.Filter {
+	return keyPrefix{datastore.NewKey(prefix)}
+}
+
+type keyPrefix struct {
+	prefix datastore.Key
+}
+
+func (kp keyPrefix) Filter(e query.Entry) bool {
+	key := datastore.RawKey(e.Key)
+	return kp.prefix.Equal(key) || kp.prefix.IsAncestorOf(key)
+}
+
+func (kp keyPrefix) String() string {
+	return fmt.Sprintf("KEY PREFIX %s", kp.prefix)
+}
+
+// KeyGlob matches records whose key matches a shell pattern, as in path.Match.
+// A * matches within a single key component, so "/baskets/*" matches
+// "/baskets/1" but not "/baskets/1/fruit"
+func KeyGlob(pattern string) query.Filter {
+	return keyGlob{pattern}
+}
+
+type keyGlob struct {
+	pattern string
+}
+
+func (kg keyGlob) Filter(e query.Entry) bool {
+	matched, _ := path.Match(kg.pattern, e.Key)
+	return matched
+}
+
+func (kg keyGlob) String() string {
+	return fmt.Sprintf("KEY GLOB %s", kg.pattern)
+}
+
+func (kg keyGlob) check() error {
+	if _, err := path.Match(kg.pattern, ""); err != nil {
+		return fmt.Errorf("key glob %q: %w", kg.pattern, err)
+	}
+	return nil
+}
+
+// KeyRegexp matches records whose key matches a regular expression
+func KeyRegexp(re *regexp.Regexp) query.Filter {
+	return keyRegexp{re}
+}
+
+type keyRegexp struct {
+	re *regexp.Regexp
+}
+
+func (kr keyRegexp) Filter(e query.Entry) bool {
+	return kr.re.MatchString(e.Key)
+}
+
+func (kr keyRegexp) String() string {
+	return fmt.Sprintf("KEY REGEXP %s", kr.re)
+}
+
+// Predicate matches records for which the given function returns true. The
+// value is the record as stored, before it is migrated
+func Predicate(match func(key datastore.Key, value []byte) bool) query.Filter {
+	return predicate(match)
+}
+
+type predicate func(key datastore.Key, value []byte) bool
+
+func (p predicate) Filter(e query.Entry) bool {
+	return p(datastore.RawKey(e.Key), e.Value)
+}
+
+func (p predicate) String() string {
+	return "PREDICATE"
+}
+
+// anyOf matches records that match at least one of its filters
+type anyOf []query.Filter
+
+func (ao anyOf) Filter(e query.Entry) bool {
+	for _, f := range ao {
+		if f.Filter(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// noneOf matches records that match none of its filters
+type noneOf []query.Filter
+
+func (no noneOf) Filter(e query.Entry) bool {
+	return !anyOf(no).Filter(e)
+}
+
+// checker is implemented by filters that can be malformed
+type checker interface {
+	check() error
+}
+
+func checkFilters(filters []query.Filter) error {
+	for _, f := range filters {
+		if c, ok := f.(checker); ok {
+			if err := c.check(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Package codec provides the built in codecs for reading and writing the values
+// of records during migrations
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+// CBOR reads and writes records with the marshalling code cbor-gen generates.
+// It is the codec migrations use unless they are given another
+var CBOR versioning.Codec = cborCodec{}
+
+// JSON reads and writes records with encoding/json
+var JSON versioning.Codec = jsonCodec{}
+
+// Raw passes the bytes of records through unchanged, to and from migration
+// functions that take or return []byte
+var Raw versioning.Codec = rawCodec{}
+
+var (
+	unmarshalerType = reflect.TypeOf((*cbg.CBORUnmarshaler)(nil)).Elem()
+	marshalerType   = reflect.TypeOf((*cbg.CBORMarshaler)(nil)).Elem()
+	bytesType       = reflect.TypeOf([]byte(nil))
+)
+
+type cborCodec struct{}
+
+func (cborCodec) Decode(data []byte, v interface{}) error {
+	return cborutil.ReadCborRPC(bytes.NewReader(data), v)
+}
+
+func (cborCodec) Encode(v interface{}) ([]byte, error) {
+	return cborutil.Dump(v)
+}
+
+func (cborCodec) CheckDecode(t reflect.Type) error {
+	if !t.Implements(unmarshalerType) {
+		return errors.New("input must be an unmarshallable CBOR struct")
+	}
+	return nil
+}
+
+func (cborCodec) CheckEncode(t reflect.Type) error {
+	if !t.Implements(marshalerType) {
+		return errors.New("first output must be an marshallable CBOR struct")
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Decode(data []byte, v interface{}) error {
+	out, ok := v.(*[]byte)
+	if !ok {
+		return errors.New("raw values can only be read into a byte slice")
+	}
+	*out = data
+	return nil
+}
+
+func (rawCodec) Encode(v interface{}) ([]byte, error) {
+	switch data := v.(type) {
+	case []byte:
+		return data, nil
+	case *[]byte:
+		if data == nil {
+			return nil, errors.New("cannot write a nil raw value")
+		}
+		return *data, nil
+	default:
+		return nil, errors.New("raw values must be byte slices")
+	}
+}
+
+func (rawCodec) CheckDecode(t reflect.Type) error {
+	return checkBytes(t, "input must be a byte slice")
+}
+
+func (rawCodec) CheckEncode(t reflect.Type) error {
+	return checkBytes(t, "first output must be a byte slice")
+}
+
+func checkBytes(t reflect.Type, msg string) error {
+	if t == bytesType || (t.Kind() == reflect.Ptr && t.Elem() == bytesType) {
+		return nil
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,106 @@
+package codec_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/codec"
+)
+
+type fruit struct {
+	Name  string
+	Count int
+}
+
+func TestRoundTrip(t *testing.T) {
+	count := cbg.CborInt(7)
+	raw := []byte("not cbor")
+	testCases := map[string]struct {
+		codec    versioning.Codec
+		value    interface{}
+		newValue func() interface{}
+	}{
+		"cbor": {
+			codec:    codec.CBOR,
+			value:    &count,
+			newValue: func() interface{} { return new(cbg.CborInt) },
+		},
+		"json": {
+			codec:    codec.JSON,
+			value:    &fruit{Name: "apple", Count: 3},
+			newValue: func() interface{} { return new(fruit) },
+		},
+		"raw": {
+			codec:    codec.Raw,
+			value:    &raw,
+			newValue: func() interface{} { return new([]byte) },
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			encoded, err := data.codec.Encode(data.value)
+			require.NoError(t, err)
+			decoded := data.newValue()
+			err = data.codec.Decode(encoded, decoded)
+			require.NoError(t, err)
+			require.Equal(t, data.value, decoded)
+		})
+	}
+}
+
+func TestCheckTypes(t *testing.T) {
+	testCases := map[string]struct {
+		codec             versioning.Codec
+		recordType        reflect.Type
+		expectedDecodeErr error
+		expectedEncodeErr error
+	}{
+		"cbor, cbor-gen type": {
+			codec:      codec.CBOR,
+			recordType: reflect.TypeOf(new(cbg.CborInt)),
+		},
+		"cbor, other type": {
+			codec:             codec.CBOR,
+			recordType:        reflect.TypeOf(new(fruit)),
+			expectedDecodeErr: errors.New("input must be an unmarshallable CBOR struct"),
+			expectedEncodeErr: errors.New("first output must be an marshallable CBOR struct"),
+		},
+		"raw, byte slice": {
+			codec:      codec.Raw,
+			recordType: reflect.TypeOf([]byte(nil)),
+		},
+		"raw, pointer to byte slice": {
+			codec:      codec.Raw,
+			recordType: reflect.TypeOf(new([]byte)),
+		},
+		"raw, other type": {
+			codec:             codec.Raw,
+			recordType:        reflect.TypeOf(""),
+			expectedDecodeErr: errors.New("input must be a byte slice"),
+			expectedEncodeErr: errors.New("first output must be a byte slice"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			checker, ok := data.codec.(versioning.CodecTypeChecker)
+			require.True(t, ok)
+			err := checker.CheckDecode(data.recordType)
+			if data.expectedDecodeErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedDecodeErr.Error())
+			}
+			err = checker.CheckEncode(data.recordType)
+			if data.expectedEncodeErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, data.expectedEncodeErr.Error())
+			}
+		})
+	}
+}
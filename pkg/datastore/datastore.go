@@ -5,94 +5,254 @@ package datastore
 
 import (
 	"context"
+	"fmt"
 
 	datastore "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
 	"github.com/ipfs/go-datastore/query"
 
+	"github.com/filecoin-project/go-ds-versioning/internal/bluegreen"
+	"github.com/filecoin-project/go-ds-versioning/internal/compat"
+	"github.com/filecoin-project/go-ds-versioning/internal/lazy"
 	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/online"
 	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	"github.com/filecoin-project/go-ds-versioning/internal/stale"
+	"github.com/filecoin-project/go-ds-versioning/internal/utils"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 )
 
 type migratedDatastore struct {
-	ds datastore.Batching
-	ms versioning.MigrationState
+	ds   datastore.Batching
+	gate utils.ReadyGate
+	// stale serves reads until migrations are complete, if set
+	stale datastore.Batching
+	// compat serves reads when migrations leave the datastore at a newer
+	// version that this code can read but not write
+	compat *compat.Datastore
 }
 
 // NewVersionedDatastore sets takes a datastore, migrations, list, and target version, and returns
-// a datastore whose functions will fail till it's migrated to the target version and a function to run migrations
-func NewVersionedDatastore(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (datastore.Batching, func(context.Context) error) {
-	r := runner.NewRunner(ds, migrations, target, migrate.To)
-	return NewMigratedDatastore(namespace.Wrap(ds, datastore.NewKey(string(target))), r), r.Migrate
+// a datastore whose functions will fail till it's migrated to the target version and a function to run migrations.
+// If the migration to the target version declares indexes, the datastore keeps them up to date as
+// records are written, and implements versioning.IndexQuerier. With versioning.LazyMigration, records
+// are migrated as they're read, and the datastore implements versioning.Sweeper. With
+// versioning.OnlineMigration, the datastore stays usable while migrations run. With versioning.StaleReads,
+// reads are served from the previous version until migrations are complete. With versioning.BlueGreen,
+// the datastore implements versioning.Promoter
+func NewVersionedDatastore(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey, opts ...versioning.Option) (datastore.Batching, func(context.Context) error) {
+	m := migrate.NewMigrator(opts...)
+	bind := func(version versioning.VersionKey) datastore.Batching {
+		if indexes := migrate.IndexesFor(migrations, version); len(indexes) > 0 {
+			return NewIndexedDatastore(ds, version, indexes, opts...)
+		}
+		return namespace.Wrap(ds, datastore.NewKey(string(version)))
+	}
+	versionDs := bind(target)
+	cfg := versioning.NewConfig(opts...)
+	compatDs := compat.NewDatastore(ds)
+	var r *runner.Runner
+	var ms versioning.MigrationState
+	switch {
+	case cfg.LazyMigration:
+		lazyDs := lazy.NewDatastore(ds, versionDs)
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(lazyDs.RunMigrations(m)), opts...)
+		versionDs, ms = lazyDs, r
+	case cfg.OnlineMigration:
+		onlineDs := online.NewDatastore(versionDs)
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(onlineDs.RunMigrations(m)), opts...)
+		versionDs, ms = onlineDs, onlineDs.MigrationState(r)
+	case cfg.BlueGreen:
+		blueGreenDs := bluegreen.NewDatastore(ds, migrations, target, m, bind)
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(blueGreenDs.RunMigrations(m)), opts...)
+		versionDs, ms = blueGreenDs, r
+	default:
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(m.To), opts...)
+		ms = r
+	}
+	migratedDs := &migratedDatastore{ds: versionDs, gate: utils.NewReadyGate(ms, cfg), compat: compatDs}
+	if cfg.StaleReads {
+		migratedDs.stale = stale.NewDatastore(ds, migrations, target, ms, opts...)
+	}
+	return migratedDs, r.Migrate
 }
 
 // NewMigratedDatastore returns a datastore whose functions will fail until the migration state says its ready
-func NewMigratedDatastore(ds datastore.Batching, ms versioning.MigrationState) datastore.Batching {
-	return &migratedDatastore{ds, ms}
+func NewMigratedDatastore(ds datastore.Batching, ms versioning.MigrationState, opts ...versioning.Option) datastore.Batching {
+	return &migratedDatastore{ds: ds, gate: utils.NewReadyGate(ms, versioning.NewConfig(opts...))}
+}
+
+// reader returns the datastore to read from, which is the stale view of the
+// datastore when there is one and migrations are not yet complete, or the newer
+// version the datastore was left at when this code can only read it
+func (ds *migratedDatastore) reader(ctx context.Context) (datastore.Read, error) {
+	if ds.stale == nil {
+		if err := ds.gate.Ready(ctx); err != nil {
+			return ds.ds, err
+		}
+	} else if err := ds.gate.ReadyNow(); err != nil {
+		return ds.stale, nil
+	}
+	if ds.compat != nil && ds.compat.Reading() {
+		return ds.compat, nil
+	}
+	return ds.ds, nil
+}
+
+// writable returns an error if the datastore can't be written, because
+// migrations are not yet complete or left it at a version this code can only read
+func (ds *migratedDatastore) writable(ctx context.Context) error {
+	if err := ds.gate.Ready(ctx); err != nil {
+		return err
+	}
+	if ds.compat != nil {
+		return ds.compat.Writable()
+	}
+	return nil
 }
 
 func (ds *migratedDatastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
-	if err := ds.ms.ReadyError(); err != nil {
+	reader, err := ds.reader(ctx)
+	if err != nil {
 		return nil, err
 	}
-	return ds.ds.Get(ctx, key)
+	return reader.Get(ctx, key)
 }
 
 func (ds *migratedDatastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
-	if err := ds.ms.ReadyError(); err != nil {
+	reader, err := ds.reader(ctx)
+	if err != nil {
 		return false, err
 	}
-	return ds.ds.Has(ctx, key)
+	return reader.Has(ctx, key)
 }
 
 func (ds *migratedDatastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
-	if err := ds.ms.ReadyError(); err != nil {
+	reader, err := ds.reader(ctx)
+	if err != nil {
 		return 0, err
 	}
-	return ds.ds.GetSize(ctx, key)
+	return reader.GetSize(ctx, key)
 }
 
 func (ds *migratedDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
-	if err := ds.ms.ReadyError(); err != nil {
+	reader, err := ds.reader(ctx)
+	if err != nil {
 		return nil, err
 	}
-	return ds.ds.Query(ctx, q)
+	return reader.Query(ctx, q)
 }
 
 func (ds *migratedDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
-	if err := ds.ms.ReadyError(); err != nil {
+	if err := ds.writable(ctx); err != nil {
 		return err
 	}
 	return ds.ds.Put(ctx, key, value)
 }
 
 func (ds *migratedDatastore) Delete(ctx context.Context, key datastore.Key) error {
-	if err := ds.ms.ReadyError(); err != nil {
+	if err := ds.writable(ctx); err != nil {
 		return err
 	}
 	return ds.ds.Delete(ctx, key)
 }
 
 func (ds *migratedDatastore) Sync(ctx context.Context, prefix datastore.Key) error {
-	if err := ds.ms.ReadyError(); err != nil {
+	if err := ds.gate.Ready(ctx); err != nil {
 		return err
 	}
 	return ds.ds.Sync(ctx, prefix)
 }
 
 func (ds *migratedDatastore) Close() error {
-	if err := ds.ms.ReadyError(); err != nil {
+	if err := ds.gate.ReadyWithTimeout(); err != nil {
 		return err
 	}
 	return ds.ds.Close()
 }
 
 func (ds *migratedDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
-	if err := ds.ms.ReadyError(); err != nil {
+	if err := ds.writable(ctx); err != nil {
 		return nil, err
 	}
 	return ds.ds.Batch(ctx)
 }
 
 var _ datastore.Batching = &migratedDatastore{}
+
+// Retry runs migrations again if they failed previously
+func (ds *migratedDatastore) Retry(ctx context.Context) error {
+	return ds.gate.Retry(ctx)
+}
+
+// Cancel stops running migrations and rolls back the partially migrated version step
+func (ds *migratedDatastore) Cancel(ctx context.Context) error {
+	return ds.gate.Cancel(ctx)
+}
+
+// GetIndexEntry returns the value of a single entry in an index, if the datastore
+// keeps indexes
+func (ds *migratedDatastore) GetIndexEntry(ctx context.Context, index string, key datastore.Key) ([]byte, error) {
+	if err := ds.gate.Ready(ctx); err != nil {
+		return nil, err
+	}
+	indexed, ok := ds.ds.(versioning.IndexQuerier)
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", index)
+	}
+	return indexed.GetIndexEntry(ctx, index, key)
+}
+
+// QueryIndex runs a query over the entries of an index, if the datastore keeps indexes
+func (ds *migratedDatastore) QueryIndex(ctx context.Context, index string, q query.Query) (query.Results, error) {
+	if err := ds.gate.Ready(ctx); err != nil {
+		return nil, err
+	}
+	indexed, ok := ds.ds.(versioning.IndexQuerier)
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", index)
+	}
+	return indexed.QueryIndex(ctx, index, q)
+}
+
+// WaitSwept waits for records still at the previous version to be migrated, when
+// the datastore is migrated lazily
+func (ds *migratedDatastore) WaitSwept(ctx context.Context) error {
+	sweeper, ok := ds.ds.(versioning.Sweeper)
+	if !ok {
+		return nil
+	}
+	return sweeper.WaitSwept(ctx)
+}
+
+// Stage builds the next version alongside the current one, if the datastore can
+// stage and promote versions
+func (ds *migratedDatastore) Stage(ctx context.Context, version versioning.VersionKey) error {
+	if err := ds.writable(ctx); err != nil {
+		return err
+	}
+	promoter, ok := ds.ds.(versioning.Promoter)
+	if !ok {
+		return versioning.ErrPromoteNotSupported
+	}
+	return promoter.Stage(ctx, version)
+}
+
+// Promote switches the datastore to a staged version, if the datastore can stage
+// and promote versions
+func (ds *migratedDatastore) Promote(ctx context.Context, version versioning.VersionKey) error {
+	if err := ds.writable(ctx); err != nil {
+		return err
+	}
+	promoter, ok := ds.ds.(versioning.Promoter)
+	if !ok {
+		return versioning.ErrPromoteNotSupported
+	}
+	return promoter.Promote(ctx, version)
+}
+
+var _ versioning.Retrier = &migratedDatastore{}
+var _ versioning.Canceller = &migratedDatastore{}
+var _ versioning.IndexQuerier = &migratedDatastore{}
+var _ versioning.Sweeper = &migratedDatastore{}
+var _ versioning.Promoter = &migratedDatastore{}
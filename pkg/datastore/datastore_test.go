@@ -3,15 +3,18 @@ package datastore_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing"
 
 	datastore "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/stretchr/testify/require"
 	cbg "github.com/whyrusleeping/cbor-gen"
 
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	versioned "github.com/filecoin-project/go-ds-versioning/pkg/datastore"
+	versionedbuilder "github.com/filecoin-project/go-ds-versioning/pkg/versioned"
 )
 
 func TestDatastore(t *testing.T) {
@@ -197,3 +200,171 @@ func toBytes(t *testing.T, val cbg.CBORMarshaler) []byte {
 	require.NoError(t, err)
 	return buf.Bytes()
 }
+
+func TestVersionedDatastoreLazy(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versionedbuilder.BuilderList{
+		versionedbuilder.NewVersionedBuilder(addMigration, "1"),
+		versionedbuilder.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	// records are swept in the background, so the datastore has to be safe for concurrent use
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	oldDs, migrate := versioned.NewVersionedDatastore(ds, migrations, "1")
+	require.NoError(t, migrate(ctx))
+	require.NoError(t, oldDs.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(7))))
+
+	lazyDs, migrate := versioned.NewVersionedDatastore(ds, migrations, "2", versioning.LazyMigration())
+	require.NoError(t, migrate(ctx))
+	val, err := lazyDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+	require.NoError(t, lazyDs.(versioning.Sweeper).WaitSwept(ctx))
+	has, err := ds.Has(ctx, datastore.NewKey("/1/apples"))
+	require.NoError(t, err)
+	require.False(t, has)
+	val, err = ds.Get(ctx, datastore.NewKey("/2/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+}
+
+func TestVersionedDatastoreStaleReads(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versionedbuilder.BuilderList{
+		versionedbuilder.NewVersionedBuilder(addMigration, "1"),
+		versionedbuilder.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	oldDs, migrate := versioned.NewVersionedDatastore(ds, migrations, "1")
+	require.NoError(t, migrate(ctx))
+	require.NoError(t, oldDs.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(7))))
+
+	staleDs, migrate := versioned.NewVersionedDatastore(ds, migrations, "2", versioning.StaleReads())
+	val, err := staleDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+	has, err := staleDs.Has(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	require.True(t, has)
+	res, err := staleDs.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	checkInt(t, entries[0].Value, 14)
+	err = staleDs.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(1)))
+	require.EqualError(t, err, versioning.ErrMigrationsNotRun.Error())
+
+	require.NoError(t, migrate(ctx))
+	require.NoError(t, staleDs.Put(ctx, datastore.NewKey("/oranges"), toBytes(t, newInt(1))))
+	val, err = staleDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+	has, err = ds.Has(ctx, datastore.NewKey("/1/apples"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestVersionedDatastoreReadableNewer(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	builders := versionedbuilder.BuilderList{
+		versionedbuilder.NewVersionedBuilder(addMigration, "1"),
+		versionedbuilder.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}
+	oldMigrations, err := builders.Build()
+	require.NoError(t, err)
+	newMigrations, err := append(builders, versionedbuilder.NewVersionedBuilder(addMigration, "3").OldVersion("2")).Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	newDs, migrate := versioned.NewVersionedDatastore(ds, newMigrations, "3", versioning.MinReaderVersion("2"))
+	require.NoError(t, migrate(ctx))
+	require.NoError(t, newDs.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(7))))
+
+	oldDs, migrate := versioned.NewVersionedDatastore(ds, oldMigrations, "2")
+	require.NoError(t, migrate(ctx))
+	val, err := oldDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 7)
+	res, err := oldDs.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	err = oldDs.Put(ctx, datastore.NewKey("/oranges"), toBytes(t, newInt(1)))
+	require.True(t, errors.Is(err, versioning.ErrStoreTooNew))
+	_, err = oldDs.Batch(ctx)
+	require.True(t, errors.Is(err, versioning.ErrStoreTooNew))
+
+	// code that doesn't understand the minimum reader version can't read it
+	_, migrate = versioned.NewVersionedDatastore(ds, oldMigrations, "1")
+	require.True(t, errors.Is(migrate(ctx), versioning.ErrStoreTooNew))
+}
+
+func TestVersionedDatastoreBlueGreen(t *testing.T) {
+	ctx := context.Background()
+	addMigration := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	migrations, err := versionedbuilder.BuilderList{
+		versionedbuilder.NewVersionedBuilder(addMigration, "1"),
+		versionedbuilder.NewVersionedBuilder(addMigration, "2").OldVersion("1"),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	liveDs, migrate := versioned.NewVersionedDatastore(ds, migrations, "1", versioning.BlueGreen())
+	require.NoError(t, migrate(ctx))
+	require.NoError(t, liveDs.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(7))))
+
+	promoter := liveDs.(versioning.Promoter)
+	require.NoError(t, promoter.Stage(ctx, "2"))
+	val, err := ds.Get(ctx, datastore.NewKey("/2/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+	val, err = liveDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 7)
+
+	require.NoError(t, promoter.Promote(ctx, "2"))
+	val, err = liveDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+	has, err := ds.Has(ctx, datastore.NewKey("/1/apples"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// migrating again keeps the store at the promoted version
+	require.NoError(t, migrate(ctx))
+	val, err = liveDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+
+	// restarting keeps the store at the promoted version too
+	restartedDs, migrate := versioned.NewVersionedDatastore(ds, migrations, "1", versioning.BlueGreen())
+	require.NoError(t, migrate(ctx))
+	val, err = restartedDs.Get(ctx, datastore.NewKey("/apples"))
+	require.NoError(t, err)
+	checkInt(t, val, 14)
+
+	plainDs, migrate := versioned.NewVersionedDatastore(datastore.NewMapDatastore(), migrations, "1")
+	require.NoError(t, migrate(ctx))
+	err = plainDs.(versioning.Promoter).Promote(ctx, "2")
+	require.EqualError(t, err, versioning.ErrPromoteNotSupported.Error())
+}
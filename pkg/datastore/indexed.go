@@ -0,0 +1,248 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+)
+
+type index struct {
+	versioning.Index
+	prefix datastore.Key
+	ds     datastore.Batching
+}
+
+type indexedDatastore struct {
+	// lk is held from reading the values writes replace until their batch is
+	// committed, so concurrent writes never update indexes from a stale value
+	lk      sync.Mutex
+	ds      datastore.Batching
+	prefix  datastore.Key
+	records datastore.Batching
+	indexes []index
+}
+
+// NewIndexedDatastore returns a datastore over the records at a version, which
+// updates the version's indexes in the same batch as every record it writes or
+// deletes. Indexes must already be built for the records stored at the version
+func NewIndexedDatastore(ds datastore.Batching, version versioning.VersionKey, indexes []versioning.Index, opts ...versioning.Option) datastore.Batching {
+	m := migrate.NewMigrator(opts...)
+	prefix := datastore.NewKey(string(version))
+	ids := &indexedDatastore{ds: ds, prefix: prefix, records: namespace.Wrap(ds, prefix)}
+	for _, idx := range indexes {
+		indexPrefix := m.IndexNamespace(version, idx.Name)
+		ids.indexes = append(ids.indexes, index{idx, indexPrefix, namespace.Wrap(ds, indexPrefix)})
+	}
+	return ids
+}
+
+func (ids *indexedDatastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	return ids.records.Get(ctx, key)
+}
+
+func (ids *indexedDatastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	return ids.records.Has(ctx, key)
+}
+
+func (ids *indexedDatastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	return ids.records.GetSize(ctx, key)
+}
+
+func (ids *indexedDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	return ids.records.Query(ctx, q)
+}
+
+func (ids *indexedDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return ids.commit(ctx, []indexedWrite{{key: key, value: value}})
+}
+
+func (ids *indexedDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	return ids.commit(ctx, []indexedWrite{{key: key, delete: true}})
+}
+
+func (ids *indexedDatastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	if err := ids.records.Sync(ctx, prefix); err != nil {
+		return err
+	}
+	for _, idx := range ids.indexes {
+		if err := idx.ds.Sync(ctx, datastore.NewKey("")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ids *indexedDatastore) Close() error {
+	return ids.records.Close()
+}
+
+func (ids *indexedDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return &indexedBatch{ids: ids}, nil
+}
+
+var _ datastore.Batching = &indexedDatastore{}
+
+// GetIndexEntry returns the value of a single entry in an index
+func (ids *indexedDatastore) GetIndexEntry(ctx context.Context, name string, key datastore.Key) ([]byte, error) {
+	idx, err := ids.index(name)
+	if err != nil {
+		return nil, err
+	}
+	return idx.ds.Get(ctx, key)
+}
+
+// QueryIndex runs a query over the entries of an index
+func (ids *indexedDatastore) QueryIndex(ctx context.Context, name string, q query.Query) (query.Results, error) {
+	idx, err := ids.index(name)
+	if err != nil {
+		return nil, err
+	}
+	return idx.ds.Query(ctx, q)
+}
+
+var _ versioning.IndexQuerier = &indexedDatastore{}
+
+func (ids *indexedDatastore) index(name string) (index, error) {
+	for _, idx := range ids.indexes {
+		if idx.Name == name {
+			return idx, nil
+		}
+	}
+	return index{}, fmt.Errorf("no index named %q", name)
+}
+
+// commit applies writes to records in order, along with the changes they make to
+// the indexes, in a single batch of the underlying datastore
+func (ids *indexedDatastore) commit(ctx context.Context, writes []indexedWrite) error {
+	ids.lk.Lock()
+	defer ids.lk.Unlock()
+	batch, err := ids.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	staged := &stagedWrites{ds: ids.ds, batch: batch, values: make(map[datastore.Key]stagedValue)}
+	for _, write := range writes {
+		if err := ids.write(ctx, staged, write); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(ctx)
+}
+
+// write stages a single write to a record, removing the index entries for its
+// old value and adding the ones for its new value
+func (ids *indexedDatastore) write(ctx context.Context, staged *stagedWrites, write indexedWrite) error {
+	recordKey := ids.prefix.Child(write.key)
+	old, exists, err := staged.get(ctx, recordKey)
+	if err != nil {
+		return err
+	}
+	for _, idx := range ids.indexes {
+		if exists {
+			oldEntries, err := idx.Entries(write.key, old)
+			if err != nil {
+				return fmt.Errorf("updating index %q for key '%s': %w", idx.Name, write.key, err)
+			}
+			for _, entry := range oldEntries {
+				if err := staged.delete(ctx, idx.prefix.Child(entry.Key)); err != nil {
+					return err
+				}
+			}
+		}
+		if write.delete {
+			continue
+		}
+		newEntries, err := idx.Entries(write.key, write.value)
+		if err != nil {
+			return fmt.Errorf("updating index %q for key '%s': %w", idx.Name, write.key, err)
+		}
+		for _, entry := range newEntries {
+			entryKey := idx.prefix.Child(entry.Key)
+			_, taken, err := staged.get(ctx, entryKey)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return fmt.Errorf("updating index %q for key '%s': another record already indexes to '%s'", idx.Name, write.key, entry.Key)
+			}
+			if err := staged.put(ctx, entryKey, entry.Value); err != nil {
+				return err
+			}
+		}
+	}
+	if write.delete {
+		return staged.delete(ctx, recordKey)
+	}
+	return staged.put(ctx, recordKey, write.value)
+}
+
+type indexedWrite struct {
+	key    datastore.Key
+	value  []byte
+	delete bool
+}
+
+type stagedValue struct {
+	value   []byte
+	deleted bool
+}
+
+// stagedWrites adds writes to a batch, remembering them so later writes in the
+// same batch see the values earlier ones left
+type stagedWrites struct {
+	ds     datastore.Read
+	batch  datastore.Batch
+	values map[datastore.Key]stagedValue
+}
+
+func (sw *stagedWrites) get(ctx context.Context, key datastore.Key) ([]byte, bool, error) {
+	if staged, ok := sw.values[key]; ok {
+		return staged.value, !staged.deleted, nil
+	}
+	value, err := sw.ds.Get(ctx, key)
+	if err == datastore.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (sw *stagedWrites) put(ctx context.Context, key datastore.Key, value []byte) error {
+	sw.values[key] = stagedValue{value: value}
+	return sw.batch.Put(ctx, key, value)
+}
+
+func (sw *stagedWrites) delete(ctx context.Context, key datastore.Key) error {
+	sw.values[key] = stagedValue{deleted: true}
+	return sw.batch.Delete(ctx, key)
+}
+
+// indexedBatch holds writes until it is committed, since updating the indexes
+// depends on what each record held before
+type indexedBatch struct {
+	ids    *indexedDatastore
+	writes []indexedWrite
+}
+
+func (ib *indexedBatch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	ib.writes = append(ib.writes, indexedWrite{key: key, value: value})
+	return nil
+}
+
+func (ib *indexedBatch) Delete(ctx context.Context, key datastore.Key) error {
+	ib.writes = append(ib.writes, indexedWrite{key: key, delete: true})
+	return nil
+}
+
+func (ib *indexedBatch) Commit(ctx context.Context) error {
+	return ib.ids.commit(ctx, ib.writes)
+}
@@ -0,0 +1,282 @@
+package datastore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	versioned "github.com/filecoin-project/go-ds-versioning/pkg/datastore"
+	versionedbuilder "github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+func TestIndexedDatastore(t *testing.T) {
+	ctx := context.Background()
+	// indexes records by their count, pointing back to the record's key
+	byCount := versioning.Index{Name: "byCount", Entries: versionedbuilder.TypedIndex(func(key datastore.Key, c *cbg.CborInt) ([]versioning.IndexEntry, error) {
+		if *c < 0 {
+			return nil, errors.New("negative count")
+		}
+		if *c == 0 {
+			return nil, nil
+		}
+		return []versioning.IndexEntry{{Key: datastore.NewKey(fmt.Sprint(*c)), Value: key.Bytes()}}, nil
+	})}
+	testCases := map[string]struct {
+		inputDatabase          map[string][]byte
+		test                   func(t *testing.T, ds datastore.Batching)
+		expectedOutputDatabase map[string][]byte
+	}{
+		"Put adds entries": {
+			test: func(t *testing.T, ds datastore.Batching) {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(7))))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+			},
+		},
+		"Put replaces entries for the old value": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(8))))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(8)),
+				"/versions/indexes/1/byCount/8": []byte("/apples"),
+			},
+		},
+		"Put with no entries": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(0))))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/1/apples": toBytes(t, newInt(0)),
+			},
+		},
+		"Put, index error": {
+			test: func(t *testing.T, ds datastore.Batching) {
+				err := ds.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(-1)))
+				require.EqualError(t, err, "updating index \"byCount\" for key '/apples': negative count")
+			},
+			expectedOutputDatabase: map[string][]byte{},
+		},
+		"Put, entry taken by another record": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				err := ds.Put(ctx, datastore.NewKey("/oranges"), toBytes(t, newInt(7)))
+				require.EqualError(t, err, "updating index \"byCount\" for key '/oranges': another record already indexes to '/7'")
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+			},
+		},
+		"Delete removes entries": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/1/oranges":                    toBytes(t, newInt(3)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+				"/versions/indexes/1/byCount/3": []byte("/oranges"),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				require.NoError(t, ds.Delete(ctx, datastore.NewKey("/apples")))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/1/oranges":                    toBytes(t, newInt(3)),
+				"/versions/indexes/1/byCount/3": []byte("/oranges"),
+			},
+		},
+		"Batch sees its own writes": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				batch, err := ds.Batch(ctx)
+				require.NoError(t, err)
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(8))))
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/oranges"), toBytes(t, newInt(7))))
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/pears"), toBytes(t, newInt(2))))
+				require.NoError(t, batch.Delete(ctx, datastore.NewKey("/pears")))
+				require.NoError(t, batch.Commit(ctx))
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(8)),
+				"/1/oranges":                    toBytes(t, newInt(7)),
+				"/versions/indexes/1/byCount/8": []byte("/apples"),
+				"/versions/indexes/1/byCount/7": []byte("/oranges"),
+			},
+		},
+		"Batch fails as a whole": {
+			test: func(t *testing.T, ds datastore.Batching) {
+				batch, err := ds.Batch(ctx)
+				require.NoError(t, err)
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(7))))
+				require.NoError(t, batch.Put(ctx, datastore.NewKey("/oranges"), toBytes(t, newInt(7))))
+				err = batch.Commit(ctx)
+				require.EqualError(t, err, "updating index \"byCount\" for key '/oranges': another record already indexes to '/7'")
+			},
+			expectedOutputDatabase: map[string][]byte{},
+		},
+		"QueryIndex and GetIndexEntry": {
+			inputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/1/oranges":                    toBytes(t, newInt(3)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+				"/versions/indexes/1/byCount/3": []byte("/oranges"),
+			},
+			test: func(t *testing.T, ds datastore.Batching) {
+				indexed := ds.(versioning.IndexQuerier)
+				value, err := indexed.GetIndexEntry(ctx, "byCount", datastore.NewKey("/3"))
+				require.NoError(t, err)
+				require.Equal(t, []byte("/oranges"), value)
+				results, err := indexed.QueryIndex(ctx, "byCount", query.Query{Orders: []query.Order{query.OrderByKey{}}})
+				require.NoError(t, err)
+				entries, err := results.Rest()
+				require.NoError(t, err)
+				require.Len(t, entries, 2)
+				require.Equal(t, "/3", entries[0].Key)
+				require.Equal(t, "/7", entries[1].Key)
+				_, err = indexed.QueryIndex(ctx, "byColor", query.Query{})
+				require.EqualError(t, err, "no index named \"byColor\"")
+			},
+			expectedOutputDatabase: map[string][]byte{
+				"/1/apples":                     toBytes(t, newInt(7)),
+				"/1/oranges":                    toBytes(t, newInt(3)),
+				"/versions/indexes/1/byCount/7": []byte("/apples"),
+				"/versions/indexes/1/byCount/3": []byte("/oranges"),
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey(key), value))
+			}
+			data.test(t, versioned.NewIndexedDatastore(ds, "1", []versioning.Index{byCount}))
+			res, err := ds.Query(ctx, query.Query{})
+			require.NoError(t, err)
+			entries, err := res.Rest()
+			require.NoError(t, err)
+			outputDatabase := make(map[string][]byte)
+			for _, entry := range entries {
+				outputDatabase[entry.Key] = entry.Value
+			}
+			require.Equal(t, data.expectedOutputDatabase, outputDatabase)
+		})
+	}
+}
+
+func TestIndexedDatastoreConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	byCount := versioning.Index{Name: "byCount", Entries: versionedbuilder.TypedIndex(func(key datastore.Key, c *cbg.CborInt) ([]versioning.IndexEntry, error) {
+		return []versioning.IndexEntry{{Key: datastore.NewKey(fmt.Sprint(*c)), Value: key.Bytes()}}, nil
+	})}
+	ds := &slowReads{dssync.MutexWrap(datastore.NewMapDatastore())}
+	indexed := versioned.NewIndexedDatastore(ds, "1", []versioning.Index{byCount})
+	keys := []datastore.Key{datastore.NewKey("/apples"), datastore.NewKey("/oranges")}
+
+	// every writer writes counts no other writer does, so records never share
+	// an index entry
+	const writers, writes = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := keys[i%len(keys)]
+				if err := indexed.Put(ctx, key, toBytes(t, newInt(int64(w*writes+i+1)))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	expectedEntries := make(map[string]string)
+	for _, key := range keys {
+		value, err := indexed.Get(ctx, key)
+		require.NoError(t, err)
+		var count cbg.CborInt
+		require.NoError(t, count.UnmarshalCBOR(bytes.NewReader(value)))
+		expectedEntries[datastore.NewKey(fmt.Sprint(count)).String()] = key.String()
+	}
+	results, err := indexed.(versioning.IndexQuerier).QueryIndex(ctx, "byCount", query.Query{})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	indexEntries := make(map[string]string)
+	for _, entry := range entries {
+		indexEntries[entry.Key] = string(entry.Value)
+	}
+	require.Equal(t, expectedEntries, indexEntries)
+}
+
+// slowReads delays reads, so concurrent writers overlap between reading the
+// values they replace and committing
+type slowReads struct {
+	datastore.Batching
+}
+
+func (sr *slowReads) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	time.Sleep(time.Millisecond)
+	return sr.Batching.Get(ctx, key)
+}
+
+func TestVersionedDatastoreIndexes(t *testing.T) {
+	ctx := context.Background()
+	identity := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		return c, nil
+	}
+	byCount := versionedbuilder.TypedIndex(func(key datastore.Key, c *cbg.CborInt) ([]versioning.IndexEntry, error) {
+		return []versioning.IndexEntry{{Key: datastore.NewKey(fmt.Sprint(*c)), Value: key.Bytes()}}, nil
+	})
+	migrations, err := versionedbuilder.BuilderList{
+		versionedbuilder.NewVersionedBuilder(identity, "1").Index("byCount", byCount),
+	}.Build()
+	require.NoError(t, err)
+
+	ds := datastore.NewMapDatastore()
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(7))))
+	versionedDs, migrate := versioned.NewVersionedDatastore(ds, migrations, "1")
+	indexed := versionedDs.(versioning.IndexQuerier)
+
+	_, err = indexed.GetIndexEntry(ctx, "byCount", datastore.NewKey("/7"))
+	require.EqualError(t, err, versioning.ErrMigrationsNotRun.Error())
+
+	require.NoError(t, migrate(ctx))
+	value, err := indexed.GetIndexEntry(ctx, "byCount", datastore.NewKey("/7"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("/apples"), value)
+
+	require.NoError(t, versionedDs.Put(ctx, datastore.NewKey("/apples"), toBytes(t, newInt(8))))
+	_, err = indexed.GetIndexEntry(ctx, "byCount", datastore.NewKey("/7"))
+	require.EqualError(t, err, datastore.ErrNotFound.Error())
+	value, err = indexed.GetIndexEntry(ctx, "byCount", datastore.NewKey("/8"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("/apples"), value)
+}
@@ -0,0 +1,240 @@
+// Package fields provides declarative migrations for records encoded as CBOR
+// maps, which add, drop, rename, or convert fields without needing the old Go
+// types of the records
+package fields
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/builder"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+// Operation is a change to the fields of a map encoded record
+type Operation interface {
+	// Apply changes the fields of the record
+	Apply(record *Record) error
+	// Reverse returns the operation that undoes this one, or false if it
+	// cannot be undone
+	Reverse() (Operation, bool)
+}
+
+// Migration is a list of operations, applied to each record in order
+type Migration []Operation
+
+// Up applies the migration to the stored bytes of a record
+func (m Migration) Up(_ datastore.Key, old []byte) ([]byte, error) {
+	return apply(m, old)
+}
+
+// Reverse returns the migration that undoes this one, applying the reverse of
+// each operation in reverse order. It returns false if any operation cannot be undone
+func (m Migration) Reverse() (Migration, bool) {
+	reversed := make(Migration, 0, len(m))
+	for i := len(m) - 1; i >= 0; i-- {
+		op, ok := m[i].Reverse()
+		if !ok {
+			return nil, false
+		}
+		reversed = append(reversed, op)
+	}
+	return reversed, true
+}
+
+// Builder returns a migration builder for the migration, which is reversible if
+// every operation can be undone
+func (m Migration) Builder() builder.Builder {
+	if reversed, ok := m.Reverse(); ok {
+		return builder.NewRawReversible(m.Up, reversed.Up)
+	}
+	return builder.NewRaw(m.Up)
+}
+
+// NewVersionedBuilder returns a versioned builder for a migration to the given
+// version that applies the operations to each record. It is reversible if every
+// operation can be undone
+func NewVersionedBuilder(newVersion versioning.VersionKey, ops ...Operation) versioned.Builder {
+	m := Migration(ops)
+	if reversed, ok := m.Reverse(); ok {
+		return versioned.NewRawReversible(m.Up, reversed.Up, newVersion)
+	}
+	return versioned.NewRaw(m.Up, newVersion)
+}
+
+func apply(ops []Operation, old []byte) ([]byte, error) {
+	var record Record
+	if err := record.UnmarshalCBOR(bytes.NewReader(old)); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	for _, op := range ops {
+		if err := op.Apply(&record); err != nil {
+			return nil, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := record.MarshalCBOR(buf); err != nil {
+		return nil, fmt.Errorf("encoding record: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type addField struct {
+	name         string
+	defaultValue []byte
+	err          error
+}
+
+// AddField adds a field with the given default value to every record. Adding a
+// field a record already has is an error. It is undone by dropping the field
+func AddField(name string, defaultValue cbg.CBORMarshaler) Operation {
+	value, err := cborutil.Dump(defaultValue)
+	return addField{name, value, err}
+}
+
+func (af addField) Apply(record *Record) error {
+	if af.err != nil {
+		return fmt.Errorf("encoding default for field %q: %w", af.name, af.err)
+	}
+	if record.Has(af.name) {
+		return fmt.Errorf("field %q already exists", af.name)
+	}
+	record.Set(af.name, af.defaultValue)
+	return nil
+}
+
+func (af addField) Reverse() (Operation, bool) {
+	return dropField{af.name}, true
+}
+
+type dropField struct {
+	name string
+}
+
+// DropField removes a field from every record that has it. It cannot be undone,
+// since the values of the field are lost -- use DropFieldWithDefault if the field
+// can be restored with a default value
+func DropField(name string) Operation {
+	return dropField{name}
+}
+
+func (df dropField) Apply(record *Record) error {
+	record.Delete(df.name)
+	return nil
+}
+
+func (df dropField) Reverse() (Operation, bool) {
+	return nil, false
+}
+
+type dropFieldWithDefault struct {
+	dropField
+	defaultValue cbg.CBORMarshaler
+}
+
+// DropFieldWithDefault removes a field from every record that has it. It is
+// undone by adding the field back with the given default value
+func DropFieldWithDefault(name string, defaultValue cbg.CBORMarshaler) Operation {
+	return dropFieldWithDefault{dropField{name}, defaultValue}
+}
+
+func (df dropFieldWithDefault) Reverse() (Operation, bool) {
+	return AddField(df.name, df.defaultValue), true
+}
+
+type renameField struct {
+	oldName string
+	newName string
+}
+
+// RenameField renames a field in every record that has it, keeping its place in
+// the record. It is an error if the record already has a field with the new name
+func RenameField(oldName string, newName string) Operation {
+	return renameField{oldName, newName}
+}
+
+func (rf renameField) Apply(record *Record) error {
+	if !record.Has(rf.oldName) {
+		return nil
+	}
+	if record.Has(rf.newName) {
+		return fmt.Errorf("cannot rename field %q to %q: field already exists", rf.oldName, rf.newName)
+	}
+	record.Rename(rf.oldName, rf.newName)
+	return nil
+}
+
+func (rf renameField) Reverse() (Operation, bool) {
+	return renameField{rf.newName, rf.oldName}, true
+}
+
+// Converter converts the encoded value of a field
+type Converter func(old []byte) ([]byte, error)
+
+type changeType struct {
+	name    string
+	convert Converter
+	revert  Converter
+}
+
+// ChangeType converts the value of a field in every record that has it, using a
+// typed conversion function. It cannot be undone
+func ChangeType[T any, U any, PT builder.Record[T], PU builder.Record[U]](name string, convert func(PT) (PU, error)) Operation {
+	return changeType{name: name, convert: converter(convert)}
+}
+
+// ChangeTypeReversible converts the value of a field in every record that has it,
+// using a pair of typed conversion functions that are inverses of each other
+func ChangeTypeReversible[T any, U any, PT builder.Record[T], PU builder.Record[U]](name string, convert func(PT) (PU, error), revert func(PU) (PT, error)) Operation {
+	return changeType{name: name, convert: converter(convert), revert: converter(revert)}
+}
+
+// ChangeTypeRaw converts the encoded value of a field in every record that has
+// it. If revert is nil, it cannot be undone
+func ChangeTypeRaw(name string, convert Converter, revert Converter) Operation {
+	return changeType{name: name, convert: convert, revert: revert}
+}
+
+func (ct changeType) Apply(record *Record) error {
+	old, ok := record.Get(ct.name)
+	if !ok {
+		return nil
+	}
+	if ct.convert == nil {
+		return errors.New("no conversion function")
+	}
+	value, err := ct.convert(old)
+	if err != nil {
+		return fmt.Errorf("converting field %q: %w", ct.name, err)
+	}
+	record.Set(ct.name, value)
+	return nil
+}
+
+func (ct changeType) Reverse() (Operation, bool) {
+	if ct.revert == nil {
+		return nil, false
+	}
+	return changeType{name: ct.name, convert: ct.revert, revert: ct.convert}, true
+}
+
+func converter[T any, U any, PT builder.Record[T], PU builder.Record[U]](convert func(PT) (PU, error)) Converter {
+	return func(old []byte) ([]byte, error) {
+		oldValue := PT(new(T))
+		if err := cborutil.ReadCborRPC(bytes.NewReader(old), oldValue); err != nil {
+			return nil, err
+		}
+		newValue, err := convert(oldValue)
+		if err != nil {
+			return nil, err
+		}
+		return cborutil.Dump(newValue)
+	}
+}
@@ -0,0 +1,238 @@
+package fields_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/fields"
+)
+
+func TestRecord(t *testing.T) {
+	encoded := record(t, "Count", intValue(3), "Ripe", boolValue(true))
+	var r fields.Record
+	require.NoError(t, r.UnmarshalCBOR(bytes.NewReader(encoded)))
+	require.Len(t, r.Fields, 2)
+	value, ok := r.Get("Ripe")
+	require.True(t, ok)
+	require.Equal(t, cborData(t, boolValue(true)), value)
+
+	r.Set("Ripe", cborData(t, boolValue(false)))
+	r.Set("Price", cborData(t, intValue(10)))
+	require.True(t, r.Rename("Count", "Total"))
+	require.False(t, r.Rename("Count", "Total"))
+	require.True(t, r.Delete("Ripe"))
+	require.False(t, r.Delete("Ripe"))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, r.MarshalCBOR(buf))
+	require.Equal(t, record(t, "Total", intValue(3), "Price", intValue(10)), buf.Bytes())
+
+	err := r.UnmarshalCBOR(bytes.NewReader(cborData(t, intValue(3))))
+	require.EqualError(t, err, "cbor input should be of type map")
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	isRipe := func(c *cbg.CborInt) (*cbg.CborBool, error) {
+		ripe := cbg.CborBool(*c > 0)
+		return &ripe, nil
+	}
+	ripeness := func(b *cbg.CborBool) (*cbg.CborInt, error) {
+		var out cbg.CborInt
+		if *b {
+			out = 1
+		}
+		return &out, nil
+	}
+	testCases := map[string]struct {
+		ops            []fields.Operation
+		inputDatabase  map[string][]byte
+		expectedOutput map[string][]byte
+		expectedDown   map[string][]byte
+		expectedErr    error
+	}{
+		"add field": {
+			ops: []fields.Operation{fields.AddField("Price", intValue(0))},
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Price", intValue(0)),
+			},
+			expectedDown: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3)),
+			},
+		},
+		"add field that already exists": {
+			ops: []fields.Operation{fields.AddField("Price", intValue(0))},
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Price", intValue(7)),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/apples': field \"Price\" already exists"),
+		},
+		"drop field": {
+			ops: []fields.Operation{fields.DropField("Price")},
+			inputDatabase: map[string][]byte{
+				"/apples":  record(t, "Count", intValue(3), "Price", intValue(7)),
+				"/oranges": record(t, "Count", intValue(4)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples":  record(t, "Count", intValue(3)),
+				"/oranges": record(t, "Count", intValue(4)),
+			},
+		},
+		"drop field with default": {
+			ops: []fields.Operation{fields.DropFieldWithDefault("Price", intValue(0))},
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Price", intValue(7)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3)),
+			},
+			expectedDown: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Price", intValue(0)),
+			},
+		},
+		"rename field": {
+			ops: []fields.Operation{fields.RenameField("Count", "Total")},
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Price", intValue(7)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": record(t, "Total", intValue(3), "Price", intValue(7)),
+			},
+			expectedDown: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Price", intValue(7)),
+			},
+		},
+		"change type": {
+			ops: []fields.Operation{fields.ChangeTypeReversible("Ripe", isRipe, ripeness)},
+			inputDatabase: map[string][]byte{
+				"/apples":  record(t, "Ripe", intValue(1)),
+				"/oranges": record(t, "Ripe", intValue(0)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples":  record(t, "Ripe", boolValue(true)),
+				"/oranges": record(t, "Ripe", boolValue(false)),
+			},
+			expectedDown: map[string][]byte{
+				"/apples":  record(t, "Ripe", intValue(1)),
+				"/oranges": record(t, "Ripe", intValue(0)),
+			},
+		},
+		"change type with bad value": {
+			ops: []fields.Operation{fields.ChangeType("Ripe", isRipe)},
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Ripe", boolValue(true)),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/apples': converting field \"Ripe\": wrong type for int64 field: 7"),
+		},
+		"several operations, one irreversible": {
+			ops: []fields.Operation{
+				fields.RenameField("Count", "Total"),
+				fields.AddField("Price", intValue(0)),
+				fields.ChangeType("Ripe", isRipe),
+			},
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Ripe", intValue(2)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": record(t, "Total", intValue(3), "Ripe", boolValue(true), "Price", intValue(0)),
+			},
+		},
+		"not a map": {
+			ops: []fields.Operation{fields.DropField("Price")},
+			inputDatabase: map[string][]byte{
+				"/apples": cborData(t, intValue(3)),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/apples': decoding record: cbor input should be of type map"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migration, err := fields.NewVersionedBuilder("2", data.ops...).OldVersion("1").Build()
+			require.NoError(t, err)
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/1"+key), value))
+			}
+			_, err = migration.Up(ctx, ds)
+			require.Equal(t, data.expectedOutput, readAll(t, ds, "/2"))
+			if data.expectedErr != nil {
+				require.EqualError(t, err, data.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			reversible, ok := migration.(versioning.ReversibleVersionedMigration)
+			require.Equal(t, data.expectedDown != nil, ok)
+			if ok {
+				deleteAll(t, ds, "/1")
+				_, err = reversible.Down(ctx, ds)
+				require.NoError(t, err)
+				require.Equal(t, data.expectedDown, readAll(t, ds, "/1"))
+			}
+		})
+	}
+}
+
+func intValue(n int64) *cbg.CborInt {
+	value := cbg.CborInt(n)
+	return &value
+}
+
+func boolValue(b bool) *cbg.CborBool {
+	value := cbg.CborBool(b)
+	return &value
+}
+
+func cborData(t *testing.T, value cbg.CBORMarshaler) []byte {
+	data, err := cborutil.Dump(value)
+	require.NoError(t, err)
+	return data
+}
+
+// record encodes a map encoded record from pairs of field names and values
+func record(t *testing.T, nameValues ...interface{}) []byte {
+	var r fields.Record
+	for i := 0; i < len(nameValues); i += 2 {
+		r.Set(nameValues[i].(string), cborData(t, nameValues[i+1].(cbg.CBORMarshaler)))
+	}
+	return cborData(t, &r)
+}
+
+func readAll(t *testing.T, ds datastore.Batching, prefix string) map[string][]byte {
+	res, err := ds.Query(context.Background(), query.Query{Prefix: prefix})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	out := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		out[strings.TrimPrefix(entry.Key, prefix)] = entry.Value
+	}
+	return out
+}
+
+func deleteAll(t *testing.T, ds datastore.Batching, prefix string) {
+	res, err := ds.Query(context.Background(), query.Query{Prefix: prefix, KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NoError(t, ds.Delete(context.Background(), datastore.NewKey(entry.Key)))
+	}
+}
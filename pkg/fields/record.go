@@ -0,0 +1,126 @@
+package fields
+
+import (
+	"fmt"
+	"io"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// Field is a single field of a map encoded record, with its value left encoded
+type Field struct {
+	Name  string
+	Value cbg.Deferred
+}
+
+// Record is a record encoded as a CBOR map with string keys, the way cbor-gen
+// writes structs with map encoding. Fields keep their order, and their values
+// are never decoded, so records can be migrated without their Go types
+type Record struct {
+	Fields []Field
+}
+
+// Get returns the encoded value of the named field
+func (r *Record) Get(name string) ([]byte, bool) {
+	i := r.index(name)
+	if i < 0 {
+		return nil, false
+	}
+	return r.Fields[i].Value.Raw, true
+}
+
+// Has returns whether the record has the named field
+func (r *Record) Has(name string) bool {
+	return r.index(name) >= 0
+}
+
+// Set sets the encoded value of the named field, adding it at the end of the
+// record if it isn't present
+func (r *Record) Set(name string, value []byte) {
+	i := r.index(name)
+	if i < 0 {
+		r.Fields = append(r.Fields, Field{Name: name, Value: cbg.Deferred{Raw: value}})
+		return
+	}
+	r.Fields[i].Value = cbg.Deferred{Raw: value}
+}
+
+// Delete removes the named field, returning false if it wasn't present
+func (r *Record) Delete(name string) bool {
+	i := r.index(name)
+	if i < 0 {
+		return false
+	}
+	r.Fields = append(r.Fields[:i], r.Fields[i+1:]...)
+	return true
+}
+
+// Rename changes the name of a field, keeping its place in the record. It
+// returns false if the field wasn't present
+func (r *Record) Rename(oldName string, newName string) bool {
+	i := r.index(oldName)
+	if i < 0 {
+		return false
+	}
+	r.Fields[i].Name = newName
+	return true
+}
+
+func (r *Record) index(name string) int {
+	for i, field := range r.Fields {
+		if field.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// MarshalCBOR writes the record as a CBOR map
+func (r *Record) MarshalCBOR(w io.Writer) error {
+	if err := cbg.WriteMajorTypeHeader(w, cbg.MajMap, uint64(len(r.Fields))); err != nil {
+		return err
+	}
+	for i := range r.Fields {
+		field := &r.Fields[i]
+		if err := cbg.WriteMajorTypeHeader(w, cbg.MajTextString, uint64(len(field.Name))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, field.Name); err != nil {
+			return err
+		}
+		if err := field.Value.MarshalCBOR(w); err != nil {
+			return fmt.Errorf("field %q: %w", field.Name, err)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCBOR reads the record from a CBOR map with string keys
+func (r *Record) UnmarshalCBOR(br io.Reader) error {
+	maj, extra, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("record has too many fields (%d)", extra)
+	}
+	r.Fields = make([]Field, 0, extra)
+	for i := uint64(0); i < extra; i++ {
+		name, err := cbg.ReadString(br)
+		if err != nil {
+			return fmt.Errorf("reading name of field %d: %w", i, err)
+		}
+		var value cbg.Deferred
+		if err := value.UnmarshalCBOR(br); err != nil {
+			return fmt.Errorf("reading field %q: %w", name, err)
+		}
+		r.Fields = append(r.Fields, Field{Name: name, Value: value})
+	}
+	return nil
+}
+
+var _ cbg.CBORMarshaler = &Record{}
+var _ cbg.CBORUnmarshaler = &Record{}
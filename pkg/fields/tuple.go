@@ -0,0 +1,89 @@
+package fields
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+// TupleToMap returns a raw migration function that converts records from
+// cbor-gen's tuple encoding to its map encoding, naming the elements of each
+// tuple with the fields of the schema, in order
+func TupleToMap(schema ...string) versioning.RawMigrationFunc {
+	return func(_ datastore.Key, old []byte) ([]byte, error) {
+		br := bytes.NewReader(old)
+		maj, extra, err := cbg.CborReadHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		if maj != cbg.MajArray {
+			return nil, fmt.Errorf("cbor input should be of type array")
+		}
+		if extra != uint64(len(schema)) {
+			return nil, fmt.Errorf("record has %d fields, but the schema has %d", extra, len(schema))
+		}
+		record := Record{Fields: make([]Field, 0, len(schema))}
+		for _, name := range schema {
+			var value cbg.Deferred
+			if err := value.UnmarshalCBOR(br); err != nil {
+				return nil, fmt.Errorf("reading field %q: %w", name, err)
+			}
+			record.Fields = append(record.Fields, Field{Name: name, Value: value})
+		}
+		buf := new(bytes.Buffer)
+		if err := record.MarshalCBOR(buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// MapToTuple returns a raw migration function that converts records from
+// cbor-gen's map encoding to its tuple encoding, with the fields in the order of
+// the schema. Records must have exactly the fields in the schema
+func MapToTuple(schema ...string) versioning.RawMigrationFunc {
+	return func(_ datastore.Key, old []byte) ([]byte, error) {
+		var record Record
+		if err := record.UnmarshalCBOR(bytes.NewReader(old)); err != nil {
+			return nil, err
+		}
+		inSchema := make(map[string]struct{}, len(schema))
+		for _, name := range schema {
+			inSchema[name] = struct{}{}
+		}
+		for _, field := range record.Fields {
+			if _, ok := inSchema[field.Name]; !ok {
+				return nil, fmt.Errorf("record has field %q, which is not in the schema", field.Name)
+			}
+		}
+		buf := new(bytes.Buffer)
+		if err := cbg.WriteMajorTypeHeader(buf, cbg.MajArray, uint64(len(schema))); err != nil {
+			return nil, err
+		}
+		for _, name := range schema {
+			value, ok := record.Get(name)
+			if !ok {
+				return nil, fmt.Errorf("record is missing field %q", name)
+			}
+			buf.Write(value)
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// NewTupleToMapBuilder returns a versioned builder for a migration to the given
+// version that converts records from tuple to map encoding. It is reversible
+func NewTupleToMapBuilder(newVersion versioning.VersionKey, schema ...string) versioned.Builder {
+	return versioned.NewRawReversible(TupleToMap(schema...), MapToTuple(schema...), newVersion)
+}
+
+// NewMapToTupleBuilder returns a versioned builder for a migration to the given
+// version that converts records from map to tuple encoding. It is reversible
+func NewMapToTupleBuilder(newVersion versioning.VersionKey, schema ...string) versioned.Builder {
+	return versioned.NewRawReversible(MapToTuple(schema...), TupleToMap(schema...), newVersion)
+}
@@ -0,0 +1,104 @@
+package fields_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/fields"
+	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
+)
+
+func TestTupleConversion(t *testing.T) {
+	ctx := context.Background()
+	schema := []string{"Count", "Ripe"}
+	testCases := map[string]struct {
+		builder        func() versioned.Builder
+		inputDatabase  map[string][]byte
+		expectedOutput map[string][]byte
+		expectedErr    error
+	}{
+		"tuple to map": {
+			builder: func() versioned.Builder { return fields.NewTupleToMapBuilder("2", schema...) },
+			inputDatabase: map[string][]byte{
+				"/apples": tuple(t, intValue(3), boolValue(true)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Ripe", boolValue(true)),
+			},
+		},
+		"tuple to map, wrong length": {
+			builder: func() versioned.Builder { return fields.NewTupleToMapBuilder("2", schema...) },
+			inputDatabase: map[string][]byte{
+				"/apples": tuple(t, intValue(3)),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/apples': record has 1 fields, but the schema has 2"),
+		},
+		"map to tuple": {
+			builder: func() versioned.Builder { return fields.NewMapToTupleBuilder("2", schema...) },
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Ripe", boolValue(true)),
+			},
+			expectedOutput: map[string][]byte{
+				"/apples": tuple(t, intValue(3), boolValue(true)),
+			},
+		},
+		"map to tuple, missing field": {
+			builder: func() versioned.Builder { return fields.NewMapToTupleBuilder("2", schema...) },
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3)),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/apples': record is missing field \"Ripe\""),
+		},
+		"map to tuple, extra field": {
+			builder: func() versioned.Builder { return fields.NewMapToTupleBuilder("2", schema...) },
+			inputDatabase: map[string][]byte{
+				"/apples": record(t, "Count", intValue(3), "Ripe", boolValue(true), "Price", intValue(1)),
+			},
+			expectedOutput: map[string][]byte{},
+			expectedErr:    errors.New("attempting to transform to new state '/apples': record has field \"Price\", which is not in the schema"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migration, err := data.builder().OldVersion("1").Build()
+			require.NoError(t, err)
+			ds := datastore.NewMapDatastore()
+			for key, value := range data.inputDatabase {
+				require.NoError(t, ds.Put(ctx, datastore.NewKey("/1"+key), value))
+			}
+			_, err = migration.Up(ctx, ds)
+			require.Equal(t, data.expectedOutput, readAll(t, ds, "/2"))
+			if data.expectedErr != nil {
+				require.EqualError(t, err, data.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			deleteAll(t, ds, "/1")
+			reversible, ok := migration.(versioning.ReversibleVersionedMigration)
+			require.True(t, ok)
+			_, err = reversible.Down(ctx, ds)
+			require.NoError(t, err)
+			require.Equal(t, data.inputDatabase, readAll(t, ds, "/1"))
+		})
+	}
+}
+
+// tuple encodes a tuple encoded record from its values
+func tuple(t *testing.T, values ...cbg.CBORMarshaler) []byte {
+	buf := new(bytes.Buffer)
+	require.NoError(t, cbg.WriteMajorTypeHeader(buf, cbg.MajArray, uint64(len(values))))
+	for _, value := range values {
+		require.NoError(t, value.MarshalCBOR(buf))
+	}
+	return buf.Bytes()
+}
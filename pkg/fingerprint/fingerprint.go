@@ -0,0 +1,134 @@
+// Package fingerprint identifies the CBOR schema of a record type, so a
+// versioned store can tell when the type it reads and writes no longer matches
+// the type that wrote its records
+package fingerprint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+var marshalerType = reflect.TypeOf((*cbg.CBORMarshaler)(nil)).Elem()
+
+// Of returns the fingerprint of a record type's schema, given a record or a
+// pointer to one
+func Of(record interface{}) (string, error) {
+	return OfType(reflect.TypeOf(record))
+}
+
+// OfType returns the fingerprint of a record type's schema. The fingerprint is
+// derived from the fields cbor-gen encodes for the type: their names, order and
+// kinds, whether the type uses the tuple or map encoding, and the same for any
+// nested cbor-gen types. Renaming the type or a named field type does not
+// change the fingerprint, since neither changes what is stored
+func OfType(recordType reflect.Type) (string, error) {
+	if recordType == nil {
+		return "", fmt.Errorf("record type is required")
+	}
+	for recordType.Kind() == reflect.Ptr {
+		recordType = recordType.Elem()
+	}
+	if recordType.Kind() != reflect.Struct {
+		return "", fmt.Errorf("%s is not a struct", recordType)
+	}
+	var d describer
+	d.describeStruct(recordType)
+	sum := sha256.Sum256([]byte(d.buf.String()))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type describer struct {
+	buf strings.Builder
+	// stack holds the structs being described, outermost first, so a type that
+	// contains itself refers back to where it started rather than repeating
+	stack []reflect.Type
+}
+
+func (d *describer) describeStruct(t reflect.Type) {
+	d.stack = append(d.stack, t)
+	defer func() { d.stack = d.stack[:len(d.stack)-1] }()
+	d.buf.WriteString("struct ")
+	d.buf.WriteString(encoding(t))
+	d.buf.WriteString(" {")
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		// cbor-gen skips unexported fields
+		if field.PkgPath != "" {
+			continue
+		}
+		d.buf.WriteString(field.Name)
+		d.buf.WriteString(" ")
+		d.describe(field.Type)
+		d.buf.WriteString("; ")
+	}
+	d.buf.WriteString("}")
+}
+
+func (d *describer) describe(t reflect.Type) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		d.buf.WriteString("*")
+		d.describe(t.Elem())
+	case reflect.Slice:
+		d.buf.WriteString("[]")
+		d.describe(t.Elem())
+	case reflect.Array:
+		fmt.Fprintf(&d.buf, "[%d]", t.Len())
+		d.describe(t.Elem())
+	case reflect.Map:
+		d.buf.WriteString("map[")
+		d.describe(t.Key())
+		d.buf.WriteString("]")
+		d.describe(t.Elem())
+	case reflect.Struct:
+		// nested cbor-gen types are part of the schema; other structs, like
+		// big.Int or cid.Cid, have fixed encodings of their own
+		if !reflect.PtrTo(t).Implements(marshalerType) {
+			d.buf.WriteString(t.String())
+			return
+		}
+		// a type that contains itself is written as how many structs out it
+		// started, which doesn't depend on its name
+		for i := len(d.stack) - 1; i >= 0; i-- {
+			if d.stack[i] == t {
+				fmt.Fprintf(&d.buf, "^%d", len(d.stack)-i)
+				return
+			}
+		}
+		d.describeStruct(t)
+	default:
+		// a type with its own marshaller is encoded however it likes
+		if reflect.PtrTo(t).Implements(marshalerType) {
+			d.buf.WriteString(t.String())
+			return
+		}
+		d.buf.WriteString(t.Kind().String())
+	}
+}
+
+// encoding reports whether cbor-gen writes a type as a tuple or a map, by
+// encoding its zero value
+func encoding(t reflect.Type) string {
+	marshaler, ok := reflect.New(t).Interface().(cbg.CBORMarshaler)
+	if !ok {
+		return ""
+	}
+	var buf bytes.Buffer
+	if err := marshaler.MarshalCBOR(&buf); err != nil || buf.Len() == 0 {
+		return ""
+	}
+	switch buf.Bytes()[0] >> 5 {
+	case cbg.MajArray:
+		return "tuple"
+	case cbg.MajMap:
+		return "map"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,187 @@
+package fingerprint_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-ds-versioning/pkg/fingerprint"
+)
+
+type Kind string
+
+type Basket struct {
+	Kind  string
+	Count uint64
+}
+
+type RenamedBasket struct {
+	Kind  Kind
+	Count uint64
+}
+
+type BasketWithPrice struct {
+	Kind  string
+	Count uint64
+	Price int64
+}
+
+type ReorderedBasket struct {
+	Count uint64
+	Kind  string
+}
+
+type TupleBasket struct {
+	Kind  string
+	Count uint64
+}
+
+func (tb *TupleBasket) MarshalCBOR(w io.Writer) error {
+	return cbg.WriteMajorTypeHeader(w, cbg.MajArray, 2)
+}
+
+type MapBasket struct {
+	Kind  string
+	Count uint64
+}
+
+func (mb *MapBasket) MarshalCBOR(w io.Writer) error {
+	return cbg.WriteMajorTypeHeader(w, cbg.MajMap, 2)
+}
+
+type Crate struct {
+	Baskets []TupleBasket
+}
+
+type MapCrate struct {
+	Baskets []MapBasket
+}
+
+type OtherTupleBasket struct {
+	Kind  string
+	Count uint64
+}
+
+func (otb *OtherTupleBasket) MarshalCBOR(w io.Writer) error {
+	return cbg.WriteMajorTypeHeader(w, cbg.MajArray, 2)
+}
+
+type Pair struct {
+	Left  TupleBasket
+	Right TupleBasket
+}
+
+type RenamedPair struct {
+	Left  OtherTupleBasket
+	Right OtherTupleBasket
+}
+
+type Tree struct {
+	Children []Tree
+}
+
+func (t *Tree) MarshalCBOR(w io.Writer) error {
+	return cbg.WriteMajorTypeHeader(w, cbg.MajArray, 1)
+}
+
+type Forest struct {
+	Trees []Tree
+}
+
+type Grove struct {
+	Children []Grove
+}
+
+func (g *Grove) MarshalCBOR(w io.Writer) error {
+	return cbg.WriteMajorTypeHeader(w, cbg.MajArray, 1)
+}
+
+type RenamedForest struct {
+	Trees []Grove
+}
+
+func TestOfType(t *testing.T) {
+	basket, err := fingerprint.Of(Basket{})
+	require.NoError(t, err)
+	tupleBasket, err := fingerprint.Of(&TupleBasket{})
+	require.NoError(t, err)
+	crate, err := fingerprint.Of(&Crate{})
+	require.NoError(t, err)
+	pair, err := fingerprint.Of(&Pair{})
+	require.NoError(t, err)
+	forest, err := fingerprint.Of(&Forest{})
+	require.NoError(t, err)
+	testCases := map[string]struct {
+		recordType  reflect.Type
+		compareTo   string
+		same        bool
+		expectedErr error
+	}{
+		"pointer to the same type": {
+			recordType: reflect.TypeOf(&Basket{}),
+			compareTo:  basket,
+			same:       true,
+		},
+		"renamed named field type": {
+			recordType: reflect.TypeOf(&RenamedBasket{}),
+			compareTo:  basket,
+			same:       true,
+		},
+		"added field": {
+			recordType: reflect.TypeOf(&BasketWithPrice{}),
+			compareTo:  basket,
+		},
+		"reordered fields": {
+			recordType: reflect.TypeOf(&ReorderedBasket{}),
+			compareTo:  basket,
+		},
+		"tuple encoding": {
+			recordType: reflect.TypeOf(&TupleBasket{}),
+			compareTo:  basket,
+		},
+		"map encoding": {
+			recordType: reflect.TypeOf(&MapBasket{}),
+			compareTo:  tupleBasket,
+		},
+		"nested type changed encoding": {
+			recordType: reflect.TypeOf(&MapCrate{}),
+			compareTo:  crate,
+		},
+		"renamed nested type used twice": {
+			recordType: reflect.TypeOf(&RenamedPair{}),
+			compareTo:  pair,
+			same:       true,
+		},
+		"renamed nested type that contains itself": {
+			recordType: reflect.TypeOf(&RenamedForest{}),
+			compareTo:  forest,
+			same:       true,
+		},
+		"not a struct": {
+			recordType:  reflect.TypeOf(new(cbg.CborInt)),
+			expectedErr: errors.New("typegen.CborInt is not a struct"),
+		},
+		"no type": {
+			expectedErr: errors.New("record type is required"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			schema, err := fingerprint.OfType(data.recordType)
+			if data.expectedErr != nil {
+				require.EqualError(t, err, data.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			if data.same {
+				require.Equal(t, data.compareTo, schema)
+			} else {
+				require.NotEqual(t, data.compareTo, schema)
+			}
+		})
+	}
+}
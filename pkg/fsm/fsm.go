@@ -11,37 +11,98 @@ import (
 	cbg "github.com/whyrusleeping/cbor-gen"
 
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/go-statestore"
 
+	"github.com/filecoin-project/go-ds-versioning/internal/bluegreen"
+	"github.com/filecoin-project/go-ds-versioning/internal/compat"
 	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
 	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	"github.com/filecoin-project/go-ds-versioning/internal/stale"
 	"github.com/filecoin-project/go-ds-versioning/internal/utils"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 )
 
 type migratedFsm struct {
-	fsm fsm.Group
-	ms  versioning.MigrationState
+	fsm  fsm.Group
+	gate utils.ReadyGate
+	// stale serves reads until migrations are complete, if set
+	stale *statestore.StateStore
+	// promoter stages and promotes versions, if set
+	promoter versioning.Promoter
+	// compat serves reads when migrations leave the fsm at a newer version that
+	// this code can read but not write
+	compat   *compat.Datastore
+	compatSs *statestore.StateStore
 }
 
 // NewVersionedFSM sets takes a datastore, fsm parameters, migrations list, and target version, and returns
-// an fsm whose functions will fail till it's migrated to the target version and a function to run migrations
-func NewVersionedFSM(ds datastore.Batching, parameters fsm.Parameters, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (fsm.Group, func(context.Context) error, error) {
-	r := runner.NewRunner(ds, migrations, target, migrate.To)
-	fsm, err := fsm.New(namespace.Wrap(ds, datastore.NewKey(string(target))), parameters)
+// an fsm whose functions will fail till it's migrated to the target version and a function to run migrations.
+// With versioning.StaleReads, Get, Has and List are served from the previous version until then.
+// With versioning.BlueGreen, the fsm implements versioning.Promoter
+func NewVersionedFSM(ds datastore.Batching, parameters fsm.Parameters, migrations versioning.VersionedMigrationList, target versioning.VersionKey, opts ...versioning.Option) (fsm.Group, func(context.Context) error, error) {
+	m := migrate.NewMigrator(opts...)
+	cfg := versioning.NewConfig(opts...)
+	var versionDs datastore.Batching = namespace.Wrap(ds, datastore.NewKey(string(target)))
+	runMigrations := m.To
+	var promoter versioning.Promoter
+	if cfg.BlueGreen {
+		blueGreenDs := bluegreen.NewDatastore(ds, migrations, target, m, func(version versioning.VersionKey) datastore.Batching {
+			return namespace.Wrap(ds, datastore.NewKey(string(version)))
+		})
+		versionDs, runMigrations, promoter = blueGreenDs, blueGreenDs.RunMigrations(m), blueGreenDs
+	}
+	compatDs := compat.NewDatastore(ds)
+	r := runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(runMigrations), opts...)
+	fsm, err := fsm.New(versionDs, parameters)
 	if err != nil {
 		return nil, nil, err
 	}
-	return NewMigratedFSM(fsm, r), r.Migrate, nil
+	group := &migratedFsm{fsm: fsm, gate: utils.NewReadyGate(r, cfg), promoter: promoter,
+		compat: compatDs, compatSs: statestore.New(compatDs)}
+	if cfg.StaleReads {
+		group.stale = statestore.New(stale.NewDatastore(ds, migrations, target, r, opts...))
+	}
+	return group, r.Migrate, nil
 }
 
 // NewMigratedFSM returns an fsm whose functions will fail until the migration state says its ready
-func NewMigratedFSM(fsm fsm.Group, ms versioning.MigrationState) fsm.Group {
-	return &migratedFsm{fsm, ms}
+func NewMigratedFSM(fsm fsm.Group, ms versioning.MigrationState, opts ...versioning.Option) fsm.Group {
+	return &migratedFsm{fsm: fsm, gate: utils.NewReadyGate(ms, versioning.NewConfig(opts...))}
+}
+
+// reader returns the state store reads should go to instead of the fsm, if any,
+// which is the stale view of the fsm states when there is one and migrations are
+// not yet complete, or the newer version the fsm was left at when this code can
+// only read it. Otherwise it returns the error reads should fail with, if any
+func (fsm *migratedFsm) reader() (*statestore.StateStore, error) {
+	if fsm.stale == nil {
+		if err := fsm.gate.ReadyWithTimeout(); err != nil {
+			return nil, err
+		}
+	} else if fsm.gate.ReadyNow() != nil {
+		return fsm.stale, nil
+	}
+	if fsm.compat != nil && fsm.compat.Reading() {
+		return fsm.compatSs, nil
+	}
+	return nil, nil
+}
+
+// writable returns an error if the fsm can't be written, because migrations
+// are not yet complete or left it at a version this code can only read
+func (fsm *migratedFsm) writable(wait func() error) error {
+	if err := wait(); err != nil {
+		return err
+	}
+	if fsm.compat != nil {
+		return fsm.compat.Writable()
+	}
+	return nil
 }
 
 // Begin initiates tracking with a specific value for a given identifier
 func (fsm *migratedFsm) Begin(id interface{}, userState interface{}) error {
-	if err := fsm.ms.ReadyError(); err != nil {
+	if err := fsm.writable(fsm.gate.ReadyWithTimeout); err != nil {
 		return err
 	}
 	return fsm.fsm.Begin(id, userState)
@@ -51,7 +112,7 @@ func (fsm *migratedFsm) Begin(id interface{}, userState interface{}) error {
 // it will error if there are underlying state store errors or if the parameters
 // do not match what is expected for the event name
 func (fsm *migratedFsm) Send(id interface{}, name fsm.EventName, args ...interface{}) error {
-	if err := fsm.ms.ReadyError(); err != nil {
+	if err := fsm.writable(fsm.gate.ReadyWithTimeout); err != nil {
 		return err
 	}
 	return fsm.fsm.Send(id, name, args...)
@@ -61,7 +122,7 @@ func (fsm *migratedFsm) Send(id interface{}, name fsm.EventName, args ...interfa
 // will return an error if the transition was not possible given the current
 // state
 func (fsm *migratedFsm) SendSync(ctx context.Context, id interface{}, name fsm.EventName, args ...interface{}) error {
-	if err := fsm.ms.ReadyError(); err != nil {
+	if err := fsm.writable(func() error { return fsm.gate.Ready(ctx) }); err != nil {
 		return err
 	}
 	return fsm.fsm.SendSync(ctx, id, name, args...)
@@ -69,35 +130,50 @@ func (fsm *migratedFsm) SendSync(ctx context.Context, id interface{}, name fsm.E
 
 // Get gets state for a single state machine
 func (fsm *migratedFsm) Get(id interface{}) fsm.StoredState {
-	if err := fsm.ms.ReadyError(); err != nil {
+	ss, err := fsm.reader()
+	if err != nil {
 		return &utils.NotReadyStoredState{Err: err}
 	}
+	if ss != nil {
+		return ss.Get(id)
+	}
 	return fsm.fsm.Get(id)
 }
 
 // GetSync will make sure all events present at the time of the call are processed before
 // returning a value, which is read into out
 func (fsm *migratedFsm) GetSync(ctx context.Context, id interface{}, value cbg.CBORUnmarshaler) error {
-	if err := fsm.ms.ReadyError(); err != nil {
+	if err := fsm.gate.Ready(ctx); err != nil {
 		return err
 	}
+	if fsm.compat != nil && fsm.compat.Reading() {
+		return fsm.compatSs.Get(id).Get(value)
+	}
 	return fsm.fsm.GetSync(ctx, id, value)
 }
 
 // Has indicates whether there is data for the given state machine
 func (fsm *migratedFsm) Has(id interface{}) (bool, error) {
-	if err := fsm.ms.ReadyError(); err != nil {
+	ss, err := fsm.reader()
+	if err != nil {
 		return false, err
 	}
+	if ss != nil {
+		return ss.Has(id)
+	}
 	return fsm.fsm.Has(id)
 }
 
 // List outputs states of all state machines in this group
 // out: *[]StateT
 func (fsm *migratedFsm) List(out interface{}) error {
-	if err := fsm.ms.ReadyError(); err != nil {
+	ss, err := fsm.reader()
+	if err != nil {
 		return err
 	}
+	if ss != nil {
+		return ss.List(out)
+	}
 	return fsm.fsm.List(out)
 }
 
@@ -109,8 +185,46 @@ func (fsm *migratedFsm) IsTerminated(out fsm.StateType) bool {
 
 // Stop stops all state machines in this group
 func (fsm *migratedFsm) Stop(ctx context.Context) error {
-	if err := fsm.ms.ReadyError(); err != nil {
+	if err := fsm.gate.Ready(ctx); err != nil {
 		return err
 	}
 	return fsm.fsm.Stop(ctx)
 }
+
+// Retry runs migrations again if they failed previously
+func (fsm *migratedFsm) Retry(ctx context.Context) error {
+	return fsm.gate.Retry(ctx)
+}
+
+// Cancel stops running migrations and rolls back the partially migrated version step
+func (fsm *migratedFsm) Cancel(ctx context.Context) error {
+	return fsm.gate.Cancel(ctx)
+}
+
+// Stage builds the next version alongside the current one, if the fsm can stage
+// and promote versions
+func (fsm *migratedFsm) Stage(ctx context.Context, version versioning.VersionKey) error {
+	if err := fsm.writable(func() error { return fsm.gate.Ready(ctx) }); err != nil {
+		return err
+	}
+	if fsm.promoter == nil {
+		return versioning.ErrPromoteNotSupported
+	}
+	return fsm.promoter.Stage(ctx, version)
+}
+
+// Promote switches the fsm to a staged version, if the fsm can stage and promote
+// versions
+func (fsm *migratedFsm) Promote(ctx context.Context, version versioning.VersionKey) error {
+	if err := fsm.writable(func() error { return fsm.gate.Ready(ctx) }); err != nil {
+		return err
+	}
+	if fsm.promoter == nil {
+		return versioning.ErrPromoteNotSupported
+	}
+	return fsm.promoter.Promote(ctx, version)
+}
+
+var _ versioning.Retrier = &migratedFsm{}
+var _ versioning.Canceller = &migratedFsm{}
+var _ versioning.Promoter = &migratedFsm{}
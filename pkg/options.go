@@ -0,0 +1,219 @@
+package versioning
+
+import (
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+// Config holds the settings for a versioned datastore, statestore, or fsm
+type Config struct {
+	// WaitForReady makes operations block until migrations are complete,
+	// rather than failing immediately with ErrMigrationsNotRun
+	WaitForReady bool
+	// ReadyTimeout is how long operations that do not take a context will
+	// wait for migrations when WaitForReady is set
+	ReadyTimeout time.Duration
+	// RetryPolicy decides whether and when failed migrations are retried
+	// automatically. If nil, failed migrations are only retried explicitly
+	RetryPolicy RetryPolicy
+	// LockOwner identifies this process when it holds the migration lease for a
+	// datastore. If empty, a random ID is generated for each migration
+	LockOwner string
+	// LockTTL is how long the migration lease lasts without being renewed,
+	// after which another process can take it over
+	LockTTL time.Duration
+	// VersionsNamespace is where versioning keeps its own records, like the
+	// current version. If empty, DefaultVersionsNamespace is used
+	VersionsNamespace datastore.Key
+	// CodeVersion identifies the version of the code using the store, and is
+	// recorded whenever the version of the data is written
+	CodeVersion string
+	// MinReaderVersion is the oldest version of the data that code must understand
+	// in order to read the store. If empty, it is the version the store is at
+	MinReaderVersion VersionKey
+	// SchemaFingerprint identifies the schema of the records at the target
+	// version. If empty, it is derived from the output type of the migration to
+	// the target version, when that is known
+	SchemaFingerprint string
+	// LazyMigration makes a store flip to the target version straight away, and
+	// migrate its records as they're read rather than all at once
+	LazyMigration bool
+	// OnlineMigration keeps a store usable while its records are migrated into
+	// the target version, by writing to both versions until the step is done
+	OnlineMigration bool
+	// StaleReads lets reads be served from the previous version while
+	// migrations run, migrated on the fly
+	StaleReads bool
+	// BlueGreen lets a store build its next version alongside the current one
+	// and switch to it in one step
+	BlueGreen bool
+}
+
+// DefaultVersionsNamespace is the default namespace for versioning's own records
+var DefaultVersionsNamespace = datastore.NewKey("/versions")
+
+// VersionsNamespaceKey returns the namespace for versioning's own records
+func (cfg Config) VersionsNamespaceKey() datastore.Key {
+	if ns := cfg.VersionsNamespace.String(); ns == "" || ns == "/" {
+		return DefaultVersionsNamespace
+	}
+	return cfg.VersionsNamespace
+}
+
+// RetryPolicy is called after a failed migration attempt with the number of
+// attempts so far and the error from the last one. It returns how long to wait
+// before trying again, and false if migrations should not be retried
+type RetryPolicy func(attempt int, err error) (time.Duration, bool)
+
+// Option sets a configuration parameter on a versioned store
+type Option func(*Config)
+
+// NewConfig returns a config with the given options applied
+func NewConfig(opts ...Option) Config {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WaitForReady makes operations on a versioned store wait until migrations complete
+// instead of failing with ErrMigrationsNotRun. Operations that take a context wait
+// until the context expires. Operations that do not take a context wait up to
+// the given timeout
+func WaitForReady(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.WaitForReady = true
+		cfg.ReadyTimeout = timeout
+	}
+}
+
+// RetryMigrations sets a policy for automatically retrying failed migrations
+func RetryMigrations(policy RetryPolicy) Option {
+	return func(cfg *Config) {
+		cfg.RetryPolicy = policy
+	}
+}
+
+// ExponentialBackoff returns a retry policy that waits minDelay after the first
+// failure, doubling the wait after each failure up to maxDelay, and gives up
+// after maxAttempts attempts. If maxAttempts is zero, it retries indefinitely
+func ExponentialBackoff(minDelay time.Duration, maxDelay time.Duration, maxAttempts int) RetryPolicy {
+	return func(attempt int, err error) (time.Duration, bool) {
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			return 0, false
+		}
+		delay := minDelay
+		for i := 1; i < attempt && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		return delay, true
+	}
+}
+
+// LockOwner sets the ID this process uses when it holds the lease for migrating
+// a datastore. A process can take over a lease held under its own ID immediately,
+// without waiting for it to expire
+func LockOwner(owner string) Option {
+	return func(cfg *Config) {
+		cfg.LockOwner = owner
+	}
+}
+
+// LockTTL sets how long the migration lease lasts without being renewed, after
+// which it is considered stale and another process may take it over. Migrating
+// fails if it's under 3ms. Zero uses the default of 30 seconds
+func LockTTL(ttl time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.LockTTL = ttl
+	}
+}
+
+// VersionsNamespace sets where versioning keeps its own records, like the
+// current version and the migration lease. It must not overlap the namespace
+// for any version, or any unversioned data in the datastore
+func VersionsNamespace(namespace datastore.Key) Option {
+	return func(cfg *Config) {
+		cfg.VersionsNamespace = namespace
+	}
+}
+
+// CodeVersion sets the version of the code using the store, which is recorded
+// alongside the version of the data whenever it is written
+func CodeVersion(version string) Option {
+	return func(cfg *Config) {
+		cfg.CodeVersion = version
+	}
+}
+
+// MinReaderVersion records that code which understands the given version of the
+// data can still read the store, even if the store is at a later version. Such
+// code leaves the store at the later version when it migrates, serves reads from
+// it, and fails writes with ErrStoreTooNew
+func MinReaderVersion(version VersionKey) Option {
+	return func(cfg *Config) {
+		cfg.MinReaderVersion = version
+	}
+}
+
+// SchemaFingerprint sets the fingerprint of the schema of the records at the
+// target version, for stores whose migrations don't say what type they produce.
+// Use the fingerprint package to compute it from the record type
+func SchemaFingerprint(fingerprint string) Option {
+	return func(cfg *Config) {
+		cfg.SchemaFingerprint = fingerprint
+	}
+}
+
+// LazyMigration makes a versioned store move up to its target version without
+// migrating its records first, when the target is one version up and its
+// migration can migrate records one at a time. Records are then migrated the
+// first time they're read, and the rest in the background, after which the
+// previous version's namespace is deleted. Other migrations still run all at once
+func LazyMigration() Option {
+	return func(cfg *Config) {
+		cfg.LazyMigration = true
+	}
+}
+
+// OnlineMigration keeps a versioned store usable while migrations run. During
+// the version step into the target version, if its migration can migrate records
+// one at a time both ways, writes go to the target version, and, migrated back
+// with the reverse of the step's migration, to the version it migrates from.
+// Reads are served from the target version, with records that haven't been
+// copied yet migrated forward. Records written while the step copies records
+// aren't copied again. During earlier steps, and between steps, operations wait.
+// LazyMigration takes precedence over it
+func OnlineMigration() Option {
+	return func(cfg *Config) {
+		cfg.OnlineMigration = true
+	}
+}
+
+// StaleReads lets a versioned store serve reads before migrations are complete,
+// from the version the store is at, with records migrated to the target version
+// as they're read but not written back. This works while the store is one version
+// below the target and the migration to it can migrate records one at a time.
+// Reads don't wait for migrations even with WaitForReady, and writes are still
+// blocked until the store is ready. Records read this way can't be changed
+func StaleReads() Option {
+	return func(cfg *Config) {
+		cfg.StaleReads = true
+	}
+}
+
+// BlueGreen makes a versioned store resolve the namespace it reads and writes
+// through the version it's at, and implement Promoter. The next version can be
+// staged -- built alongside the current one -- and checked before the store is
+// promoted to it, which switches existing handles to the new version once the
+// operations in flight are done. LazyMigration and OnlineMigration take
+// precedence over it
+func BlueGreen() Option {
+	return func(cfg *Config) {
+		cfg.BlueGreen = true
+	}
+}
@@ -12,8 +12,13 @@ import (
 
 	"github.com/filecoin-project/go-statestore"
 
+	"github.com/filecoin-project/go-ds-versioning/internal/bluegreen"
+	"github.com/filecoin-project/go-ds-versioning/internal/compat"
+	"github.com/filecoin-project/go-ds-versioning/internal/lazy"
 	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	"github.com/filecoin-project/go-ds-versioning/internal/online"
 	"github.com/filecoin-project/go-ds-versioning/internal/runner"
+	"github.com/filecoin-project/go-ds-versioning/internal/stale"
 	"github.com/filecoin-project/go-ds-versioning/internal/utils"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 )
@@ -34,47 +39,168 @@ type StateStore interface {
 }
 
 type migratedStateStore struct {
-	ss *statestore.StateStore
-	ms versioning.MigrationState
+	ss      *statestore.StateStore
+	gate    utils.ReadyGate
+	sweeper versioning.Sweeper
+	// stale serves reads until migrations are complete, if set
+	stale *statestore.StateStore
+	// promoter stages and promotes versions, if set
+	promoter versioning.Promoter
+	// compat serves reads when migrations leave the store at a newer version
+	// that this code can read but not write
+	compat   *compat.Datastore
+	compatSs *statestore.StateStore
 }
 
 // NewVersionedStateStore sets takes a datastore, fsm parameters, migrations list, and target version, and returns
-// an fsm whose functions will fail till it's migrated to the target version and a function to run migrations
-func NewVersionedStateStore(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey) (StateStore, func(context.Context) error) {
-	r := runner.NewRunner(ds, migrations, target, migrate.To)
-	ss := statestore.New(namespace.Wrap(ds, datastore.NewKey(string(target))))
-	return NewMigratedStateStore(ss, r), r.Migrate
+// an fsm whose functions will fail till it's migrated to the target version and a function to run migrations.
+// With versioning.BlueGreen, the store implements versioning.Promoter
+func NewVersionedStateStore(ds datastore.Batching, migrations versioning.VersionedMigrationList, target versioning.VersionKey, opts ...versioning.Option) (StateStore, func(context.Context) error) {
+	m := migrate.NewMigrator(opts...)
+	cfg := versioning.NewConfig(opts...)
+	bind := func(version versioning.VersionKey) datastore.Batching {
+		return namespace.Wrap(ds, datastore.NewKey(string(version)))
+	}
+	versionDs := bind(target)
+	compatDs := compat.NewDatastore(ds)
+	var r *runner.Runner
+	var ms versioning.MigrationState
+	var sweeper versioning.Sweeper
+	var promoter versioning.Promoter
+	switch {
+	case cfg.LazyMigration:
+		lazyDs := lazy.NewDatastore(ds, versionDs)
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(lazyDs.RunMigrations(m)), opts...)
+		versionDs, ms, sweeper = lazyDs, r, lazyDs
+	case cfg.OnlineMigration:
+		onlineDs := online.NewDatastore(versionDs)
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(onlineDs.RunMigrations(m)), opts...)
+		versionDs, ms = onlineDs, onlineDs.MigrationState(r)
+	case cfg.BlueGreen:
+		blueGreenDs := bluegreen.NewDatastore(ds, migrations, target, m, bind)
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(blueGreenDs.RunMigrations(m)), opts...)
+		versionDs, ms, promoter = blueGreenDs, r, blueGreenDs
+	default:
+		r = runner.NewRunner(ds, migrations, target, compatDs.RunMigrations(m.To), opts...)
+		ms = r
+	}
+	mss := &migratedStateStore{ss: statestore.New(versionDs), gate: utils.NewReadyGate(ms, cfg), sweeper: sweeper, promoter: promoter,
+		compat: compatDs, compatSs: statestore.New(compatDs)}
+	if cfg.StaleReads {
+		mss.stale = statestore.New(stale.NewDatastore(ds, migrations, target, ms, opts...))
+	}
+	return mss, r.Migrate
 }
 
 // NewMigratedStateStore returns an fsm whose functions will fail until the migration state says its ready
-func NewMigratedStateStore(ss *statestore.StateStore, ms versioning.MigrationState) StateStore {
-	return &migratedStateStore{ss, ms}
+func NewMigratedStateStore(ss *statestore.StateStore, ms versioning.MigrationState, opts ...versioning.Option) StateStore {
+	return &migratedStateStore{ss: ss, gate: utils.NewReadyGate(ms, versioning.NewConfig(opts...))}
+}
+
+// reader returns the state store to read from, which is the stale view of the
+// store when there is one and migrations are not yet complete, or the newer
+// version the store was left at when this code can only read it
+func (mss *migratedStateStore) reader() (*statestore.StateStore, error) {
+	if mss.stale == nil {
+		if err := mss.gate.ReadyWithTimeout(); err != nil {
+			return mss.ss, err
+		}
+	} else if err := mss.gate.ReadyNow(); err != nil {
+		return mss.stale, nil
+	}
+	if mss.compat != nil && mss.compat.Reading() {
+		return mss.compatSs, nil
+	}
+	return mss.ss, nil
+}
+
+// writable returns an error if the store can't be written, because migrations
+// are not yet complete or left it at a version this code can only read
+func (mss *migratedStateStore) writable(wait func() error) error {
+	if err := wait(); err != nil {
+		return err
+	}
+	if mss.compat != nil {
+		return mss.compat.Writable()
+	}
+	return nil
 }
 
 func (mss *migratedStateStore) Begin(i interface{}, state interface{}) error {
-	if err := mss.ms.ReadyError(); err != nil {
+	if err := mss.writable(mss.gate.ReadyWithTimeout); err != nil {
 		return err
 	}
 	return mss.ss.Begin(i, state)
 }
 
 func (mss *migratedStateStore) Get(i interface{}) StoredState {
-	if err := mss.ms.ReadyError(); err != nil {
+	ss, err := mss.reader()
+	if err != nil {
 		return &utils.NotReadyStoredState{Err: err}
 	}
-	return mss.ss.Get(i)
+	return ss.Get(i)
 }
 
 func (mss *migratedStateStore) Has(i interface{}) (bool, error) {
-	if err := mss.ms.ReadyError(); err != nil {
+	ss, err := mss.reader()
+	if err != nil {
 		return false, err
 	}
-	return mss.ss.Has(i)
+	return ss.Has(i)
 }
 
 func (mss *migratedStateStore) List(out interface{}) error {
-	if err := mss.ms.ReadyError(); err != nil {
+	ss, err := mss.reader()
+	if err != nil {
+		return err
+	}
+	return ss.List(out)
+}
+
+// Retry runs migrations again if they failed previously
+func (mss *migratedStateStore) Retry(ctx context.Context) error {
+	return mss.gate.Retry(ctx)
+}
+
+// Cancel stops running migrations and rolls back the partially migrated version step
+func (mss *migratedStateStore) Cancel(ctx context.Context) error {
+	return mss.gate.Cancel(ctx)
+}
+
+// WaitSwept waits for records still at the previous version to be migrated, when
+// the store is migrated lazily
+func (mss *migratedStateStore) WaitSwept(ctx context.Context) error {
+	if mss.sweeper == nil {
+		return nil
+	}
+	return mss.sweeper.WaitSwept(ctx)
+}
+
+// Stage builds the next version alongside the current one, if the store can stage
+// and promote versions
+func (mss *migratedStateStore) Stage(ctx context.Context, version versioning.VersionKey) error {
+	if err := mss.writable(func() error { return mss.gate.Ready(ctx) }); err != nil {
 		return err
 	}
-	return mss.ss.List(out)
+	if mss.promoter == nil {
+		return versioning.ErrPromoteNotSupported
+	}
+	return mss.promoter.Stage(ctx, version)
 }
+
+// Promote switches the store to a staged version, if the store can stage and
+// promote versions
+func (mss *migratedStateStore) Promote(ctx context.Context, version versioning.VersionKey) error {
+	if err := mss.writable(func() error { return mss.gate.Ready(ctx) }); err != nil {
+		return err
+	}
+	if mss.promoter == nil {
+		return versioning.ErrPromoteNotSupported
+	}
+	return mss.promoter.Promote(ctx, version)
+}
+
+var _ versioning.Retrier = &migratedStateStore{}
+var _ versioning.Canceller = &migratedStateStore{}
+var _ versioning.Sweeper = &migratedStateStore{}
+var _ versioning.Promoter = &migratedStateStore{}
@@ -3,15 +3,41 @@ package versioning
 
 import (
 	"context"
+	"reflect"
 
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 )
 
 // MigrationFunc is a function to transform an single element of one type of data into
 // a single element of another type of data. It has the following form:
 // func<T extends cbg.CBORUnmarshaller, U extends cbg.CBORMarshaller>(old T) (new U, error)
+// A migration function that needs to read other records can also take an Accessor:
+// func<T extends cbg.CBORUnmarshaller, U extends cbg.CBORMarshaller>(old T, accessor Accessor) (new U, error)
 type MigrationFunc interface{}
 
+// Accessor gives a migration function read-only access to records other than the
+// one it is migrating: the rest of the namespace it is migrating from, and any
+// other stores given to the migration builder. Reads use the context the migration
+// runs in
+type Accessor interface {
+	// Get returns the stored bytes of a record
+	Get(key datastore.Key) ([]byte, error)
+	// Has returns whether a record exists
+	Has(key datastore.Key) (bool, error)
+	// Load reads a record into v, decoding it with the migration's input codec,
+	// or as CBOR for other stores
+	Load(key datastore.Key, v interface{}) error
+	// Query runs a query over the records
+	Query(q query.Query) (query.Results, error)
+	// Store returns an accessor for another store given to the migration builder
+	Store(name string) (Accessor, error)
+}
+
+// RawMigrationFunc transforms the stored bytes of a single record directly, without
+// decoding or encoding it
+type RawMigrationFunc func(key datastore.Key, old []byte) ([]byte, error)
+
 // DatastoreMigration can run a migration of a datastore that is a table
 // of one kind of structured data and write it to a table that is another kind of
 // structured data
@@ -19,12 +45,49 @@ type DatastoreMigration interface {
 	Up(ctx context.Context, oldDs datastore.Batching, newDS datastore.Batching) ([]datastore.Key, error)
 }
 
+// RecordMigration is a migration that can migrate records one at a time, so a
+// store can be migrated lazily as its records are read. Every migration the
+// builders make can
+type RecordMigration interface {
+	// MigrateRecord migrates a single record read from oldDs, which is the rest
+	// of the namespace being migrated from. It returns false if the migration
+	// leaves the record out
+	MigrateRecord(ctx context.Context, oldDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error)
+}
+
+// ReversibleRecordMigration is a record migration that can also migrate records
+// back one at a time
+type ReversibleRecordMigration interface {
+	RecordMigration
+	// MigrateRecordDown migrates a single record back, read from newDs, which is
+	// the rest of the namespace being migrated back from. It returns false if the
+	// migration leaves the record out
+	MigrateRecordDown(ctx context.Context, newDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error)
+}
+
 // ReversableDatastoreMigration is
 type ReversableDatastoreMigration interface {
 	DatastoreMigration
 	Down(ctx context.Context, newDs datastore.Batching, oldDS datastore.Batching) ([]datastore.Key, error)
 }
 
+// Codec reads and writes the values of records in a datastore
+type Codec interface {
+	// Decode reads data into v, which is a pointer to a record
+	Decode(data []byte, v interface{}) error
+	// Encode writes v, a record, to bytes
+	Encode(v interface{}) ([]byte, error)
+}
+
+// CodecTypeChecker is implemented by codecs that only work with some types, so
+// migration functions can be checked when they are built rather than when they run
+type CodecTypeChecker interface {
+	// CheckDecode returns an error if the codec cannot read records of type t
+	CheckDecode(t reflect.Type) error
+	// CheckEncode returns an error if the codec cannot write records of type t
+	CheckEncode(t reflect.Type) error
+}
+
 // VersionKey is an identifier for a databased version
 type VersionKey string
 
@@ -43,6 +106,73 @@ type ReversibleVersionedMigration interface {
 	Down(ctx context.Context, ds datastore.Batching) ([]datastore.Key, error)
 }
 
+// DataCompatibleMigration is a migration that cannot be reversed, but whose
+// records the previous version can read as they are. Migrating down past it just
+// moves records back to the previous version's namespace
+type DataCompatibleMigration interface {
+	VersionedMigration
+	DataCompatible() bool
+}
+
+// WrappedMigration is a migration that wraps another migration, changing only the
+// methods it implements itself
+type WrappedMigration interface {
+	VersionedMigration
+	Unwrap() VersionedMigration
+}
+
+// MigrationAs finds the first migration that implements T, starting with the
+// given migration and following the migrations it wraps, so that the optional
+// interfaces of a wrapped migration are still found
+func MigrationAs[T any](migration VersionedMigration) (T, bool) {
+	for {
+		if found, ok := migration.(T); ok {
+			return found, true
+		}
+		wrapped, ok := migration.(WrappedMigration)
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		migration = wrapped.Unwrap()
+	}
+}
+
+// IndexEntry is a single entry in a secondary index
+type IndexEntry struct {
+	Key   datastore.Key
+	Value []byte
+}
+
+// IndexFunc derives the index entries for a record from its key and stored value.
+// It returns no entries for records that shouldn't be indexed
+type IndexFunc func(key datastore.Key, value []byte) ([]IndexEntry, error)
+
+// Index is a secondary index of the records at a version, kept under the versions
+// namespace and built from the records when the version is migrated to
+type Index struct {
+	// Name identifies the index among the indexes for its version. It must be a
+	// single key component
+	Name string
+	// Entries derives the entries for each record
+	Entries IndexFunc
+}
+
+// IndexedMigration is a migration that declares indexes of the records it
+// produces. They are built when it runs, and dropped when its records are
+type IndexedMigration interface {
+	VersionedMigration
+	Indexes() []Index
+}
+
+// TypedMigration is a migration that can report the types of records it reads
+// and writes, so that lists of migrations can be checked for type continuity.
+// A nil type means the type is not known
+type TypedMigration interface {
+	InputType() reflect.Type
+	OutputType() reflect.Type
+}
+
 // VersionedMigrationList is a sortable list of versioned migrations
 type VersionedMigrationList []VersionedMigration
 
@@ -67,6 +197,59 @@ type MigrationState interface {
 	ReadyError() error
 }
 
+// ReadyWaiter is a MigrationState that can block until migrations complete
+type ReadyWaiter interface {
+	MigrationState
+	// WaitReady blocks until migrations have finished or the context expires,
+	// then returns the same value as ReadyError
+	WaitReady(ctx context.Context) error
+}
+
+// Retrier is implemented by versioned stores whose migrations can be run
+// again after they fail
+type Retrier interface {
+	// Retry runs migrations again if the last attempt failed, and returns the result
+	Retry(ctx context.Context) error
+}
+
+// Canceller is implemented by versioned stores whose running migrations can be stopped
+type Canceller interface {
+	// Cancel stops running migrations and waits for any partially migrated
+	// version step to be rolled back
+	Cancel(ctx context.Context) error
+}
+
+// IndexQuerier is implemented by versioned stores that keep the secondary indexes
+// of their current version up to date as records are written
+type IndexQuerier interface {
+	// GetIndexEntry returns the value of a single entry in an index
+	GetIndexEntry(ctx context.Context, index string, key datastore.Key) ([]byte, error)
+	// QueryIndex runs a query over the entries of an index
+	QueryIndex(ctx context.Context, index string, q query.Query) (query.Results, error)
+}
+
+// Sweeper is implemented by versioned stores that migrate records lazily, as
+// they are read, and sweep up the rest in the background
+type Sweeper interface {
+	// WaitSwept blocks until every record left at the previous version has been
+	// migrated and the previous version's namespace deleted, or the context
+	// expires. It returns the error the sweep stopped with, if any, and returns
+	// immediately if nothing is being swept
+	WaitSwept(ctx context.Context) error
+}
+
+// Promoter is implemented by versioned stores that can build the next version
+// of their records alongside the current one, and switch to it in one step
+type Promoter interface {
+	// Stage builds a version one up from the version the store is at, alongside
+	// it, without changing what the store reads and writes
+	Stage(ctx context.Context, version VersionKey) error
+	// Promote switches the store to a staged version. Operations that started
+	// before it finish against the previous version, and operations that start
+	// after it use the new one
+	Promote(ctx context.Context, version VersionKey) error
+}
+
 type readyError string
 
 func (re readyError) Error() string {
@@ -78,3 +261,39 @@ const ErrMigrationsNotRun = readyError("Database not migrations must be run or a
 
 // ErrContextCancelled means the context the migrations were run in was cancelled
 const ErrContextCancelled = readyError("context cancelled")
+
+// ErrMigrationsCancelled means migrations were cancelled while running, and the
+// partially migrated version step was rolled back
+const ErrMigrationsCancelled = readyError("migrations were cancelled")
+
+// ErrCancelNotSupported means the migration state for a store cannot cancel migrations
+const ErrCancelNotSupported = readyError("migrations for this store cannot be cancelled")
+
+// ErrRetryNotSupported means the migration state for a store cannot retry migrations
+const ErrRetryNotSupported = readyError("migrations for this store cannot be retried")
+
+// ErrPromoteNotSupported means a store cannot stage and promote versions
+const ErrPromoteNotSupported = readyError("this store cannot stage and promote versions")
+
+// ErrMigrationLocked means another process holds the lease for migrating the datastore
+const ErrMigrationLocked = readyError("migrations are locked by another process")
+
+// ErrNamespaceCollision means the namespace versioning keeps its own records in
+// overlaps a version namespace or existing data
+const ErrNamespaceCollision = readyError("versions namespace collides with data")
+
+// ErrStoreTooNew means the datastore is at a version this code does not know
+// how to read or migrate down from
+const ErrStoreTooNew = readyError("database version is newer than this code supports")
+
+// ErrIrreversibleMigration means migrating down would require reversing a migration
+// that cannot be reversed
+const ErrIrreversibleMigration = readyError("migration is not reversible")
+
+// ErrSchemaDrift means the records at the target version were written with a
+// different schema than the record type this code uses for that version
+const ErrSchemaDrift = readyError("record schema does not match the schema this version was written with")
+
+// ErrStaleReadOnly means a write was made through a stale view of a store, which
+// serves records from the previous version while migrations run
+const ErrStaleReadOnly = readyError("stale reads cannot be written back")
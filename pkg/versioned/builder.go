@@ -1,8 +1,11 @@
 package versioned
 
 import (
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	"go.uber.org/multierr"
 
+	"github.com/filecoin-project/go-ds-versioning/internal/validate"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	"github.com/filecoin-project/go-ds-versioning/pkg/builder"
 )
@@ -12,7 +15,14 @@ type Builder interface {
 	Reversible(down versioning.MigrationFunc) Builder
 	FilterKeys([]string) Builder
 	Only([]string) Builder
+	Select(...query.Filter) Builder
+	Exclude(...query.Filter) Builder
+	WithStore(name string, ds datastore.Read) Builder
 	OldVersion(versioning.VersionKey) Builder
+	InputCodec(versioning.Codec) Builder
+	OutputCodec(versioning.Codec) Builder
+	DataCompatible() Builder
+	Index(name string, entries versioning.IndexFunc) Builder
 	Build() (versioning.VersionedMigration, error)
 }
 
@@ -20,27 +30,95 @@ type versionedBuilder struct {
 	base       builder.Builder
 	newVersion versioning.VersionKey
 	oldVersion versioning.VersionKey
+	compatible bool
+	indexes    []versioning.Index
 }
 
-// NewVersionedBuilder returns a new versioned builder for the given migration function
+// NewVersionedBuilder returns a new versioned builder for the given migration function,
+// which may be a raw migration function as for NewRaw
 func NewVersionedBuilder(up versioning.MigrationFunc, newVersion versioning.VersionKey) Builder {
-	return versionedBuilder{builder.NewMigrationBuilder(up), newVersion, ""}
+	return versionedBuilder{builder.NewMigrationBuilder(up), newVersion, "", false, nil}
+}
+
+// New returns a new versioned builder for a typed migration function, which is
+// checked at compile time rather than when the migration is built
+func New[T any, U any, PT builder.Record[T], PU builder.Record[U]](up func(PT) (PU, error), newVersion versioning.VersionKey) Builder {
+	return versionedBuilder{builder.New(up), newVersion, "", false, nil}
+}
+
+// NewReversible returns a new versioned builder for a pair of typed migration
+// functions that are inverses of each other
+func NewReversible[T any, U any, PT builder.Record[T], PU builder.Record[U]](up func(PT) (PU, error), down func(PU) (PT, error), newVersion versioning.VersionKey) Builder {
+	return versionedBuilder{builder.NewReversible(up, down), newVersion, "", false, nil}
+}
+
+// NewRaw returns a new versioned builder for a migration that transforms the
+// stored bytes of each record directly
+func NewRaw(up versioning.RawMigrationFunc, newVersion versioning.VersionKey) Builder {
+	return versionedBuilder{builder.NewRaw(up), newVersion, "", false, nil}
+}
+
+// NewRawReversible returns a new versioned builder for a migration that transforms
+// the stored bytes of each record directly in both directions
+func NewRawReversible(up versioning.RawMigrationFunc, down versioning.RawMigrationFunc, newVersion versioning.VersionKey) Builder {
+	return versionedBuilder{builder.NewRawReversible(up, down), newVersion, "", false, nil}
+}
+
+// NewDispatch returns a new versioned builder for a migration that sends each
+// record to the first route that matches it, so record types that share a
+// namespace are all migrated in one version step
+func NewDispatch(newVersion versioning.VersionKey, routes ...builder.Route) Builder {
+	return versionedBuilder{builder.NewDispatch(routes...), newVersion, "", false, nil}
 }
 
 func (vb versionedBuilder) Reversible(down versioning.MigrationFunc) Builder {
-	return versionedBuilder{vb.base.Reversible(down), vb.newVersion, vb.oldVersion}
+	return versionedBuilder{vb.base.Reversible(down), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
 }
 
 func (vb versionedBuilder) FilterKeys(keys []string) Builder {
-	return versionedBuilder{vb.base.FilterKeys(keys), vb.newVersion, vb.oldVersion}
+	return versionedBuilder{vb.base.FilterKeys(keys), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
 }
 
 func (vb versionedBuilder) Only(keys []string) Builder {
-	return versionedBuilder{vb.base.Only(keys), vb.newVersion, vb.oldVersion}
+	return versionedBuilder{vb.base.Only(keys), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
+}
+
+func (vb versionedBuilder) Select(filters ...query.Filter) Builder {
+	return versionedBuilder{vb.base.Select(filters...), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
+}
+
+func (vb versionedBuilder) Exclude(filters ...query.Filter) Builder {
+	return versionedBuilder{vb.base.Exclude(filters...), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
+}
+
+func (vb versionedBuilder) WithStore(name string, ds datastore.Read) Builder {
+	return versionedBuilder{vb.base.WithStore(name, ds), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
+}
+
+func (vb versionedBuilder) InputCodec(inputCodec versioning.Codec) Builder {
+	return versionedBuilder{vb.base.InputCodec(inputCodec), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
+}
+
+func (vb versionedBuilder) OutputCodec(outputCodec versioning.Codec) Builder {
+	return versionedBuilder{vb.base.OutputCodec(outputCodec), vb.newVersion, vb.oldVersion, vb.compatible, vb.indexes}
 }
 
 func (vb versionedBuilder) OldVersion(oldVersion versioning.VersionKey) Builder {
-	return versionedBuilder{vb.base, vb.newVersion, oldVersion}
+	return versionedBuilder{vb.base, vb.newVersion, oldVersion, vb.compatible, vb.indexes}
+}
+
+// DataCompatible marks a migration that cannot be reversed, but whose output the
+// previous version can still read, so it is safe to migrate down past it
+func (vb versionedBuilder) DataCompatible() Builder {
+	return versionedBuilder{vb.base, vb.newVersion, vb.oldVersion, true, vb.indexes}
+}
+
+// Index declares a secondary index of the records this migration produces. The
+// index is built from the migrated records as part of the version step, kept under
+// the versions namespace, and dropped when the records at this version are
+func (vb versionedBuilder) Index(name string, entries versioning.IndexFunc) Builder {
+	indexes := append(vb.indexes[:len(vb.indexes):len(vb.indexes)], versioning.Index{Name: name, Entries: entries})
+	return versionedBuilder{vb.base, vb.newVersion, vb.oldVersion, vb.compatible, indexes}
 }
 
 func (vb versionedBuilder) Build() (versioning.VersionedMigration, error) {
@@ -48,14 +126,22 @@ func (vb versionedBuilder) Build() (versioning.VersionedMigration, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewVersionedMigration(baseMigration, vb.oldVersion, vb.newVersion), nil
+	if err := validate.CheckIndexes(vb.indexes); err != nil {
+		return nil, err
+	}
+	migration := newVersionedMigration(baseMigration, vb.oldVersion, vb.newVersion, vb.indexes)
+	if vb.compatible {
+		migration = DataCompatible(migration)
+	}
+	return migration, nil
 }
 
 // BuilderList is a list of versioned builders that can be built into a single
 // command to a VersionedMigrationList
 type BuilderList []Builder
 
-// Build creates a VersionedMigrationList from a list of VersionedBuilders in a single step
+// Build creates a VersionedMigrationList from a list of VersionedBuilders in a single step,
+// and if every migration builds, validates the list as a whole
 func (vbl BuilderList) Build() (versioning.VersionedMigrationList, error) {
 	var migrations versioning.VersionedMigrationList
 	var err error
@@ -67,5 +153,8 @@ func (vbl BuilderList) Build() (versioning.VersionedMigrationList, error) {
 			migrations = append(migrations, migration)
 		}
 	}
+	if err == nil {
+		err = Validate(migrations)
+	}
 	return migrations, err
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/ipfs/go-datastore"
 	"github.com/stretchr/testify/require"
 	cbg "github.com/whyrusleeping/cbor-gen"
 
@@ -25,6 +26,13 @@ func TestVersionedBuilderTest(t *testing.T) {
 
 	migration, err := builder.NewMigrationBuilder(migrateFunc).Reversible(unmigrateFunc).Build()
 	require.NoError(t, err)
+	irreversible, err := builder.NewMigrationBuilder(migrateFunc).Build()
+	require.NoError(t, err)
+	byValue := func(key datastore.Key, value []byte) ([]versioning.IndexEntry, error) {
+		return []versioning.IndexEntry{{Key: datastore.NewKey(string(value)), Value: key.Bytes()}}, nil
+	}
+	selected, err := builder.NewMigrationBuilder(migrateFunc).Select(builder.KeyPrefix("/apples")).Exclude(builder.KeyGlob("/apples/*")).Build()
+	require.NoError(t, err)
 
 	testCases := map[string]struct {
 		builder           versioned.Builder
@@ -41,11 +49,37 @@ func TestVersionedBuilderTest(t *testing.T) {
 			expectedErr:       nil,
 			expectedMigration: versioned.NewInitialVersionedMigration(migration, "2"),
 		},
+		"data compatible": {
+			builder:           versioned.NewVersionedBuilder(migrateFunc, "2").OldVersion("1").DataCompatible(),
+			expectedErr:       nil,
+			expectedMigration: versioned.DataCompatible(versioned.NewVersionedMigration(irreversible, "1", "2")),
+		},
+		"selected keys": {
+			builder:           versioned.NewVersionedBuilder(migrateFunc, "2").Select(builder.KeyPrefix("/apples")).Exclude(builder.KeyGlob("/apples/*")).OldVersion("1"),
+			expectedErr:       nil,
+			expectedMigration: versioned.NewVersionedMigration(selected, "1", "2"),
+		},
 		"builder error": {
 			builder:           versioned.NewVersionedBuilder(7, "2"),
 			expectedErr:       errors.New("migration must be a function"),
 			expectedMigration: nil,
 		},
+		"index with no name": {
+			builder:     versioned.NewVersionedBuilder(migrateFunc, "2").OldVersion("1").Index("", byValue),
+			expectedErr: errors.New("index name \"\" must be a single key component"),
+		},
+		"index name with more than one component": {
+			builder:     versioned.NewVersionedBuilder(migrateFunc, "2").OldVersion("1").Index("by/value", byValue),
+			expectedErr: errors.New("index name \"by/value\" must be a single key component"),
+		},
+		"index with no entries function": {
+			builder:     versioned.NewVersionedBuilder(migrateFunc, "2").OldVersion("1").Index("byValue", nil),
+			expectedErr: errors.New("index \"byValue\" has no entries function"),
+		},
+		"two indexes with the same name": {
+			builder:     versioned.NewVersionedBuilder(migrateFunc, "2").OldVersion("1").Index("byValue", byValue).Index("byValue", byValue),
+			expectedErr: errors.New("more than one index named \"byValue\""),
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -59,3 +93,75 @@ func TestVersionedBuilderTest(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionedBuilderRaw(t *testing.T) {
+	fix := func(key datastore.Key, old []byte) ([]byte, error) {
+		return append([]byte("fixed:"), old...), nil
+	}
+	migration, err := versioned.NewVersionedBuilder(fix, "2").OldVersion("1").Build()
+	require.NoError(t, err)
+	require.Equal(t, versioning.VersionKey("2"), migration.NewVersion())
+	_, ok := migration.(versioning.RecordMigration)
+	require.True(t, ok)
+}
+
+func TestBuilderList(t *testing.T) {
+	intToInt := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		return c, nil
+	}
+	intToBool := func(c *cbg.CborInt) (*cbg.CborBool, error) {
+		out := cbg.CborBool(*c != 0)
+		return &out, nil
+	}
+	testCases := map[string]struct {
+		builders    versioned.BuilderList
+		expectedErr error
+	}{
+		"valid list": {
+			builders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(intToBool, "2").OldVersion("1"),
+			},
+		},
+		"typed builders": {
+			builders: versioned.BuilderList{
+				versioned.New(intToInt, "1"),
+				versioned.NewReversible(intToInt, intToInt, "2").OldVersion("1"),
+				versioned.NewVersionedBuilder(intToBool, "3").OldVersion("2"),
+			},
+		},
+		"versions that don't sort lexically": {
+			builders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(intToInt, "a"),
+				versioned.NewVersionedBuilder(intToInt, "b").OldVersion("a"),
+				versioned.NewVersionedBuilder(intToBool, "9").OldVersion("b"),
+			},
+		},
+		"builder error": {
+			builders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(intToInt, "1"),
+				versioned.NewVersionedBuilder(7, "2"),
+			},
+			expectedErr: errors.New("migration must be a function"),
+		},
+		"invalid list": {
+			builders: versioned.BuilderList{
+				versioned.NewVersionedBuilder(intToBool, "1"),
+				versioned.NewVersionedBuilder(intToInt, "2"),
+			},
+			expectedErr: errors.New("migrations to versions \"1\" and \"2\" both start from an unversioned datastore (missing OldVersion?)"),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			migrations, err := data.builders.Build()
+			if data.expectedErr == nil {
+				require.NoError(t, err)
+				require.Len(t, migrations, len(data.builders))
+				require.NoError(t, versioned.Validate(migrations))
+			} else {
+				require.EqualError(t, err, data.expectedErr.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package versioned
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+
+	"github.com/filecoin-project/go-ds-versioning/internal/migrate"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
+	"github.com/filecoin-project/go-ds-versioning/pkg/builder"
+)
+
+// TypedIndex converts a function that derives index entries from a decoded
+// cbor-gen record into an index function
+func TypedIndex[T any, PT builder.Record[T]](entries func(key datastore.Key, record PT) ([]versioning.IndexEntry, error)) versioning.IndexFunc {
+	return func(key datastore.Key, value []byte) ([]versioning.IndexEntry, error) {
+		record := PT(new(T))
+		if err := record.UnmarshalCBOR(bytes.NewReader(value)); err != nil {
+			return nil, err
+		}
+		return entries(key, record)
+	}
+}
+
+// OpenIndex returns read-only access to the entries of an index of the records
+// at a version
+func OpenIndex(ds datastore.Batching, version versioning.VersionKey, name string, opts ...versioning.Option) datastore.Read {
+	return namespace.Wrap(ds, migrate.NewMigrator(opts...).IndexNamespace(version, name))
+}
+
+// RebuildIndex drops an index of the records at the datastore's current version
+// and builds it again from the records as they are now, say to fill in an index
+// that was added to a version after the datastore was migrated to it, or to
+// repair one. It holds the migration lease while it runs, and fails if the
+// datastore is not at the given version
+func RebuildIndex(ctx context.Context, ds datastore.Batching, version versioning.VersionKey, index versioning.Index, opts ...versioning.Option) error {
+	return migrate.RebuildIndex(ctx, ds, version, index, opts...)
+}
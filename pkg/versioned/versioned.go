@@ -5,10 +5,12 @@ package versioned
 
 import (
 	"context"
+	"reflect"
 
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
 
+	"github.com/filecoin-project/go-ds-versioning/internal/validate"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 )
 
@@ -24,6 +26,7 @@ type versionedMigration struct {
 	oldKey    versioning.VersionKey
 	newKey    versioning.VersionKey
 	migration versioning.DatastoreMigration
+	indexes   []versioning.Index
 }
 
 func (vm versionedMigration) OldVersion() versioning.VersionKey {
@@ -38,24 +41,127 @@ func (vm versionedMigration) Up(ctx context.Context, ds datastore.Batching) ([]d
 	return versionMigrate(ctx, vm.migration.Up, ds, vm.oldKey, vm.newKey)
 }
 
+func (vm versionedMigration) down(ctx context.Context, ds datastore.Batching) ([]datastore.Key, error) {
+	return versionMigrate(ctx, vm.migration.(versioning.ReversableDatastoreMigration).Down, ds, vm.newKey, vm.oldKey)
+}
+
+func (vm versionedMigration) Indexes() []versioning.Index {
+	return vm.indexes
+}
+
+func (vm versionedMigration) InputType() reflect.Type {
+	if typed, ok := vm.migration.(versioning.TypedMigration); ok {
+		return typed.InputType()
+	}
+	return nil
+}
+
+func (vm versionedMigration) OutputType() reflect.Type {
+	if typed, ok := vm.migration.(versioning.TypedMigration); ok {
+		return typed.OutputType()
+	}
+	return nil
+}
+
 type reversibleVersionedMigration struct {
 	versionedMigration
 }
 
 func (rvm reversibleVersionedMigration) Down(ctx context.Context, ds datastore.Batching) ([]datastore.Key, error) {
-	return versionMigrate(ctx, rvm.migration.(versioning.ReversableDatastoreMigration).Down, ds, rvm.newKey, rvm.oldKey)
+	return rvm.down(ctx, ds)
+}
+
+// recordVersionedMigration is a versioned migration whose datastore migration
+// can migrate records one at a time
+type recordVersionedMigration struct {
+	versionedMigration
+}
+
+// MigrateRecord migrates a single record, read from the old version's namespace
+func (rvm recordVersionedMigration) MigrateRecord(ctx context.Context, oldDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error) {
+	return rvm.migration.(versioning.RecordMigration).MigrateRecord(ctx, oldDs, key, value)
+}
+
+type reversibleRecordVersionedMigration struct {
+	recordVersionedMigration
+}
+
+func (rrvm reversibleRecordVersionedMigration) Down(ctx context.Context, ds datastore.Batching) ([]datastore.Key, error) {
+	return rrvm.down(ctx, ds)
+}
+
+// recordsBothWaysVersionedMigration is a reversible versioned migration whose
+// datastore migration can migrate records one at a time in both directions
+type recordsBothWaysVersionedMigration struct {
+	reversibleRecordVersionedMigration
+}
+
+// MigrateRecordDown migrates a single record back, read from the new version's
+// namespace
+func (rbvm recordsBothWaysVersionedMigration) MigrateRecordDown(ctx context.Context, newDs datastore.Read, key datastore.Key, value []byte) ([]byte, bool, error) {
+	return rbvm.migration.(versioning.ReversibleRecordMigration).MigrateRecordDown(ctx, newDs, key, value)
 }
 
 // NewVersionedMigration converts a datastore migration to a versioned migration with the given old and new versions
 func NewVersionedMigration(datastoreMigration versioning.DatastoreMigration, oldVersion versioning.VersionKey, newVersion versioning.VersionKey) versioning.VersionedMigration {
-	vm := versionedMigration{oldVersion, newVersion, datastoreMigration}
-	if _, ok := datastoreMigration.(versioning.ReversableDatastoreMigration); ok {
+	return newVersionedMigration(datastoreMigration, oldVersion, newVersion, nil)
+}
+
+// newVersionedMigration picks a wrapper with only the methods the datastore
+// migration supports, so checking a versioned migration for an optional
+// interface answers for the datastore migration inside it
+func newVersionedMigration(datastoreMigration versioning.DatastoreMigration, oldVersion versioning.VersionKey, newVersion versioning.VersionKey, indexes []versioning.Index) versioning.VersionedMigration {
+	vm := versionedMigration{oldVersion, newVersion, datastoreMigration, indexes}
+	_, reversible := datastoreMigration.(versioning.ReversableDatastoreMigration)
+	_, records := datastoreMigration.(versioning.RecordMigration)
+	_, recordsBack := datastoreMigration.(versioning.ReversibleRecordMigration)
+	switch {
+	case reversible && recordsBack:
+		return recordsBothWaysVersionedMigration{reversibleRecordVersionedMigration{recordVersionedMigration{vm}}}
+	case reversible && records:
+		return reversibleRecordVersionedMigration{recordVersionedMigration{vm}}
+	case reversible:
 		return reversibleVersionedMigration{vm}
+	case records:
+		return recordVersionedMigration{vm}
+	default:
+		return vm
 	}
-	return vm
 }
 
 // NewInitialVersionedMigration sets up a migration that starts from an unversioned datastore
 func NewInitialVersionedMigration(datastoreMigration versioning.DatastoreMigration, newVersion versioning.VersionKey) versioning.VersionedMigration {
 	return NewVersionedMigration(datastoreMigration, "", newVersion)
 }
+
+type dataCompatibleVersionedMigration struct {
+	versioning.VersionedMigration
+}
+
+func (dcvm dataCompatibleVersionedMigration) DataCompatible() bool {
+	return true
+}
+
+func (dcvm dataCompatibleVersionedMigration) Unwrap() versioning.VersionedMigration {
+	return dcvm.VersionedMigration
+}
+
+// DataCompatible marks a versioned migration as safe to migrate down past without
+// reversing it, because the previous version can read its records as they are.
+// Reversible migrations are returned unchanged, since they are always reversed.
+// Other migrations are wrapped, and versioning.MigrationAs finds what they implement
+func DataCompatible(migration versioning.VersionedMigration) versioning.VersionedMigration {
+	if _, ok := migration.(versioning.ReversibleVersionedMigration); ok {
+		return migration
+	}
+	return dataCompatibleVersionedMigration{migration}
+}
+
+// Validate checks the structure of a list of versioned migrations, reporting every
+// problem it finds: more than one migration to the same version, more than one
+// initial migration, gaps or branches between versions, migrations that loop back
+// to an earlier version, and migrations that take a different type of record than
+// the migration before them produces
+func Validate(migrations versioning.VersionedMigrationList) error {
+	return validate.CheckMigrationList(migrations)
+}
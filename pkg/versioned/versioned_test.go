@@ -3,6 +3,7 @@ package versioned_test
 import (
 	"bytes"
 	"context"
+	"reflect"
 	"testing"
 
 	"github.com/ipfs/go-datastore"
@@ -138,3 +139,91 @@ func TestExecuteMigration(t *testing.T) {
 	}
 
 }
+
+func TestDataCompatible(t *testing.T) {
+	migrateFunc := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		newCount := *c + 7
+		return &newCount, nil
+	}
+	byValue := func(key datastore.Key, value []byte) ([]versioning.IndexEntry, error) {
+		return []versioning.IndexEntry{{Key: datastore.NewKey(string(value)), Value: key.Bytes()}}, nil
+	}
+	migration, err := versioned.NewVersionedBuilder(migrateFunc, "2").OldVersion("1").Index("byValue", byValue).DataCompatible().Build()
+	require.NoError(t, err)
+
+	compatible, ok := migration.(versioning.DataCompatibleMigration)
+	require.True(t, ok)
+	require.True(t, compatible.DataCompatible())
+	_, ok = versioning.MigrationAs[versioning.RecordMigration](migration)
+	require.True(t, ok)
+	indexed, ok := versioning.MigrationAs[versioning.IndexedMigration](migration)
+	require.True(t, ok)
+	require.Len(t, indexed.Indexes(), 1)
+	typed, ok := versioning.MigrationAs[versioning.TypedMigration](migration)
+	require.True(t, ok)
+	require.Equal(t, reflect.TypeOf(new(cbg.CborInt)), typed.OutputType())
+	_, ok = versioning.MigrationAs[versioning.ReversibleVersionedMigration](migration)
+	require.False(t, ok)
+}
+
+type rawMigration struct{}
+
+func (rawMigration) Up(ctx context.Context, oldDs datastore.Batching, newDs datastore.Batching) ([]datastore.Key, error) {
+	return nil, nil
+}
+
+type reversibleRawMigration struct {
+	rawMigration
+}
+
+func (reversibleRawMigration) Down(ctx context.Context, newDs datastore.Batching, oldDs datastore.Batching) ([]datastore.Key, error) {
+	return nil, nil
+}
+
+func TestVersionedMigrationInterfaces(t *testing.T) {
+	migrateFunc := func(c *cbg.CborInt) (*cbg.CborInt, error) {
+		return c, nil
+	}
+	build := func(b versioned.Builder) versioning.VersionedMigration {
+		migration, err := b.Build()
+		require.NoError(t, err)
+		return migration
+	}
+	testCases := map[string]struct {
+		migration           versioning.VersionedMigration
+		expectedReversible  bool
+		expectedRecords     bool
+		expectedRecordsBack bool
+	}{
+		"datastore migration": {
+			migration: versioned.NewVersionedMigration(rawMigration{}, "1", "2"),
+		},
+		"reversible datastore migration": {
+			migration:          versioned.NewVersionedMigration(reversibleRawMigration{}, "1", "2"),
+			expectedReversible: true,
+		},
+		"record migration": {
+			migration:       build(versioned.NewVersionedBuilder(migrateFunc, "2").OldVersion("1")),
+			expectedRecords: true,
+		},
+		"reversible record migration": {
+			migration:           build(versioned.NewReversible(migrateFunc, migrateFunc, "2").OldVersion("1")),
+			expectedReversible:  true,
+			expectedRecords:     true,
+			expectedRecordsBack: true,
+		},
+		"data compatible datastore migration": {
+			migration: versioned.DataCompatible(versioned.NewVersionedMigration(rawMigration{}, "1", "2")),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			_, ok := versioning.MigrationAs[versioning.ReversibleVersionedMigration](data.migration)
+			require.Equal(t, data.expectedReversible, ok)
+			_, ok = versioning.MigrationAs[versioning.RecordMigration](data.migration)
+			require.Equal(t, data.expectedRecords, ok)
+			_, ok = versioning.MigrationAs[versioning.ReversibleRecordMigration](data.migration)
+			require.Equal(t, data.expectedRecordsBack, ok)
+		})
+	}
+}